@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/vklap/go_ddd/internal/entrypoints/http"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	config := http.DefaultConfig()
+	flag.StringVar(&config.Addr, "addr", config.Addr, "TCP address to listen on")
+	flag.StringVar(&config.RPCSocket, "rpc-socket", config.RPCSocket, "path of a Unix socket serving JSON-RPC requests (disabled when empty)")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", config.ShutdownTimeout, "time given to in-flight requests once stopped")
+	flag.Parse()
+
+	// SIGINT and SIGTERM stop accepting new requests, and let the in-flight ones finish within the shutdown timeout.
+	// A second signal terminates the process right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if err := http.Run(ctx, config); err != nil {
+		log.Printf("api stopped uncleanly: %v", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/vklap/go_ddd/internal/entrypoints/dddctl"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"io"
+	"os"
+	"strings"
+)
+
+const usage = `Usage: dddctl <command> [flags]
+
+Commands:
+  list                                      list the registered commands and events
+  send <CommandName> [-f file] [-user id=email]...
+                                            send a command read from a JSON file (or stdin),
+                                            and print its result and the events it triggered
+
+Examples:
+  dddctl send SaveUserCommand -f cmd.json
+  echo '{"user_id":"1","email":"eli.cohen@mossad.gov.il"}' | dddctl send SaveUserCommand
+`
+
+// users is a flag that can be repeated, such as -user 1=a@b.com -user 2=c@d.com.
+type users map[string]string
+
+func (u users) String() string {
+	return fmt.Sprint(map[string]string(u))
+}
+
+func (u users) Set(value string) error {
+	id, email, ok := strings.Cut(value, "=")
+	if ok == false || id == "" {
+		return errors.New("want id=email")
+	}
+	u[id] = email
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		exitUsage()
+	}
+	switch os.Args[1] {
+	case "list":
+		if err := dddctl.List(os.Stdout); err != nil {
+			exit(err)
+		}
+	case "send":
+		if len(os.Args) < 3 || strings.HasPrefix(os.Args[2], "-") {
+			exitUsage()
+		}
+		flags := flag.NewFlagSet("send", flag.ExitOnError)
+		file := flags.String("f", "-", "JSON file of the command, or - for stdin")
+		seeded := users{}
+		flags.Var(seeded, "user", "id=email of a user in the repository (can be repeated, defaults to the demo user 1)")
+		flags.Parse(os.Args[3:])
+		if len(seeded) == 0 {
+			seeded = dddctl.DefaultUsers
+		}
+
+		data, err := readInput(*file)
+		if err != nil {
+			exit(err)
+		}
+		if err = dddctl.Send(context.Background(), os.Args[2], data, seeded, os.Stdout); err != nil {
+			exit(err)
+		}
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		exitUsage()
+	}
+}
+
+func readInput(file string) ([]byte, error) {
+	if file == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(file)
+}
+
+func exit(err error) {
+	var e *ddd.Error
+	if errors.As(err, &e) {
+		fmt.Fprintf(os.Stderr, "error: %v (status code: %s)\n", err, e.StatusCode())
+	} else {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	}
+	os.Exit(1)
+}
+
+func exitUsage() {
+	fmt.Fprint(os.Stderr, usage)
+	os.Exit(2)
+}
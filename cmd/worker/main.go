@@ -1,7 +1,77 @@
 package main
 
-import "github.com/vklap/go_ddd/internal/entrypoints/worker"
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/vklap/go_ddd/internal/entrypoints/worker"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const usage = `Usage: worker [flags] [command]
+
+Commands:
+  run                        consume messages until stopped (default)
+  publish                    publish the demo commands, for a worker running in another process
+  quarantine list            list the quarantined messages
+  quarantine replay [id...]  handle the quarantined messages again (all of them when no id is given)
+
+Flags:
+`
 
 func main() {
-	worker.Start()
+	config := worker.DefaultConfig()
+	if dir := os.Getenv("GO_DDD_DATA_DIR"); dir != "" {
+		config.DataDir = dir
+	}
+	flag.StringVar(&config.DataDir, "data-dir", config.DataDir, "directory of the event store, the quarantine and the message broker (or GO_DDD_DATA_DIR)")
+	flag.DurationVar(&config.GracePeriod, "grace-period", config.GracePeriod, "time given to in-flight commands once stopped")
+	flag.IntVar(&config.Concurrency, "concurrency", config.Concurrency, "number of messages handled concurrently")
+	flag.IntVar(&config.MaxAttempts, "max-attempts", config.MaxAttempts, "number of failures before a message is quarantined")
+	flag.BoolVar(&config.PublishDemoCommands, "publish-demo", config.PublishDemoCommands, "publish the demo commands before consuming")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	// SIGINT and SIGTERM stop pulling new messages, and let the in-flight commands finish within the grace period.
+	// A second signal terminates the process right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	args := flag.Args()
+	switch {
+	case len(args) == 0 || args[0] == "run":
+		if err := worker.Run(ctx, config); err != nil {
+			log.Printf("worker stopped uncleanly: %v", err)
+			os.Exit(1)
+		}
+	case len(args) == 1 && args[0] == "publish":
+		if err := worker.Publish(ctx, config); err != nil {
+			log.Printf("publish failed: %v", err)
+			os.Exit(1)
+		}
+	case len(args) == 2 && args[0] == "quarantine" && args[1] == "list":
+		if err := worker.ListQuarantine(ctx, config, os.Stdout); err != nil {
+			log.Printf("list quarantine failed: %v", err)
+			os.Exit(1)
+		}
+	case len(args) >= 2 && args[0] == "quarantine" && args[1] == "replay":
+		replayed, err := worker.ReplayQuarantine(ctx, config, args[2:]...)
+		log.Printf("replayed %d quarantined messages", replayed)
+		if err != nil {
+			log.Printf("replay quarantine failed: %v", err)
+			os.Exit(1)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
 }
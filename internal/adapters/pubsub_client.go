@@ -4,98 +4,224 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/vklap/go_ddd/internal/domain/command_model"
 	"github.com/vklap/go_ddd/pkg/ddd"
+	"github.com/vklap/go_ddd/pkg/ddd/broker"
 	"log"
+	"sync"
 )
 
+// The topics of the demo's message broker.
+const (
+	// CommandsTopic is the topic of the commands handled by the worker.
+	CommandsTopic = "commands"
+	// EmailChangedTopic is the topic of the integration events about changed emails.
+	EmailChangedTopic = "user-email-changed"
+	// KPITopic is the topic of the notifications sent to the KPI service.
+	KPITopic = "kpi"
+)
+
+// WorkerGroup is the consumer group of the worker.
+const WorkerGroup = "worker"
+
 type PubSubClient interface {
-	GetSaveUserMessages(ctx context.Context) (chan []byte, error)
-	NotifyEmailChanged(ctx context.Context, userId string, newEmail string, oldEmail string) error
+	ddd.Subscriber
 	NotifyKPIService(ctx context.Context, e *command_model.KPIEvent) error
 	ddd.RollbackCommitter
 }
 
 // InMemoryPubSubClient is used for demo purposes.
+// It consumes the commands of a message broker (an in-process one unless created by NewPubSubClient),
+// and publishes its notifications to the broker once the unit of work that sent them commits.
+// It also publishes the integration events (see integration.Publisher), and keeps a few flags that are used by the unit tests.
+// The handlers of the worker run concurrently, so the flags are set while holding mu.
 type InMemoryPubSubClient struct {
-	Commands                 []*command_model.SaveUserCommand
-	CommitCalled             bool
-	CommitShouldFail         bool
-	MailSent                 bool
-	NotifyEmailSetCalled     bool
-	NotifyEmailSetFailed     bool
-	NotifyEmailSetNewEmail   string
-	NotifyEmailSetOldEmail   string
-	NotifyEmailSetShouldFail bool
-	NotifyEmailSetUserId     string
-	NotifyKPICalled          bool
-	KPIEvent                 *command_model.KPIEvent
-	RollbackCalled           bool
-	RollbackShouldFail       bool
-	KPIEventSent             bool
+	Broker              broker.Broker
+	Acked               int
+	Nacked              int
+	CommitCalled        bool
+	CommitShouldFail    bool
+	NotifyKPICalled     bool
+	NotifyKPIShouldFail bool
+	KPIEvent            *command_model.KPIEvent
+	RollbackCalled      bool
+	RollbackShouldFail  bool
+	KPIEventSent        bool
+	mu                  sync.Mutex
+	pending             map[*ddd.UnitOfWork][]pendingRecord
+	published           map[string][]broker.Record
+}
+
+// pendingRecord is a notification that is published once its unit of work commits.
+type pendingRecord struct {
+	topic  string
+	record broker.Record
 }
 
 func NewInMemoryPubSubClient() *InMemoryPubSubClient {
-	return &InMemoryPubSubClient{Commands: make([]*command_model.SaveUserCommand, 0)}
+	return NewPubSubClient(broker.NewInMemoryBroker())
+}
+
+// NewPubSubClient creates a client of the given broker, such as a broker.FileBroker shared with other processes.
+func NewPubSubClient(b broker.Broker) *InMemoryPubSubClient {
+	return &InMemoryPubSubClient{
+		Broker:    b,
+		pending:   make(map[*ddd.UnitOfWork][]pendingRecord),
+		published: make(map[string][]broker.Record),
+	}
+}
+
+// Publish publishes the records to the topic of the broker right away, and keeps them for PublishedTo.
+func (c *InMemoryPubSubClient) Publish(ctx context.Context, topic string, records ...broker.Record) error {
+	if err := c.Broker.Publish(ctx, topic, records...); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.published[topic] = append(c.published[topic], records...)
+	return nil
+}
+
+// PublishedTo returns the records published to the topic by Publish.
+func (c *InMemoryPubSubClient) PublishedTo(topic string) []broker.Record {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]broker.Record(nil), c.published[topic]...)
+}
+
+// PublishCommands publishes the commands to CommandsTopic, wrapped by envelopes.
+// The commands with the same key, such as the ID of the user they change, are handled in order.
+func (c *InMemoryPubSubClient) PublishCommands(ctx context.Context, key string, commands ...ddd.Command) error {
+	records := make([]broker.Record, 0, len(commands))
+	for _, command := range commands {
+		data, err := ddd.NewEnvelope(command.CommandName(), command)
+		if err != nil {
+			return err
+		}
+		records = append(records, broker.Record{Key: key, Data: data})
+	}
+	return c.Broker.Publish(ctx, CommandsTopic, records...)
 }
 
-func (c *InMemoryPubSubClient) GetSaveUserMessages(ctx context.Context) (chan []byte, error) {
-	messages := make(chan []byte)
+// Subscribe delivers the commands published to CommandsTopic to the WorkerGroup, until ctx is done.
+// It counts how many of them were acked and nacked.
+func (c *InMemoryPubSubClient) Subscribe(ctx context.Context) (<-chan ddd.Message, error) {
+	deliveries, err := c.Broker.Subscribe(ctx, CommandsTopic, WorkerGroup)
+	if err != nil {
+		return nil, err
+	}
+	messages := make(chan ddd.Message)
 	go func() {
-		for _, command := range c.Commands {
-			data, err := json.Marshal(command)
-			if err != nil {
-				panic(err)
+		defer close(messages)
+		for message := range deliveries {
+			select {
+			case messages <- &countedMessage{Delivery: message.(broker.Delivery), client: c}:
+			case <-ctx.Done():
+				message.Nack(ctx, ctx.Err())
+				return
 			}
-			messages <- data
 		}
-		close(messages)
 	}()
 	return messages, nil
 }
 
-func (c *InMemoryPubSubClient) NotifyEmailChanged(ctx context.Context, userId string, newEmail, oldEmail string) error {
-	if c.NotifyEmailSetFailed {
-		return errors.New("notify email changed failed")
-	}
-	c.NotifyEmailSetCalled = true
-	if c.NotifyEmailSetShouldFail {
-		return errors.New("notify email changed has failed")
+// publishLater queues the notification until the unit of work of ctx commits.
+func (c *InMemoryPubSubClient) publishLater(ctx context.Context, topic string, key string, message any) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
 	}
-	c.NotifyEmailSetNewEmail = newEmail
-	c.NotifyEmailSetOldEmail = oldEmail
-	c.NotifyEmailSetUserId = userId
-	log.Printf("requested to send EmailChanged notification: userID=%q, oldEmail=%q, newEmail=%q", userId, oldEmail, newEmail)
+	uow, _ := ddd.UnitOfWorkFromContext(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pending[uow] = append(c.pending[uow], pendingRecord{topic: topic, record: broker.Record{Key: key, Data: data}})
 	return nil
 }
 
+// takePending removes and returns the notifications queued by the unit of work of ctx.
+func (c *InMemoryPubSubClient) takePending(ctx context.Context) []pendingRecord {
+	uow, _ := ddd.UnitOfWorkFromContext(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending := c.pending[uow]
+	delete(c.pending, uow)
+	return pending
+}
+
 func (c *InMemoryPubSubClient) NotifyKPIService(ctx context.Context, e *command_model.KPIEvent) error {
+	c.mu.Lock()
 	c.NotifyKPICalled = true
-	c.KPIEvent = e
+	shouldFail := c.NotifyKPIShouldFail
+	if shouldFail == false {
+		c.KPIEvent = e
+	}
+	c.mu.Unlock()
+	if shouldFail {
+		return errors.New("notify KPI service has failed")
+	}
+	if err := c.publishLater(ctx, KPITopic, "", e); err != nil {
+		return err
+	}
 	log.Printf("notfiied KPI service: %v", e)
 	return nil
 }
 
 func (c *InMemoryPubSubClient) Commit(ctx context.Context) error {
+	c.mu.Lock()
 	c.CommitCalled = true
-	if c.CommitShouldFail {
-		return errors.New("commit failed")
+	shouldFail := c.CommitShouldFail
+	if shouldFail == false && c.NotifyKPICalled {
+		c.KPIEventSent = true
 	}
-	if c.NotifyEmailSetCalled {
-		c.MailSent = true
+	c.mu.Unlock()
+	if shouldFail {
+		return errors.New("commit failed")
 	}
-	if c.NotifyKPICalled {
-		c.KPIEventSent = true
+	for _, pending := range c.takePending(ctx) {
+		if err := c.Broker.Publish(ctx, pending.topic, pending.record); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
 func (c *InMemoryPubSubClient) Rollback(ctx context.Context) error {
+	c.mu.Lock()
 	c.RollbackCalled = true
-	if c.RollbackShouldFail {
+	shouldFail := c.RollbackShouldFail
+	c.mu.Unlock()
+	c.takePending(ctx)
+	if shouldFail {
 		return errors.New("rollback failed")
 	}
 	return nil
 }
 
+// countedMessage counts the acknowledgements of the messages delivered by the broker.
+type countedMessage struct {
+	broker.Delivery
+	client *InMemoryPubSubClient
+}
+
+func (m *countedMessage) Ack(ctx context.Context) error {
+	m.client.mu.Lock()
+	m.client.Acked++
+	m.client.mu.Unlock()
+	return m.Delivery.Ack(ctx)
+}
+
+func (m *countedMessage) Nack(ctx context.Context, err error) error {
+	m.client.mu.Lock()
+	m.client.Nacked++
+	m.client.mu.Unlock()
+	return m.Delivery.Nack(ctx, err)
+}
+
 var _ PubSubClient = (*InMemoryPubSubClient)(nil)
+var _ broker.Publisher = (*InMemoryPubSubClient)(nil)
+var _ ddd.IdentifiedMessage = (*countedMessage)(nil)
@@ -3,63 +3,54 @@ package adapters
 import (
 	"context"
 	"errors"
-	"fmt"
 	"github.com/vklap/go_ddd/internal/domain/command_model"
 	"github.com/vklap/go_ddd/pkg/ddd"
+	"sync"
 )
 
 type Repository interface {
-	GetUserById(ctx context.Context, id string) (*command_model.User, error)
-	SaveUser(ctx context.Context, user *command_model.User) error
-	ddd.RollbackCommitter
+	ddd.Repository[*command_model.User]
 }
 
 // InMemoryRepository is used for demo purposes.
 // In the real world it might be a MongoDBRepository, PostgresqlRepository, etc.
+// It is composed of ddd.InMemoryRepository which provides the transactional storage,
+// and adds a few flags that are used by the unit tests.
+// The handlers of the worker run concurrently, so the flags are set while holding mu.
 type InMemoryRepository struct {
+	*ddd.InMemoryRepository[*command_model.User]
 	CommitCalled       bool
 	CommitShouldFail   bool
 	RollbackCalled     bool
 	RollbackShouldFail bool
-	UsersById          map[string]*command_model.User
-	savedUsers         []*command_model.User
+	mu                 sync.Mutex
 }
 
 func NewInMemoryRepository() *InMemoryRepository {
-	return &InMemoryRepository{UsersById: make(map[string]*command_model.User)}
-}
-
-func (r *InMemoryRepository) GetUserById(ctx context.Context, id string) (*command_model.User, error) {
-	user, ok := r.UsersById[id]
-	if ok == false {
-		return nil, ddd.NewError(fmt.Sprintf("user with id %q does not exist", id), ddd.StatusCodeNotFound)
-	}
-	return user, nil
-}
-
-func (r *InMemoryRepository) SaveUser(ctx context.Context, user *command_model.User) error {
-	r.savedUsers = append(r.savedUsers, user)
-	return nil
+	return &InMemoryRepository{InMemoryRepository: ddd.NewInMemoryRepository((*command_model.User).Clone)}
 }
 
 func (r *InMemoryRepository) Commit(ctx context.Context) error {
+	r.mu.Lock()
 	r.CommitCalled = true
-	if r.CommitShouldFail {
+	shouldFail := r.CommitShouldFail
+	r.mu.Unlock()
+	if shouldFail {
 		return errors.New("commit failed")
 	}
-	for _, user := range r.savedUsers {
-		r.UsersById[user.ID()] = user
-	}
-	return nil
+	return r.InMemoryRepository.Commit(ctx)
 }
 
 func (r *InMemoryRepository) Rollback(ctx context.Context) error {
+	r.mu.Lock()
 	r.RollbackCalled = true
-	if r.RollbackShouldFail {
+	shouldFail := r.RollbackShouldFail
+	r.mu.Unlock()
+	if shouldFail {
 		return errors.New("rollback failed")
 	}
-	r.savedUsers = make([]*command_model.User, 0)
-	return nil
+	return r.InMemoryRepository.Rollback(ctx)
 }
 
 var _ Repository = (*InMemoryRepository)(nil)
+var _ ddd.Savepointer = (*InMemoryRepository)(nil)
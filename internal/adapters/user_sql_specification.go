@@ -0,0 +1,72 @@
+package adapters
+
+import (
+	"fmt"
+	"github.com/vklap/go_ddd/internal/domain/command_model"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"strings"
+)
+
+// UserSQLWhereClause translates a user specification into an SQL WHERE clause.
+// It demonstrates how a database backed repository (such as a PostgresqlRepository) can reuse
+// the business rules written in the domain layer, instead of duplicating them in its queries.
+func UserSQLWhereClause(specification ddd.Specification[*command_model.User]) (string, error) {
+	visitor := &userSQLVisitor{}
+	if err := ddd.Visit[*command_model.User](specification, visitor); err != nil {
+		return "", err
+	}
+	return visitor.clause.String(), nil
+}
+
+type userSQLVisitor struct {
+	clause strings.Builder
+}
+
+// VisitAnd joins the specifications with AND. Like ddd.And, an empty conjunction is satisfied by every user.
+func (v *userSQLVisitor) VisitAnd(specifications []ddd.Specification[*command_model.User]) error {
+	if len(specifications) == 0 {
+		v.clause.WriteString("TRUE")
+		return nil
+	}
+	return v.join(" AND ", specifications)
+}
+
+// VisitOr joins the specifications with OR. Like ddd.Or, an empty disjunction is satisfied by no user.
+func (v *userSQLVisitor) VisitOr(specifications []ddd.Specification[*command_model.User]) error {
+	if len(specifications) == 0 {
+		v.clause.WriteString("FALSE")
+		return nil
+	}
+	return v.join(" OR ", specifications)
+}
+
+func (v *userSQLVisitor) VisitNot(specification ddd.Specification[*command_model.User]) error {
+	v.clause.WriteString("NOT ")
+	return v.join("", []ddd.Specification[*command_model.User]{specification})
+}
+
+func (v *userSQLVisitor) VisitLeaf(specification ddd.Specification[*command_model.User]) error {
+	switch specification.(type) {
+	case command_model.ActiveUserSpecification:
+		v.clause.WriteString("active = TRUE")
+	case command_model.VerifiedEmailSpecification:
+		v.clause.WriteString("email_verified = TRUE")
+	default:
+		return fmt.Errorf("specification %T cannot be translated to SQL", specification)
+	}
+	return nil
+}
+
+func (v *userSQLVisitor) join(separator string, specifications []ddd.Specification[*command_model.User]) error {
+	v.clause.WriteString("(")
+	for i, specification := range specifications {
+		if i > 0 {
+			v.clause.WriteString(separator)
+		}
+		if err := ddd.Visit[*command_model.User](specification, v); err != nil {
+			return err
+		}
+	}
+	v.clause.WriteString(")")
+	return nil
+}
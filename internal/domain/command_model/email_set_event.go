@@ -4,9 +4,9 @@ import "github.com/vklap/go_ddd/pkg/ddd"
 
 // EmailSetEvent contains the data required to notify about the email modification.
 type EmailSetEvent struct {
-	UserID        string
-	OriginalEmail string
-	NewEmail      string
+	UserID        string `json:"user_id"`
+	OriginalEmail string `json:"original_email"`
+	NewEmail      string `json:"new_email"`
 }
 
 func (e *EmailSetEvent) EventName() string {
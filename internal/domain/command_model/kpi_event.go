@@ -6,8 +6,8 @@ import (
 
 // KPIEvent contains data for KPI (Key Performance Indicators) metrics.
 type KPIEvent struct {
-	Action string
-	Data   string
+	Action string `json:"action"`
+	Data   string `json:"data"`
 }
 
 func (e *KPIEvent) EventName() string {
@@ -2,23 +2,59 @@ package command_model
 
 import "github.com/vklap/go_ddd/pkg/ddd"
 
-// User is composed of ddd.BaseEntity which exposes the entity's ID and Events,
+// User is an aggregate root composed of ddd.BaseEntity which exposes the entity's ID and Events,
 // and the user's Email.
 type User struct {
 	ddd.BaseEntity
-	email string
+	email         ddd.Email
+	emailVerified bool
+	active        bool
 }
 
-func (u *User) Email() string {
+// NewUser creates a new user, whose ID is assigned by the given generator.
+func NewUser(generator ddd.IDGenerator) (*User, error) {
+	base, err := ddd.NewBaseEntity(generator)
+	if err != nil {
+		return nil, err
+	}
+	return &User{BaseEntity: base}, nil
+}
+
+func (u *User) Email() ddd.Email {
 	return u.email
 }
 
-func (u *User) SetEmail(value string) {
-	if value != "" && u.email != value {
-		u.AddEvent(&EmailSetEvent{UserID: u.ID(), NewEmail: value, OriginalEmail: u.email})
+// Clone returns a copy of the user, so that repositories can keep users isolated from the changes of their callers.
+func (u *User) Clone() *User {
+	clone := *u
+	return &clone
+}
+
+// SetEmail sets the user's email. Being a ddd.Email value object, the email is valid by construction.
+// A new email has to be verified again.
+func (u *User) SetEmail(value ddd.Email) {
+	if value.IsZero() == false && u.email.Equals(value) == false {
+		u.AddEvent(&EmailSetEvent{UserID: u.ID(), NewEmail: value.String(), OriginalEmail: u.email.String()})
+		u.emailVerified = false
 	}
 	u.email = value
 }
 
-// The below line ensures at compile time that User adheres to the ddd.Entity interface
-var _ ddd.Entity = (*User)(nil)
+func (u *User) EmailVerified() bool {
+	return u.emailVerified
+}
+
+func (u *User) VerifyEmail() {
+	u.emailVerified = true
+}
+
+func (u *User) IsActive() bool {
+	return u.active
+}
+
+func (u *User) SetActive(value bool) {
+	u.active = value
+}
+
+// The below line ensures at compile time that User adheres to the ddd.AggregateRoot interface
+var _ ddd.AggregateRoot = (*User)(nil)
@@ -0,0 +1,27 @@
+package command_model
+
+import "github.com/vklap/go_ddd/pkg/ddd"
+
+// ActiveUserSpecification is satisfied by active users.
+type ActiveUserSpecification struct{}
+
+func (s ActiveUserSpecification) IsSatisfiedBy(user *User) bool {
+	return user.IsActive()
+}
+
+// VerifiedEmailSpecification is satisfied by users whose email was verified.
+type VerifiedEmailSpecification struct{}
+
+func (s VerifiedEmailSpecification) IsSatisfiedBy(user *User) bool {
+	return user.EmailVerified()
+}
+
+// ActiveUsersWithUnverifiedEmail is the business rule selecting the users that should be reminded
+// to verify their email. Repositories can either evaluate it in memory, or translate it into their query language.
+func ActiveUsersWithUnverifiedEmail() ddd.Specification[*User] {
+	return ddd.And[*User](ActiveUserSpecification{}, ddd.Not[*User](VerifiedEmailSpecification{}))
+}
+
+// The below lines ensure at compile time that the specifications adhere to the ddd.Specification interface
+var _ ddd.Specification[*User] = ActiveUserSpecification{}
+var _ ddd.Specification[*User] = VerifiedEmailSpecification{}
@@ -6,49 +6,130 @@ import (
 	"github.com/vklap/go_ddd/internal/domain/command_model"
 	"github.com/vklap/go_ddd/internal/service_layer/command_handlers"
 	"github.com/vklap/go_ddd/internal/service_layer/event_handlers"
+	"github.com/vklap/go_ddd/internal/service_layer/integration_events"
 	"github.com/vklap/go_ddd/pkg/ddd"
+	"github.com/vklap/go_ddd/pkg/ddd/broker"
+	"github.com/vklap/go_ddd/pkg/ddd/integration"
 )
 
-var Instance *DemoBootstrapper
-
-// init creates the Bootstrapper instance and registers the command and event handlers.
-func init() {
-	Instance = New()
-}
-
+// DemoBootstrapper gives the entrypoints (and tests) access to the adapters resolved from the Bootstrapper.
 type DemoBootstrapper struct {
 	PubSubClient *adapters.InMemoryPubSubClient
-	Repository   *adapters.InMemoryRepository
+	// Broker is the message broker of the PubSubClient.
+	Broker     broker.Broker
+	Repository *adapters.InMemoryRepository
+	// EventStore records the EmailSetEvents, so the users can be restored after a restart.
+	EventStore   ddd.EventStore
 	Bootstrapper *ddd.Bootstrapper
 }
 
-// New creates and initializes the bootstrapper.
-// Please notice that in a real world scenario you may not require such a custom "DemoBootstrapper",
-// and that the adapter instances should most probably be created within the register callbacks, like so:
-//
-//	bs.Bootstrapper.RegisterCommandHandlerFactory(&command_model.SaveUserCommand{}, func() (ddd.CommandHandler, error) {
-//		return command_handlers.NewSaveUserCommandHandler(adapters.NewInMemoryRepository()), nil
-//	})
+// NewCodec creates a codec for the commands received by the worker, and the events recorded in the EventStore.
+func NewCodec() *ddd.Codec {
+	codec := ddd.NewCodec()
+	codec.RegisterCommand(&command_model.SaveUserCommand{})
+	codec.RegisterEvent(&command_model.EmailSetEvent{})
+	codec.RegisterEvent(&command_model.KPIEvent{})
+	return codec
+}
+
+// New creates and initializes the bootstrapper, with an in memory EventStore.
 func New() *DemoBootstrapper {
-	bs := &DemoBootstrapper{
-		PubSubClient: adapters.NewInMemoryPubSubClient(),
-		Repository:   adapters.NewInMemoryRepository(),
-		Bootstrapper: ddd.NewBootstrapper(),
+	return NewWithEventStore(ddd.NewInMemoryEventStore())
+}
+
+// NewWithEventStore creates and initializes the bootstrapper, with an in-process message broker.
+func NewWithEventStore(eventStore ddd.EventStore) *DemoBootstrapper {
+	return NewWithAdapters(eventStore, broker.NewInMemoryBroker())
+}
+
+// NewWithAdapters creates and initializes the bootstrapper, which is sealed (see ddd.Bootstrapper.Seal).
+// The broker is closed when the bootstrapper is shut down.
+// The adapters are provided as singletons, since the in memory ones hold the demo's data.
+// In a real world scenario, a repository wrapping a DB transaction would rather be provided as ddd.Scoped,
+// so that all the handlers of a command share the transaction.
+func NewWithAdapters(eventStore ddd.EventStore, messageBroker broker.Broker) *DemoBootstrapper {
+	b := ddd.NewBootstrapper()
+	pubSubClient := adapters.NewPubSubClient(messageBroker)
+	must(ddd.Provide(b, ddd.Singleton, func(scope *ddd.Scope) (*adapters.InMemoryPubSubClient, error) {
+		return pubSubClient, nil
+	}))
+	must(ddd.Provide(b, ddd.Singleton, func(scope *ddd.Scope) (adapters.PubSubClient, error) {
+		return ddd.Resolve[*adapters.InMemoryPubSubClient](scope)
+	}))
+	must(ddd.Provide(b, ddd.Singleton, func(scope *ddd.Scope) (broker.Broker, error) {
+		return messageBroker, nil
+	}))
+	must(ddd.Provide(b, ddd.Singleton, func(scope *ddd.Scope) (broker.Publisher, error) {
+		return ddd.Resolve[broker.Broker](scope)
+	}))
+	must(ddd.Provide(b, ddd.Singleton, func(scope *ddd.Scope) (*adapters.InMemoryRepository, error) {
+		return adapters.NewInMemoryRepository(), nil
+	}))
+	must(ddd.Provide(b, ddd.Singleton, func(scope *ddd.Scope) (adapters.Repository, error) {
+		return ddd.Resolve[*adapters.InMemoryRepository](scope)
+	}))
+	must(ddd.Provide(b, ddd.Singleton, func(scope *ddd.Scope) (ddd.EventStore, error) {
+		return eventStore, nil
+	}))
+
+	must(b.RegisterScopedCommandHandlerFactory(&command_model.SaveUserCommand{}, func(scope *ddd.Scope) (ddd.CommandHandler, error) {
+		repository, err := ddd.Resolve[adapters.Repository](scope)
+		if err != nil {
+			return nil, err
+		}
+		return command_handlers.NewSaveUserCommandHandler(repository), nil
+	}))
+	must(b.RegisterEventHandlerFactory(&command_model.EmailSetEvent{}, func() (ddd.EventHandler, error) {
+		return event_handlers.NewEmailSetEventHandler(), nil
+	}))
+	must(b.RegisterScopedEventHandlerFactory(&command_model.EmailSetEvent{}, func(scope *ddd.Scope) (ddd.EventHandler, error) {
+		store, err := ddd.Resolve[ddd.EventStore](scope)
+		if err != nil {
+			return nil, err
+		}
+		return ddd.NewEventRecorder(store, UserStreamID)()
+	}))
+	// The EmailChanged integration event is published by the pubsub client, once the command that set the email commits.
+	must(integration.NewPublisher(pubSubClient).Register(b, &command_model.EmailSetEvent{}, integration_events.TranslateEmailSetEvent))
+	must(b.RegisterScopedEventHandlerFactory(&command_model.KPIEvent{}, func(scope *ddd.Scope) (ddd.EventHandler, error) {
+		pubSubClient, err := ddd.Resolve[adapters.PubSubClient](scope)
+		if err != nil {
+			return nil, err
+		}
+		return event_handlers.NewKPIEventHandler(pubSubClient), nil
+	}))
+
+	scope := b.NewScope()
+	demo := &DemoBootstrapper{
+		PubSubClient: mustResolve[*adapters.InMemoryPubSubClient](scope),
+		Broker:       mustResolve[broker.Broker](scope),
+		Repository:   mustResolve[*adapters.InMemoryRepository](scope),
+		EventStore:   mustResolve[ddd.EventStore](scope),
+		Bootstrapper: b,
 	}
-	bs.Bootstrapper.RegisterCommandHandlerFactory(&command_model.SaveUserCommand{}, func() (ddd.CommandHandler, error) {
-		return command_handlers.NewSaveUserCommandHandler(bs.Repository), nil
-	})
-	bs.Bootstrapper.RegisterEventHandlerFactory(&command_model.EmailSetEvent{}, func() (ddd.EventHandler, error) {
-		return event_handlers.NewEmailSetEventHandler(bs.PubSubClient), nil
+	// Closing the broker ends its subscriptions, once the bootstrapper drained the commands being handled.
+	b.OnStop(func(ctx context.Context) error {
+		return demo.Broker.Close()
 	})
-	bs.Bootstrapper.RegisterEventHandlerFactory(&command_model.KPIEvent{}, func() (ddd.EventHandler, error) {
-		return event_handlers.NewKPIEventHandler(bs.PubSubClient), nil
-	})
-	return bs
+	// The wiring is complete, so the handlers and dependencies cannot be changed while commands are handled.
+	b.Seal()
+	return demo
+}
+
+// UserStreamID returns the ID of the EventStore stream of the user the event belongs to.
+func UserStreamID(event ddd.Event) string {
+	return "user-" + event.(*command_model.EmailSetEvent).UserID
+}
+
+// must panics on wiring errors, which are programming errors.
+func must(err error) {
+	if err != nil {
+		panic(err)
+	}
 }
 
-// HandleCommand encapsulates the Bootstrapper HandleCommand, and gives a strongly typed interface
-// provided by go's generics.
-func HandleCommand[Command ddd.Command](ctx context.Context, command Command) (any, error) {
-	return Instance.Bootstrapper.HandleCommand(ctx, command)
+func mustResolve[T any](scope *ddd.Scope) T {
+	value, err := ddd.Resolve[T](scope)
+	must(err)
+	return value
 }
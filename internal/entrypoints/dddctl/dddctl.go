@@ -0,0 +1,78 @@
+package dddctl
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/vklap/go_ddd/internal/domain/command_model"
+	"github.com/vklap/go_ddd/internal/entrypoints/boostrapper"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"io"
+	"sort"
+)
+
+// DefaultUsers are the users that commands are sent to, unless other users are given.
+var DefaultUsers = map[string]string{"1": "kamel.amin@thaabet.sy"}
+
+// List writes the commands and events registered in the sample bootstrapper to out.
+func List(out io.Writer) error {
+	bs := boostrapper.New()
+	codec := boostrapper.NewCodec()
+	fmt.Fprintln(out, "Commands:")
+	for _, name := range bs.Bootstrapper.CommandNames() {
+		decodable := ""
+		if codec.HasCommand(name) == false {
+			decodable = " (cannot be sent: not registered in the codec)"
+		}
+		fmt.Fprintf(out, "  %s%s\n", name, decodable)
+	}
+	fmt.Fprintln(out, "Events:")
+	for _, name := range bs.Bootstrapper.EventNames() {
+		count := bs.Bootstrapper.EventHandlerCount(name)
+		handlers := "handlers"
+		if count == 1 {
+			handlers = "handler"
+		}
+		fmt.Fprintf(out, "  %s (%d %s)\n", name, count, handlers)
+	}
+	return nil
+}
+
+// Send decodes the JSON data into the command with the given name, and handles it with the sample bootstrapper,
+// whose repository holds the given users (by ID). It writes the result, and the tree of the events it triggered, to out.
+func Send(ctx context.Context, name string, data []byte, users map[string]string, out io.Writer) error {
+	bs := boostrapper.New()
+	ids := make([]string, 0, len(users))
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		email, err := ddd.NewEmail(users[id])
+		if err != nil {
+			return fmt.Errorf("invalid user %q: %w", id, err)
+		}
+		user := &command_model.User{}
+		user.SetID(id)
+		user.SetEmail(email)
+		// The seeded users are not changed by the command, so their events are dropped.
+		user.PullEvents()
+		bs.Repository.Add(user)
+	}
+
+	command, err := boostrapper.NewCodec().DecodeCommand(name, data)
+	if err != nil {
+		return err
+	}
+	ctx, trace := ddd.WithTrace(ctx)
+	result, err := bs.Bootstrapper.HandleCommand(ctx, command)
+	if err == nil {
+		encoded, encodeErr := json.Marshal(result)
+		if encodeErr != nil {
+			return fmt.Errorf("failed to encode result: %w", encodeErr)
+		}
+		fmt.Fprintf(out, "Result: %s\n", encoded)
+	}
+	fmt.Fprintf(out, "Trace:\n%s", trace)
+	return err
+}
@@ -0,0 +1,166 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vklap/go_ddd/internal/domain/command_model"
+	"github.com/vklap/go_ddd/internal/entrypoints/boostrapper"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"github.com/vklap/go_ddd/pkg/ddd/httpapi"
+	"github.com/vklap/go_ddd/pkg/ddd/jsonrpc"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Config contains the settings of the HTTP API.
+type Config struct {
+	// Addr is the TCP address the API listens on, such as ":8080".
+	Addr string
+	// RPCSocket is the path of a Unix socket that serves JSON-RPC requests, in addition to `POST /rpc`.
+	// It is disabled when empty.
+	RPCSocket string
+	// ShutdownTimeout is the time that the requests being served are given to finish once the API is stopped.
+	ShutdownTimeout time.Duration
+}
+
+// DefaultConfig returns the default settings of the HTTP API.
+func DefaultConfig() Config {
+	return Config{Addr: ":8080", ShutdownTimeout: 10 * time.Second}
+}
+
+// UserView is the result of the GetUser query.
+type UserView struct {
+	UserID string `json:"user_id"`
+	Email  string `json:"email"`
+}
+
+// NewHandler mounts the commands of the bootstrapper as `POST /commands/{name}`,
+// such as `POST /commands/SaveUserCommand`, and the GetUser query as `GET /queries/GetUser?user_id={id}`.
+// The commands are also exposed as JSON-RPC methods by `POST /rpc`.
+func NewHandler(bs *boostrapper.DemoBootstrapper) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/rpc", NewRPCServer(bs))
+	mux.Handle("/", newAPIHandler(bs))
+	return mux
+}
+
+// NewRPCServer exposes the commands of the bootstrapper as JSON-RPC methods, such as `SaveUserCommand`.
+func NewRPCServer(bs *boostrapper.DemoBootstrapper) *jsonrpc.Server {
+	return jsonrpc.NewServer(bs.Bootstrapper, boostrapper.NewCodec(),
+		jsonrpc.WithErrorHandler(func(ctx context.Context, method string, err error) {
+			log.Printf("rpc %s failed: %v", method, err)
+		}),
+	)
+}
+
+func newAPIHandler(bs *boostrapper.DemoBootstrapper) http.Handler {
+	return httpapi.NewHandler(bs.Bootstrapper, boostrapper.NewCodec(),
+		httpapi.WithQuery("GetUser", func(ctx context.Context, params url.Values) (any, error) {
+			user, err := bs.Repository.Get(ctx, params.Get("user_id"))
+			if err != nil {
+				return nil, err
+			}
+			return &UserView{UserID: user.ID(), Email: user.Email().String()}, nil
+		}),
+		httpapi.WithErrorHandler(func(r *http.Request, err error) {
+			log.Printf("%s %s failed: %v", r.Method, r.URL.Path, err)
+		}),
+	)
+}
+
+// Run serves the HTTP API (and the JSON-RPC socket) until ctx is done (such as when the process is signaled),
+// and then lets the requests being served finish within the shutdown timeout.
+func Run(ctx context.Context, config Config) error {
+	bs := boostrapper.New()
+
+	// Setup InMemory fake data
+	user, err := command_model.NewUser(ddd.NewSequenceGenerator(""))
+	if err != nil {
+		return err
+	}
+	email, err := ddd.NewEmail("kamel.amin@thaabet.sy")
+	if err != nil {
+		return err
+	}
+	user.SetEmail(email)
+	bs.Repository.Add(user)
+
+	// The address is bound before logging it, so a port in use fails the start rather than the serving.
+	httpListener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return fmt.Errorf("listen failed: %w", err)
+	}
+	var listener net.Listener
+	if config.RPCSocket != "" {
+		if listener, err = listenUnix(config.RPCSocket); err != nil {
+			httpListener.Close()
+			return err
+		}
+	}
+	if err = bs.Bootstrapper.Start(ctx); err != nil {
+		httpListener.Close()
+		if listener != nil {
+			listener.Close()
+		}
+		return err
+	}
+	server := &http.Server{Handler: NewHandler(bs), ReadHeaderTimeout: 10 * time.Second}
+	log.Printf("listening on %s", httpListener.Addr())
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(httpListener)
+	}()
+
+	// The socket's connections are only closed once the bootstrapper drained the commands being handled,
+	// so it is served with its own context.
+	rpcCtx, stopRPC := context.WithCancel(context.Background())
+	defer stopRPC()
+	var rpcServed chan error
+	if listener != nil {
+		rpcServed = make(chan error, 1)
+		go func() {
+			rpcServed <- NewRPCServer(bs).Serve(rpcCtx, listener)
+		}()
+		log.Printf("serving JSON-RPC on %s", config.RPCSocket)
+	}
+
+	select {
+	case err = <-served:
+		err = fmt.Errorf("serve failed: %w", err)
+	case err = <-rpcServed:
+		err = fmt.Errorf("serve rpc failed: %w", err)
+		rpcServed = nil
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	// Stop accepting requests first, so the commands they send are drained by the bootstrapper's shutdown.
+	if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+		err = fmt.Errorf("shutdown failed: %w", shutdownErr)
+	}
+	if shutdownErr := bs.Bootstrapper.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+		err = fmt.Errorf("shutdown failed: %w", shutdownErr)
+	}
+	stopRPC()
+	if rpcServed != nil {
+		<-rpcServed
+	}
+	return err
+}
+
+// listenUnix listens on the Unix socket, and removes the socket file left by a previous run (if any).
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && errors.Is(err, os.ErrNotExist) == false {
+		return nil, fmt.Errorf("failed to remove socket: %w", err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on socket: %w", err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,118 @@
+package http_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/vklap/go_ddd/internal/domain/command_model"
+	"github.com/vklap/go_ddd/internal/entrypoints/boostrapper"
+	api "github.com/vklap/go_ddd/internal/entrypoints/http"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"github.com/vklap/go_ddd/pkg/ddd/jsonrpc"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	bs := boostrapper.New()
+	user := &command_model.User{}
+	user.SetID("1")
+	email, err := ddd.NewEmail("kamel.amin@thaabet.sy")
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	user.SetEmail(email)
+	bs.Repository.Add(user)
+	server := httptest.NewServer(api.NewHandler(bs))
+	t.Cleanup(func() {
+		server.Close()
+		bs.Bootstrapper.Shutdown(context.Background())
+	})
+	return server
+}
+
+func getUser(t *testing.T, server *httptest.Server, userID string) (int, api.UserView) {
+	t.Helper()
+	response, err := http.Get(server.URL + "/queries/GetUser?user_id=" + userID)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	defer response.Body.Close()
+	var view api.UserView
+	if response.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(response.Body).Decode(&view); err != nil {
+			t.Fatalf("want a user, got %v", err)
+		}
+	}
+	return response.StatusCode, view
+}
+
+func TestHandler(t *testing.T) {
+	server := newTestServer(t)
+
+	status, view := getUser(t, server, "1")
+	if status != http.StatusOK || view.UserID != "1" || view.Email != "kamel.amin@thaabet.sy" {
+		t.Errorf("want the seeded user, got status %d and %+v", status, view)
+	}
+	if status, _ = getUser(t, server, "missing"); status != http.StatusNotFound {
+		t.Errorf("want status %d for a missing user, got %d", http.StatusNotFound, status)
+	}
+
+	response, err := http.Post(server.URL+"/commands/SaveUserCommand", "application/json", strings.NewReader(`{"user_id":"1","email":"eli.cohen@mossad.gov.il"}`))
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		t.Fatalf("want status %d, got %d", http.StatusNoContent, response.StatusCode)
+	}
+	if _, view = getUser(t, server, "1"); view.Email != "eli.cohen@mossad.gov.il" {
+		t.Errorf("want the email saved by the command, got %q", view.Email)
+	}
+
+	response, err = http.Post(server.URL+"/rpc", "application/json", strings.NewReader(`{"jsonrpc":"2.0","method":"SaveUserCommand","params":{"user_id":"1","email":"wolfgang.lotz@mossad.gov.il"},"id":1}`))
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	defer response.Body.Close()
+	var got jsonrpc.Response
+	if err = json.NewDecoder(response.Body).Decode(&got); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if response.StatusCode != http.StatusOK || got.Error != nil || string(got.ID) != "1" {
+		t.Errorf("want the result of the call, got status %d and %+v", response.StatusCode, got)
+	}
+	if _, view = getUser(t, server, "1"); view.Email != "wolfgang.lotz@mossad.gov.il" {
+		t.Errorf("want the email saved by the call, got %q", view.Email)
+	}
+}
+
+func TestRunFailsWhenAddressIsInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	defer listener.Close()
+	config := api.DefaultConfig()
+	config.Addr = listener.Addr().String()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- api.Run(context.Background(), config)
+	}()
+
+	select {
+	case err = <-done:
+		var opErr *net.OpError
+		if errors.As(err, &opErr) == false || strings.HasPrefix(err.Error(), "listen failed") == false {
+			t.Errorf("want the listen error, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("want Run to fail, got it serving")
+	}
+}
@@ -2,42 +2,251 @@ package worker
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
+	"github.com/vklap/go_ddd/internal/adapters"
 	"github.com/vklap/go_ddd/internal/domain/command_model"
 	"github.com/vklap/go_ddd/internal/entrypoints/boostrapper"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"github.com/vklap/go_ddd/pkg/ddd/broker"
+	"io"
 	"log"
+	"path/filepath"
+	"time"
 )
 
-// Start listens to the message broker and dispatches commands to be handled.
-func Start() {
-	// Setup InMemory fake data
-	bs := boostrapper.Instance
-	user := &command_model.User{}
-	user.SetEmail("kamel.amin@thaabet.sy")
-	user.SetID("1")
-	bs.Repository.UsersById[user.ID()] = user
+// Config contains the settings of the worker.
+type Config struct {
+	// DataDir is the directory of the worker's event store, which lets it restore the users after a restart.
+	DataDir string
+	// GracePeriod is the time that the commands being handled are given to finish once the worker is stopped,
+	// before they are canceled.
+	GracePeriod time.Duration
+	// Concurrency is the number of messages that are handled concurrently.
+	Concurrency int
+	// MaxAttempts is the number of times a message may fail, before it is moved to the quarantine.
+	MaxAttempts int
+	// PublishDemoCommands makes Run publish the demo commands before it consumes the messages.
+	// Otherwise, they are published by another process with Publish, so that restarting the worker
+	// does not publish them again.
+	PublishDemoCommands bool
+}
+
+// DefaultConfig returns the default settings of the worker.
+func DefaultConfig() Config {
+	return Config{DataDir: "data", GracePeriod: 10 * time.Second, Concurrency: 4, MaxAttempts: 3}
+}
+
+// brokerRetention is how long the message broker keeps the records, which is long enough for a demo.
+const brokerRetention = 7 * 24 * time.Hour
+
+// openBroker opens the message broker within DataDir, which is shared with the other processes of the demo.
+func openBroker(config Config) (*broker.FileBroker, error) {
+	return broker.OpenFileBroker(filepath.Join(config.DataDir, "broker"),
+		broker.WithRetention(0, brokerRetention),
+		broker.WithErrorHandler(func(err error) {
+			log.Printf("message broker failed: %v", err)
+		}),
+	)
+}
+
+// worker holds the wiring shared by Run, ListQuarantine and ReplayQuarantine.
+type worker struct {
+	bs       *boostrapper.DemoBootstrapper
+	consumer *ddd.Consumer
+}
+
+// start opens the event store, the quarantine and the message broker, starts the bootstrapper and restores the users.
+// The returned stop function shuts the bootstrapper down.
+func start(ctx context.Context, config Config) (*worker, func() error, error) {
+	codec := boostrapper.NewCodec()
+	store, err := ddd.OpenFileEventStore(config.DataDir, codec)
+	if err != nil {
+		return nil, nil, err
+	}
+	quarantine, err := ddd.NewFileQuarantine(filepath.Join(config.DataDir, "quarantine"))
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+	messageBroker, err := openBroker(config)
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+	bs := boostrapper.NewWithAdapters(store, messageBroker)
+	bs.Bootstrapper.OnStop(func(ctx context.Context) error {
+		return store.Close()
+	})
+	stop := func() error {
+		// The consumer already waited for the commands it handles, so only the stop hooks are left.
+		ctx, cancel := context.WithTimeout(context.Background(), config.GracePeriod)
+		defer cancel()
+		if err := bs.Bootstrapper.Shutdown(ctx); err != nil {
+			return fmt.Errorf("shutdown failed: %w", err)
+		}
+		return nil
+	}
+	if err = bs.Bootstrapper.Start(ctx); err != nil {
+		stop()
+		return nil, nil, err
+	}
+	// Restore the users saved by previous runs
+	if err = restoreUsers(ctx, bs); err != nil {
+		stop()
+		return nil, nil, err
+	}
+
+	consumer := ddd.NewConsumer(bs.Bootstrapper, bs.PubSubClient, codec,
+		ddd.WithConcurrency(config.Concurrency),
+		ddd.WithGracePeriod(config.GracePeriod),
+		ddd.WithQuarantine(quarantine, config.MaxAttempts),
+		ddd.WithConsumerErrorHandler(func(ctx context.Context, message ddd.Message, err error) {
+			log.Printf("handle message failed: %v (message: %s)", err, message.Data())
+		}),
+	)
+	return &worker{bs: bs, consumer: consumer}, stop, nil
+}
+
+// Run consumes the messages of the message broker, and dispatches their commands to be handled,
+// until ctx is done (such as when the process is signaled).
+// It returns an error when the worker did not stop cleanly, such as when commands had to be canceled.
+func Run(ctx context.Context, config Config) (err error) {
+	w, stop, err := start(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if stopErr := stop(); stopErr != nil && err == nil {
+			err = stopErr
+		}
+	}()
+	bs := w.bs
+
+	// Setup InMemory fake data, unless the user was restored
+	user, err := command_model.NewUser(ddd.NewSequenceGenerator(""))
+	if err != nil {
+		return err
+	}
+	if _, err = bs.Repository.Get(ctx, user.ID()); err != nil {
+		email, err := ddd.NewEmail("kamel.amin@thaabet.sy")
+		if err != nil {
+			return err
+		}
+		user.SetEmail(email)
+		bs.Repository.Add(user)
+	}
 
+	if config.PublishDemoCommands {
+		if err = publishDemoCommands(ctx, bs.PubSubClient, user.ID()); err != nil {
+			return err
+		}
+	}
+
+	// Consume the messages of the broker until stopped, whose envelopes route them to their commands
+	if err = w.consumer.Run(ctx); err != nil {
+		return err
+	}
+	log.Printf("consumed messages: %d acked, %d nacked", bs.PubSubClient.Acked, bs.PubSubClient.Nacked)
+	return nil
+}
+
+// Publish publishes the demo commands to the message broker within DataDir, for a worker running in another process.
+func Publish(ctx context.Context, config Config) error {
+	messageBroker, err := openBroker(config)
+	if err != nil {
+		return err
+	}
+	defer messageBroker.Close()
+	user, err := command_model.NewUser(ddd.NewSequenceGenerator(""))
+	if err != nil {
+		return err
+	}
+	return publishDemoCommands(ctx, adapters.NewPubSubClient(messageBroker), user.ID())
+}
+
+// publishDemoCommands publishes a command that changes the email of the user, and a poison command.
+func publishDemoCommands(ctx context.Context, client *adapters.InMemoryPubSubClient, userID string) error {
 	fakePubSubMessage := &command_model.SaveUserCommand{
 		Email:  "eli.cohen@mossad.gov.il",
-		UserID: "1",
+		UserID: userID,
 	}
-	bs.PubSubClient.Commands = append(bs.PubSubClient.Commands, fakePubSubMessage)
+	// The invalid email turns this message into a poison message, which is moved to the quarantine.
+	fakePoisonMessage := &command_model.SaveUserCommand{
+		Email:  "not an email",
+		UserID: userID,
+	}
+	if err := client.PublishCommands(ctx, userID, fakePubSubMessage, fakePoisonMessage); err != nil {
+		return err
+	}
+	log.Printf("published the demo commands of user %q", userID)
+	return nil
+}
 
-	// Start listening for messages from fake in memory PubSub
-	messages, err := bs.PubSubClient.GetSaveUserMessages(context.Background())
+// ListQuarantine writes the quarantined messages to out.
+func ListQuarantine(ctx context.Context, config Config, out io.Writer) error {
+	quarantine, err := ddd.NewFileQuarantine(filepath.Join(config.DataDir, "quarantine"))
 	if err != nil {
-		panic(err)
+		return err
 	}
-	for message := range messages {
-		var command command_model.SaveUserCommand
-		err = json.Unmarshal(message, &command)
-		if err != nil {
-			log.Printf("failed to unmarshal SaveUserCommand: %v (message: %v)", err, message)
+	messages, err := quarantine.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, message := range messages {
+		fmt.Fprintf(out, "%s\tattempts=%d\tquarantined_at=%s\n", message.ID, message.Attempts, message.QuarantinedAt.Format(time.RFC3339))
+		fmt.Fprintf(out, "\tdata: %s\n", message.Data)
+		for _, e := range message.Errors {
+			fmt.Fprintf(out, "\terror: %s\n", e)
+		}
+	}
+	fmt.Fprintf(out, "%d quarantined messages\n", len(messages))
+	return nil
+}
+
+// ReplayQuarantine handles the quarantined messages with the given IDs again (or all of them, when no ID is given),
+// and returns the number of messages that succeeded.
+func ReplayQuarantine(ctx context.Context, config Config, ids ...string) (replayed int, err error) {
+	w, stop, err := start(ctx, config)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if stopErr := stop(); stopErr != nil && err == nil {
+			err = stopErr
+		}
+	}()
+	return w.consumer.Replay(ctx, ids...)
+}
+
+// restoreUsers replays the EmailSetEvents recorded in the event store, and adds the restored users to the repository.
+func restoreUsers(ctx context.Context, bs *boostrapper.DemoBootstrapper) error {
+	events, err := bs.EventStore.LoadAll(ctx, 0)
+	if err != nil {
+		return err
+	}
+	users := make(map[string]*command_model.User)
+	for _, recorded := range events {
+		event, ok := recorded.Event.(*command_model.EmailSetEvent)
+		if ok == false {
 			continue
 		}
-		_, err = boostrapper.HandleCommand[*command_model.SaveUserCommand](context.Background(), &command)
+		email, err := ddd.NewEmail(event.NewEmail)
 		if err != nil {
-			log.Printf("handle SaveUserCommand failed: %v", err)
+			return err
+		}
+		user, ok := users[event.UserID]
+		if ok == false {
+			user = &command_model.User{}
+			user.SetID(event.UserID)
+			users[event.UserID] = user
 		}
+		user.SetEmail(email)
+		// The replayed events were already handled.
+		user.PullEvents()
+	}
+	for _, user := range users {
+		bs.Repository.Add(user)
 	}
+	log.Printf("restored %d users from %d events", len(users), len(events))
+	return nil
 }
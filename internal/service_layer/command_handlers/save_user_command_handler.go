@@ -29,7 +29,13 @@ func (h *SaveUserCommandHandler) Handle(ctx context.Context, command ddd.Command
 	// No need to call saveUserCommand.IsValid() - as it's being called by the framework.
 
 	// Delegate fetching data to the repository, which belongs to the Adapters Layer.
-	user, err := h.repository.GetUserById(ctx, saveUserCommand.UserID)
+	user, err := h.repository.Get(ctx, saveUserCommand.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the email value object, which fails if the email is invalid.
+	email, err := ddd.NewEmail(saveUserCommand.Email)
 	if err != nil {
 		return nil, err
 	}
@@ -37,18 +43,16 @@ func (h *SaveUserCommandHandler) Handle(ctx context.Context, command ddd.Command
 	// Delegate updating the email to the user, which is a Domain Entity.
 	// The SetEmail method is responsible to detect if a new email was set,
 	// and if so, then it will record an EmailSetEvent.
-	user.SetEmail(saveUserCommand.Email)
+	user.SetEmail(email)
 
 	// Delegate storing data to the repository.
-	if err = h.repository.SaveUser(ctx, user); err != nil {
+	// The repository tracks the user in the unit of work, so there is no need to register the user's events here:
+	// they are harvested by the framework and dispatched to event handlers (if they exist).
+	// In our use case the events will be dispatched to the EmailSetEventHandler.
+	if err = h.repository.Save(ctx, user); err != nil {
 		return nil, err
 	}
 
-	// This is where Domain events are being registered,
-	// so they can eventually be dispatched to event handlers (if they exist).
-	// In our use case the events will be dispatched to the EmailChangedEventHandler.
-	h.events = append(h.events, user.Events()...)
-
 	return nil, nil
 }
 
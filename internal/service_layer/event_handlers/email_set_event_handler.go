@@ -3,20 +3,20 @@ package event_handlers
 import (
 	"context"
 	"fmt"
-	"github.com/vklap/go_ddd/internal/adapters"
 	"github.com/vklap/go_ddd/internal/domain/command_model"
 	"github.com/vklap/go_ddd/pkg/ddd"
 )
 
 // EmailSetEventHandler implements ddd.EventHandler.
+// The other services are notified about the changed email by the integration_events.EmailChanged integration event,
+// which is published once the unit of work that raised the event commits.
 type EmailSetEventHandler struct {
-	pubSubClient adapters.PubSubClient
-	events       []ddd.Event
+	events []ddd.Event
 }
 
 // NewEmailSetEventHandler is a constructor function to be used by the Bootstrapper.
-func NewEmailSetEventHandler(pubSubClient adapters.PubSubClient) *EmailSetEventHandler {
-	return &EmailSetEventHandler{pubSubClient: pubSubClient, events: make([]ddd.Event, 0)}
+func NewEmailSetEventHandler() *EmailSetEventHandler {
+	return &EmailSetEventHandler{events: make([]ddd.Event, 0)}
 }
 
 // Handle manages the business logic flow, and is the glue between the Domain and the Adapters.
@@ -25,9 +25,6 @@ func (h *EmailSetEventHandler) Handle(ctx context.Context, event ddd.Event) erro
 	if ok == false {
 		panic(fmt.Sprintf("failed to handle email set: want %T, got %T", &command_model.EmailSetEvent{}, e))
 	}
-	if err := h.pubSubClient.NotifyEmailChanged(ctx, e.UserID, e.NewEmail, e.OriginalEmail); err != nil {
-		return err
-	}
 	h.events = append(h.events, &command_model.KPIEvent{Action: e.EventName(), Data: fmt.Sprintf("%v", e)})
 	return nil
 }
@@ -36,14 +33,14 @@ func (h *EmailSetEventHandler) Handle(ctx context.Context, event ddd.Event) erro
 // committing a database transaction managed by the repository.
 // This method is being called by the framework, so it should not be called from within the Handle method.
 func (h *EmailSetEventHandler) Commit(ctx context.Context) error {
-	return h.pubSubClient.Commit(ctx)
+	return nil
 }
 
 // Rollback is responsible to rollback changes performed by the Handle method, such as
 // rollback a database transaction managed by the repository.
 // This method is being called by the framework, so it should not be called from within the Handle method.
 func (h *EmailSetEventHandler) Rollback(ctx context.Context) error {
-	return h.pubSubClient.Rollback(ctx)
+	return nil
 }
 
 // Events reports about events.
@@ -0,0 +1,39 @@
+// Package integration_events defines the public schemas of the integration events published by the demo,
+// along with the translators of the domain events they are published for.
+package integration_events
+
+import (
+	"context"
+	"fmt"
+	"github.com/vklap/go_ddd/internal/adapters"
+	"github.com/vklap/go_ddd/internal/domain/command_model"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"github.com/vklap/go_ddd/pkg/ddd/integration"
+)
+
+// EmailChangedType is the type of the EmailChanged integration event.
+const EmailChangedType = "user.email_changed.v1"
+
+// EmailChanged is the public schema of the notifications about changed emails, published to adapters.EmailChangedTopic.
+// It is decoupled from command_model.EmailSetEvent, so the domain event can change without breaking the consumers.
+type EmailChanged struct {
+	UserID   string `json:"user_id"`
+	OldEmail string `json:"old_email"`
+	NewEmail string `json:"new_email"`
+}
+
+// TranslateEmailSetEvent translates the EmailSetEvent into the EmailChanged integration event, keyed by the user ID.
+func TranslateEmailSetEvent(ctx context.Context, event ddd.Event) (*integration.Message, error) {
+	e, ok := event.(*command_model.EmailSetEvent)
+	if ok == false {
+		return nil, fmt.Errorf("failed to translate email set: want %T, got %T", &command_model.EmailSetEvent{}, event)
+	}
+	return &integration.Message{
+		Topic:   adapters.EmailChangedTopic,
+		Key:     e.UserID,
+		Type:    EmailChangedType,
+		Payload: EmailChanged{UserID: e.UserID, OldEmail: e.OriginalEmail, NewEmail: e.NewEmail},
+	}, nil
+}
+
+var _ integration.Translator = TranslateEmailSetEvent
@@ -14,29 +14,136 @@ import (
 type Bootstrapper struct {
 	commandHandlerFactory *commandHandlerFactory
 	eventHandlersFactory  *eventHandlersFactory
+	container             *container
+	lifecycle             *lifecycle
+	propagatePanics       bool
 }
 
 // NewBootstrapper initializes a new Bootstrapper instance.
-func NewBootstrapper() *Bootstrapper {
-	return &Bootstrapper{
+func NewBootstrapper(options ...BootstrapperOption) *Bootstrapper {
+	b := &Bootstrapper{
 		commandHandlerFactory: newCommandHandlerFactory(),
 		eventHandlersFactory:  newEventHandlersFactory(),
+		container:             newContainer(),
+		lifecycle:             newLifecycle(),
 	}
+	for _, option := range options {
+		option(b)
+	}
+	return b
 }
 
 // RegisterCommandHandlerFactory registers a function based create command handler factory.
-func (b *Bootstrapper) RegisterCommandHandlerFactory(command Command, factory CreateCommandHandler) {
-	b.commandHandlerFactory.Register(command, factory)
+// Options, such as WithTimeout, configure how the created handlers are run.
+// It fails with ErrDuplicateCommandHandler if the command is already registered,
+// and with ErrRegistrySealed once Seal was called.
+func (b *Bootstrapper) RegisterCommandHandlerFactory(command Command, factory CreateCommandHandler, options ...HandlerOption) error {
+	return b.commandHandlerFactory.Register(command, func(ctx context.Context, command Command) (CommandHandler, error) {
+		return factory()
+	}, options...)
+}
+
+// RegisterScopedCommandHandlerFactory registers a command handler factory that resolves its dependencies
+// from the Scope of the HandleCommand call. It fails like RegisterCommandHandlerFactory.
+func (b *Bootstrapper) RegisterScopedCommandHandlerFactory(command Command, factory CreateScopedCommandHandler, options ...HandlerOption) error {
+	return b.commandHandlerFactory.Register(command, func(ctx context.Context, command Command) (CommandHandler, error) {
+		return factory(ScopeFromContext(ctx))
+	}, options...)
+}
+
+// RegisterCommandHandlerFactoryWithContext registers a command handler factory that receives the context
+// of the HandleCommand call and the command. It fails like RegisterCommandHandlerFactory.
+func (b *Bootstrapper) RegisterCommandHandlerFactoryWithContext(command Command, factory CreateCommandHandlerWithContext, options ...HandlerOption) error {
+	return b.commandHandlerFactory.Register(command, factory, options...)
 }
 
 // RegisterEventHandlerFactory registers a function based create event handler factory.
-func (b *Bootstrapper) RegisterEventHandlerFactory(event Event, factory CreateEventHandler) {
-	b.eventHandlersFactory.Register(event, factory)
+// Options, such as WithTimeout, configure how the created handlers are run.
+// It fails with ErrRegistrySealed once Seal was called.
+func (b *Bootstrapper) RegisterEventHandlerFactory(event Event, factory CreateEventHandler, options ...HandlerOption) error {
+	return b.eventHandlersFactory.Register(event, func(ctx context.Context, event Event) (EventHandler, error) {
+		return factory()
+	}, options...)
+}
+
+// RegisterScopedEventHandlerFactory registers an event handler factory that resolves its dependencies
+// from the Scope of the HandleCommand call. It fails like RegisterEventHandlerFactory.
+func (b *Bootstrapper) RegisterScopedEventHandlerFactory(event Event, factory CreateScopedEventHandler, options ...HandlerOption) error {
+	return b.eventHandlersFactory.Register(event, func(ctx context.Context, event Event) (EventHandler, error) {
+		return factory(ScopeFromContext(ctx))
+	}, options...)
+}
+
+// RegisterEventHandlerFactoryWithContext registers an event handler factory that receives the context
+// of the handler that raised the event, and the event. It fails like RegisterEventHandlerFactory.
+func (b *Bootstrapper) RegisterEventHandlerFactoryWithContext(event Event, factory CreateEventHandlerWithContext, options ...HandlerOption) error {
+	return b.eventHandlersFactory.Register(event, factory, options...)
+}
+
+// Seal prevents further registrations, so the registered handlers and dependencies cannot change
+// while commands are handled.
+func (b *Bootstrapper) Seal() {
+	b.commandHandlerFactory.Seal()
+	b.eventHandlersFactory.Seal()
+	b.container.Seal()
+}
+
+// CommandNames returns the names of the commands that have a registered handler, sorted alphabetically.
+func (b *Bootstrapper) CommandNames() []string {
+	return b.commandHandlerFactory.Names()
+}
+
+// EventNames returns the names of the events that have registered handlers, sorted alphabetically.
+func (b *Bootstrapper) EventNames() []string {
+	return b.eventHandlersFactory.Names()
+}
+
+// EventHandlerCount returns the number of handlers registered for the event with the given name.
+func (b *Bootstrapper) EventHandlerCount(eventName string) int {
+	return b.eventHandlersFactory.Count(eventName)
 }
 
 // HandleCommand is the facade handling Domain Commands, that will eventually trigger registered Event handlers.
+// Once ctx is done, no further handlers are run and the current unit of work is rolled back.
+// A panicking handler is rolled back as well, and its panic is returned as an Error with StatusCodeInternal.
+// Every call has its own Scope, which is shared by all the handlers it runs, and is closed once the call returns.
+// Errors of closing the scoped dependencies are not returned, since the outcome of the command is already known,
+// so dependencies should report them on their own.
+// A ctx created by WithTrace records the handlers that ran, and the events they raised.
+// Once Shutdown was called, it fails with an Error wrapping ErrShuttingDown, with StatusCodeUnavailable,
+// and ctx is canceled when the shutdown deadline is exceeded while the command is still being handled.
+// A command without a registered handler fails with an Error wrapping ErrCommandNotRegistered, with StatusCodeNotFound.
 func (b *Bootstrapper) HandleCommand(ctx context.Context, command Command) (any, error) {
+	ctx, exit, err := b.lifecycle.enter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer exit()
+
 	mb := newMessageBus(b.commandHandlerFactory, b.eventHandlersFactory)
+	mb.propagatePanics = b.propagatePanics
+	scope := b.NewScope()
+	defer scope.Close()
+	ctx = withScope(ctx, scope)
 	result, err := mb.Publish(ctx, command)
 	return result, err
 }
+
+// HandleEvent handles an event that was raised outside of the Bootstrapper (such as by another process),
+// as if a command handler had raised it: the handlers registered with JoinUnitOfWork share a unit of work,
+// and the other handlers run in units of work of their own. Like HandleCommand, every call has its own Scope,
+// and once Shutdown was called it fails with an Error wrapping ErrShuttingDown.
+func (b *Bootstrapper) HandleEvent(ctx context.Context, event Event) error {
+	ctx, exit, err := b.lifecycle.enter(ctx)
+	if err != nil {
+		return err
+	}
+	defer exit()
+
+	mb := newMessageBus(b.commandHandlerFactory, b.eventHandlersFactory)
+	mb.propagatePanics = b.propagatePanics
+	scope := b.NewScope()
+	defer scope.Close()
+	ctx = withScope(ctx, scope)
+	return mb.PublishEvent(ctx, event)
+}
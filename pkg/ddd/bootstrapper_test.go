@@ -2,9 +2,13 @@ package ddd_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"github.com/vklap/go_ddd/internal/adapters"
 	"github.com/vklap/go_ddd/internal/domain/command_model"
 	"github.com/vklap/go_ddd/internal/entrypoints/boostrapper"
 	"github.com/vklap/go_ddd/internal/service_layer/command_handlers"
+	"github.com/vklap/go_ddd/internal/service_layer/integration_events"
 	"github.com/vklap/go_ddd/pkg/ddd"
 	"strings"
 	"testing"
@@ -123,7 +127,7 @@ func TestChangeEmail(t *testing.T) {
 			errorStatusCode:    "",
 			failed:             true,
 			name:               "commit failed",
-			rollbackCalled:     false,
+			rollbackCalled:     true,
 			rollbackShouldFail: false,
 			userExists:         true,
 		},
@@ -133,10 +137,10 @@ func TestChangeEmail(t *testing.T) {
 		t.Run(d.name, func(t *testing.T) {
 			fb := boostrapper.New()
 			aUser := &command_model.User{}
-			aUser.SetEmail(originalEmail)
+			aUser.SetEmail(mustNewEmail(t, originalEmail))
 			aUser.SetID(userID)
 			if d.userExists {
-				fb.Repository.UsersById[aUser.ID()] = aUser
+				fb.Repository.Add(aUser)
 			}
 			fb.Repository.RollbackShouldFail = d.rollbackShouldFail
 			fb.Repository.CommitShouldFail = d.commitShouldFail
@@ -153,31 +157,58 @@ func TestChangeEmail(t *testing.T) {
 }
 
 func TestCommandWithoutRegisteredHandler(t *testing.T) {
-	defer func() {
-		if v := recover(); v == nil {
-			t.Error("want panic, got not error")
-		}
-	}()
 	fb := boostrapper.New()
 	command := &notSupportedCommand{}
 
-	_, _ = fb.Bootstrapper.HandleCommand(context.Background(), command)
+	_, err := fb.Bootstrapper.HandleCommand(context.Background(), command)
+
+	if errors.Is(err, ddd.ErrCommandNotRegistered) == false {
+		t.Errorf("want ErrCommandNotRegistered, got %v", err)
+	}
+	assertStatusCode(t, err, ddd.StatusCodeNotFound)
 }
 
-func TestHandlerReceivedCommandOfWrongType(t *testing.T) {
+func TestDemoBootstrapperIsSealed(t *testing.T) {
 	fb := boostrapper.New()
-	command := &notSupportedCommand{}
-	fb.Bootstrapper.RegisterCommandHandlerFactory(command, func() (ddd.CommandHandler, error) {
+	aUser := &command_model.User{}
+	aUser.SetEmail(mustNewEmail(t, "kamel.amit@thaabet.sy"))
+	aUser.SetID("1")
+	fb.Repository.Add(aUser)
+
+	err := fb.Bootstrapper.RegisterCommandHandlerFactory(&notSupportedCommand{}, func() (ddd.CommandHandler, error) {
 		return command_handlers.NewSaveUserCommandHandler(fb.Repository), nil
 	})
+	if errors.Is(err, ddd.ErrRegistrySealed) == false {
+		t.Errorf("want ErrRegistrySealed for a command handler, got %v", err)
+	}
+	err = ddd.Provide(fb.Bootstrapper, ddd.Singleton, func(scope *ddd.Scope) (*adapters.InMemoryRepository, error) {
+		return adapters.NewInMemoryRepository(), nil
+	})
+	if errors.Is(err, ddd.ErrRegistrySealed) == false {
+		t.Errorf("want ErrRegistrySealed for a dependency, got %v", err)
+	}
+	if _, err = fb.Bootstrapper.HandleCommand(context.Background(), &command_model.SaveUserCommand{Email: "eli.cohen@mossad.gov.il", UserID: "1"}); err != nil {
+		t.Errorf("want the sealed bootstrapper to handle commands, got %v", err)
+	}
+}
+
+func TestHandlerReceivedCommandOfWrongType(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	command := &notSupportedCommand{}
+	err := b.RegisterCommandHandlerFactory(command, func() (ddd.CommandHandler, error) {
+		return command_handlers.NewSaveUserCommandHandler(adapters.NewInMemoryRepository()), nil
+	})
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
 
-	result, err := fb.Bootstrapper.HandleCommand(context.Background(), command)
+	result, err := b.HandleCommand(context.Background(), command)
 
 	if result != nil {
 		t.Errorf("want resut nil, got %v", result)
 	}
 	if err == nil {
-		t.Error("want error not nil, got nil")
+		t.Fatal("want error not nil, got nil")
 	}
 	expectedCommand := &command_model.SaveUserCommand{}
 	if strings.Contains(err.Error(), expectedCommand.CommandName()) != true {
@@ -223,7 +254,7 @@ func TestHandleEventFailure(t *testing.T) {
 			const originalEmail = "kamel.amit@thaabet.sy"
 			const newEmail = "eli.cohen@mossad.gov.il"
 			aUser := &command_model.User{}
-			aUser.SetEmail(originalEmail)
+			aUser.SetEmail(mustNewEmail(t, originalEmail))
 			aUser.SetID(userID)
 			fb.PubSubClient.RollbackShouldFail = d.rollbackFailed
 			fb.PubSubClient.CommitCalled = d.commitCalled
@@ -255,15 +286,31 @@ func assertSuccess(t *testing.T, err error, result any, fb *boostrapper.DemoBoot
 	if result != nil {
 		t.Errorf("want result nil, got %v", result)
 	}
-	user := fb.Repository.UsersById[userID]
-	if user.Email() != newEmail {
+	user, err := fb.Repository.Get(context.Background(), userID)
+	if err != nil {
+		t.Fatalf("want user %q to exist, got %v", userID, err)
+	}
+	if user.Email().String() != newEmail {
 		t.Errorf("want email %q, got %q", newEmail, user.Email())
 	}
 	if fb.Repository.CommitCalled != true {
 		t.Errorf("want adapters.Repository commitCalled true, got %v", fb.Repository.CommitCalled)
 	}
-	if !fb.PubSubClient.NotifyEmailSetCalled {
-		t.Error("want notify email changed to be called")
+	published := fb.PubSubClient.PublishedTo(adapters.EmailChangedTopic)
+	if len(published) != 1 {
+		t.Fatalf("want 1 email changed integration event, got %d", len(published))
+	}
+	envelope, err := ddd.ParseEnvelope(published[0].Data)
+	if err != nil || envelope.Type != integration_events.EmailChangedType {
+		t.Fatalf("want a %q envelope, got %s (%v)", integration_events.EmailChangedType, published[0].Data, err)
+	}
+	var emailChanged integration_events.EmailChanged
+	if err = json.Unmarshal(envelope.Payload, &emailChanged); err != nil {
+		t.Fatalf("want a valid %q payload, got %s (%v)", integration_events.EmailChangedType, envelope.Payload, err)
+	}
+	want := integration_events.EmailChanged{UserID: userID, OldEmail: originalEmail, NewEmail: newEmail}
+	if emailChanged != want || published[0].Key != userID {
+		t.Errorf("want %+v keyed by %q, got %+v keyed by %q", want, userID, emailChanged, published[0].Key)
 	}
 	if !fb.PubSubClient.NotifyKPICalled {
 		t.Error("want notify slack to be called")
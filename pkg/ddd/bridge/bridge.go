@@ -0,0 +1,205 @@
+// Package bridge forwards events raised within a ddd.Bootstrapper to the Bootstrappers of other processes
+// on the same host, over Unix domain sockets or localhost TCP.
+//
+// A Sender forwards the selected events once the unit of work that raised them commits,
+// and a Receiver handles them with ddd.Bootstrapper.HandleEvent, as if they had been raised locally.
+//
+// The protocol consists of frames: a 4-byte big-endian length, followed by a JSON payload.
+// The Sender writes a frame for every event, such as {"seq":1,"type":"EmailSetEvent","payload":{...}},
+// and the Receiver answers with {"ack":1} once the event was handled. The events are buffered by the Sender
+// until they are acknowledged, and are sent again after a reconnect, so they are delivered at least once.
+//
+// The events handled by a Receiver are not forwarded again by the Senders of its process, so processes can forward
+// the same events to each other. The events they raise in turn carry the number of hops they went through,
+// and are dropped once it exceeds the limit (see WithMaxHops), which stops forwarding cycles.
+package bridge
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"io"
+	"reflect"
+	"time"
+)
+
+// DefaultBufferSize is the default number of events that a Sender buffers until they are acknowledged.
+const DefaultBufferSize = 1000
+
+// DefaultMaxFrameSize is the default maximum size (in bytes) of a frame.
+const DefaultMaxFrameSize = 4 << 20
+
+// DefaultWriteTimeout is the default time given to writing a frame, before the connection is considered stalled.
+const DefaultWriteTimeout = 10 * time.Second
+
+// DefaultMaxHops is the default number of times an event can be forwarded by the events it caused.
+const DefaultMaxHops = 8
+
+// ErrBufferFull is wrapped by the errors reported for the events that were dropped,
+// since the Sender already buffered as many events as it can.
+var ErrBufferFull = errors.New("bridge buffer is full")
+
+// Option configures a Sender created by NewSender, or a Receiver created by NewReceiver.
+type Option func(*options)
+
+type options struct {
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	bufferSize   int
+	maxFrameSize int
+	writeTimeout time.Duration
+	maxHops      int
+	errorHandler func(err error)
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		minBackoff:   100 * time.Millisecond,
+		maxBackoff:   5 * time.Second,
+		bufferSize:   DefaultBufferSize,
+		maxFrameSize: DefaultMaxFrameSize,
+		writeTimeout: DefaultWriteTimeout,
+		maxHops:      DefaultMaxHops,
+		errorHandler: func(err error) {},
+	}
+	for _, option := range opts {
+		option(&o)
+	}
+	return o
+}
+
+// WithBackoff sets the time a Sender waits before it reconnects, which is doubled after every failed attempt,
+// up to max. The defaults are 100ms and 5s.
+func WithBackoff(min time.Duration, max time.Duration) Option {
+	return func(o *options) {
+		if min > 0 && max >= min {
+			o.minBackoff = min
+			o.maxBackoff = max
+		}
+	}
+}
+
+// WithBufferSize sets the number of events that a Sender buffers until they are acknowledged.
+// The default is DefaultBufferSize.
+func WithBufferSize(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.bufferSize = n
+		}
+	}
+}
+
+// WithMaxFrameSize sets the maximum size (in bytes) of the frames that are read. The default is DefaultMaxFrameSize.
+func WithMaxFrameSize(bytes int) Option {
+	return func(o *options) {
+		if bytes > 0 {
+			o.maxFrameSize = bytes
+		}
+	}
+}
+
+// WithWriteTimeout sets the time given to writing a frame to a connection that supports deadlines (see net.Conn),
+// after which the connection fails, so a stalled peer cannot block it forever. The default is DefaultWriteTimeout.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		if timeout > 0 {
+			o.writeTimeout = timeout
+		}
+	}
+}
+
+// WithMaxHops sets the number of times a Receiver lets an event be forwarded by the events it caused,
+// before it drops the event. The default is DefaultMaxHops.
+func WithMaxHops(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.maxHops = n
+		}
+	}
+}
+
+// WithErrorHandler sets a function that is called with the errors that cannot be returned,
+// such as failed connections of a Sender, or events that a Receiver failed to handle.
+func WithErrorHandler(handler func(err error)) Option {
+	return func(o *options) {
+		o.errorHandler = handler
+	}
+}
+
+// frame is either an event (with Seq, Type, Payload and Hops), or the acknowledgement of the events up to Ack.
+// Hops is the number of times the events that caused the event were forwarded.
+type frame struct {
+	Seq     uint64          `json:"seq,omitempty"`
+	Type    string          `json:"type,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Hops    int             `json:"hops,omitempty"`
+	Ack     uint64          `json:"ack,omitempty"`
+}
+
+// writeFrame writes the frame, within the timeout when w supports write deadlines.
+func writeFrame(w io.Writer, f frame, timeout time.Duration) error {
+	payload, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("failed to encode frame: %w", err)
+	}
+	if conn, ok := w.(interface{ SetWriteDeadline(t time.Time) error }); ok {
+		if err = conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+			return fmt.Errorf("failed to set write deadline: %w", err)
+		}
+	}
+	buf := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)))
+	copy(buf[4:], payload)
+	if _, err = w.Write(buf); err != nil {
+		return fmt.Errorf("failed to write frame: %w", err)
+	}
+	return nil
+}
+
+type receivedKey struct{}
+
+// received is the event being handled by a Receiver, which is passed to its handlers through the context.
+type received struct {
+	event ddd.Event
+	hops  int
+}
+
+func withReceived(ctx context.Context, event ddd.Event, hops int) context.Context {
+	return context.WithValue(ctx, receivedKey{}, received{event: event, hops: hops})
+}
+
+// forwardedHops returns the hops of an event that is about to be forwarded,
+// and false when the event itself was received, so it must not be forwarded back.
+func forwardedHops(ctx context.Context, event ddd.Event) (int, bool) {
+	r, ok := ctx.Value(receivedKey{}).(received)
+	if ok == false {
+		return 0, true
+	}
+	if reflect.TypeOf(event).Comparable() && r.event == event {
+		return 0, false
+	}
+	return r.hops + 1, true
+}
+
+func readFrame(r io.Reader, maxFrameSize int) (frame, error) {
+	var f frame
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return f, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > uint32(maxFrameSize) {
+		return f, fmt.Errorf("frame of %d bytes exceeds the maximum of %d bytes", size, maxFrameSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return f, fmt.Errorf("incomplete frame: %w", err)
+	}
+	if err := json.Unmarshal(payload, &f); err != nil {
+		return f, fmt.Errorf("invalid frame: %w", err)
+	}
+	return f, nil
+}
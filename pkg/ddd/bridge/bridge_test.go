@@ -0,0 +1,375 @@
+package bridge_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"github.com/vklap/go_ddd/pkg/ddd/bridge"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type createUserCommand struct {
+	UserID string
+}
+
+func (c *createUserCommand) IsValid() error {
+	return nil
+}
+
+func (c *createUserCommand) CommandName() string {
+	return "CreateUser"
+}
+
+type userCreatedEvent struct {
+	UserID string `json:"user_id"`
+}
+
+func (e *userCreatedEvent) EventName() string {
+	return "UserCreated"
+}
+
+type createUserCommandHandler struct {
+	events []ddd.Event
+}
+
+func (h *createUserCommandHandler) Handle(ctx context.Context, command ddd.Command) (any, error) {
+	h.events = append(h.events, &userCreatedEvent{UserID: command.(*createUserCommand).UserID})
+	return nil, nil
+}
+
+func (h *createUserCommandHandler) Events() []ddd.Event {
+	return h.events
+}
+
+func (h *createUserCommandHandler) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (h *createUserCommandHandler) Rollback(ctx context.Context) error {
+	return nil
+}
+
+// rejectingEventHandler joins the unit of work of the events, and fails the ones of the rejected user.
+type rejectingEventHandler struct{}
+
+func (h *rejectingEventHandler) Handle(ctx context.Context, event ddd.Event) error {
+	if event.(*userCreatedEvent).UserID == "rejected" {
+		return ddd.NewError("user is rejected", ddd.StatusCodeBadRequest)
+	}
+	return nil
+}
+
+func (h *rejectingEventHandler) Events() []ddd.Event {
+	return nil
+}
+
+func (h *rejectingEventHandler) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (h *rejectingEventHandler) Rollback(ctx context.Context) error {
+	return nil
+}
+
+type recordingEventHandler struct {
+	received chan<- string
+	userID   string
+}
+
+func (h *recordingEventHandler) Handle(ctx context.Context, event ddd.Event) error {
+	h.userID = event.(*userCreatedEvent).UserID
+	return nil
+}
+
+func (h *recordingEventHandler) Events() []ddd.Event {
+	return nil
+}
+
+func (h *recordingEventHandler) Commit(ctx context.Context) error {
+	h.received <- h.userID
+	return nil
+}
+
+func (h *recordingEventHandler) Rollback(ctx context.Context) error {
+	return nil
+}
+
+func newSenderBootstrapper(t *testing.T, sender *bridge.Sender) *ddd.Bootstrapper {
+	t.Helper()
+	b := ddd.NewBootstrapper()
+	b.RegisterCommandHandlerFactory(&createUserCommand{}, func() (ddd.CommandHandler, error) {
+		return &createUserCommandHandler{}, nil
+	})
+	b.RegisterEventHandlerFactory(&userCreatedEvent{}, func() (ddd.EventHandler, error) {
+		return &rejectingEventHandler{}, nil
+	}, ddd.JoinUnitOfWork())
+	if err := sender.Forward(b, &userCreatedEvent{}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	return b
+}
+
+// serveReceiver serves a Receiver on a new Unix socket at path, until the test ends.
+func serveReceiver(t *testing.T, path string, received chan<- string) {
+	t.Helper()
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets are not supported: %v", err)
+	}
+	b := ddd.NewBootstrapper()
+	b.RegisterEventHandlerFactory(&userCreatedEvent{}, func() (ddd.EventHandler, error) {
+		return &recordingEventHandler{received: received}, nil
+	})
+	codec := ddd.NewCodec()
+	codec.RegisterEvent(&userCreatedEvent{})
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- bridge.NewReceiver(b, codec).Serve(ctx, listener)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Errorf("want no error, got %v", err)
+		}
+	})
+}
+
+func runSender(t *testing.T, sender *bridge.Sender) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- sender.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("want no error, got %v", err)
+		}
+	})
+}
+
+func receiveUserID(t *testing.T, received <-chan string) string {
+	t.Helper()
+	select {
+	case userID := <-received:
+		return userID
+	case <-time.After(2 * time.Second):
+		t.Fatalf("want an event to be received")
+		return ""
+	}
+}
+
+func waitUntilAcknowledged(t *testing.T, sender *bridge.Sender) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for sender.Pending() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want the events to be acknowledged, got %d pending", sender.Pending())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBridgeForwardsCommittedEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	received := make(chan string, 2)
+	serveReceiver(t, path, received)
+	sender := bridge.NewSender("unix", path)
+	runSender(t, sender)
+	b := newSenderBootstrapper(t, sender)
+
+	if _, err := b.HandleCommand(context.Background(), &createUserCommand{UserID: "rejected"}); err == nil {
+		t.Fatalf("want the command to fail")
+	}
+	if _, err := b.HandleCommand(context.Background(), &createUserCommand{UserID: "1"}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+
+	if userID := receiveUserID(t, received); userID != "1" {
+		t.Errorf("want only the event of the committed unit of work, got the event of user %q", userID)
+	}
+	waitUntilAcknowledged(t, sender)
+}
+
+func TestSenderBuffersWhileDisconnected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	sender := bridge.NewSender("unix", path, bridge.WithBackoff(5*time.Millisecond, 20*time.Millisecond))
+	runSender(t, sender)
+	b := newSenderBootstrapper(t, sender)
+	for _, userID := range []string{"1", "2"} {
+		if _, err := b.HandleCommand(context.Background(), &createUserCommand{UserID: userID}); err != nil {
+			t.Fatalf("want no error, got %v", err)
+		}
+	}
+	if sender.Pending() != 2 {
+		t.Errorf("want 2 buffered events, got %d", sender.Pending())
+	}
+
+	received := make(chan string, 2)
+	serveReceiver(t, path, received)
+	for _, want := range []string{"1", "2"} {
+		if userID := receiveUserID(t, received); userID != want {
+			t.Errorf("want user %s, got %s", want, userID)
+		}
+	}
+	waitUntilAcknowledged(t, sender)
+}
+
+func TestSenderBufferFull(t *testing.T) {
+	var reported error
+	sender := bridge.NewSender("unix", filepath.Join(t.TempDir(), "events.sock"), bridge.WithBufferSize(1), bridge.WithErrorHandler(func(err error) {
+		reported = err
+	}))
+	b := newSenderBootstrapper(t, sender)
+	if _, err := b.HandleCommand(context.Background(), &createUserCommand{UserID: "1"}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+
+	_, err := b.HandleCommand(context.Background(), &createUserCommand{UserID: "2"})
+
+	if err != nil {
+		t.Errorf("want the committed command not to fail, got %v", err)
+	}
+	if errors.Is(reported, bridge.ErrBufferFull) == false {
+		t.Errorf("want ErrBufferFull to be reported, got %v", reported)
+	}
+	if sender.Pending() != 1 || sender.Dropped() != 1 {
+		t.Errorf("want 1 pending and 1 dropped event, got %d and %d", sender.Pending(), sender.Dropped())
+	}
+}
+
+func TestReceiverProtocol(t *testing.T) {
+	received := make(chan string, 1)
+	b := ddd.NewBootstrapper()
+	b.RegisterEventHandlerFactory(&userCreatedEvent{}, func() (ddd.EventHandler, error) {
+		return &recordingEventHandler{received: received}, nil
+	})
+	codec := ddd.NewCodec()
+	codec.RegisterEvent(&userCreatedEvent{})
+	var handlerErr error
+	receiver := bridge.NewReceiver(b, codec, bridge.WithErrorHandler(func(err error) {
+		handlerErr = err
+	}))
+	client, server := net.Pipe()
+	served := make(chan error)
+	go func() {
+		served <- receiver.ServeConn(context.Background(), server)
+	}()
+
+	for _, tc := range []struct {
+		frame string
+		ack   string
+	}{
+		{frame: `{"seq":1,"type":"UserCreated","payload":{"user_id":"1"}}`, ack: `{"ack":1}`},
+		{frame: `{"seq":2,"type":"Unknown","payload":{}}`, ack: `{"ack":2}`},
+		{frame: `{"seq":3,"type":"UserCreated","payload":{"user_id":"2"},"hops":9}`, ack: `{"ack":3}`},
+	} {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(tc.frame)))
+		client.Write(append(header, tc.frame...))
+		if _, err := io.ReadFull(client, header); err != nil {
+			t.Fatalf("want no error, got %v", err)
+		}
+		ack := make([]byte, binary.BigEndian.Uint32(header))
+		io.ReadFull(client, ack)
+		if string(ack) != tc.ack {
+			t.Errorf("want %s, got %s", tc.ack, ack)
+		}
+	}
+	if userID := receiveUserID(t, received); userID != "1" {
+		t.Errorf("want user 1, got %s", userID)
+	}
+	if handlerErr == nil {
+		t.Errorf("want the unknown event and the one that exceeded the maximum hops to be reported")
+	}
+	select {
+	case userID := <-received:
+		t.Errorf("want the event that exceeded the maximum hops to be dropped, got user %s", userID)
+	default:
+	}
+
+	client.Close()
+	if err := <-served; err != nil {
+		t.Errorf("want no error, got %v", err)
+	}
+}
+
+func TestReceivedEventsAreNotForwardedBack(t *testing.T) {
+	received := make(chan string, 1)
+	b := ddd.NewBootstrapper()
+	b.RegisterEventHandlerFactory(&userCreatedEvent{}, func() (ddd.EventHandler, error) {
+		return &recordingEventHandler{received: received}, nil
+	})
+	// The process forwards the events it receives from its peer, which forwards them as well.
+	sender := bridge.NewSender("unix", filepath.Join(t.TempDir(), "peer.sock"))
+	sender.Forward(b, &userCreatedEvent{})
+	codec := ddd.NewCodec()
+	codec.RegisterEvent(&userCreatedEvent{})
+	client, server := net.Pipe()
+	defer client.Close()
+	go bridge.NewReceiver(b, codec).ServeConn(context.Background(), server)
+
+	frame := `{"seq":1,"type":"UserCreated","payload":{"user_id":"1"}}`
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(frame)))
+	client.Write(append(header, frame...))
+	io.ReadFull(client, header)
+	io.ReadFull(client, make([]byte, binary.BigEndian.Uint32(header)))
+
+	if userID := receiveUserID(t, received); userID != "1" {
+		t.Errorf("want user 1, got %s", userID)
+	}
+	if sender.Pending() != 0 {
+		t.Errorf("want the received event not to be forwarded back, got %d pending", sender.Pending())
+	}
+}
+
+func TestSenderWriteTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets are not supported: %v", err)
+	}
+	defer listener.Close()
+	// The peer accepts the connection, but never reads from it.
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(2 * time.Second)
+		}
+	}()
+	failed := make(chan error, 1)
+	sender := bridge.NewSender("unix", path, bridge.WithWriteTimeout(20*time.Millisecond), bridge.WithBackoff(time.Second, time.Second), bridge.WithErrorHandler(func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+	}))
+	runSender(t, sender)
+	b := newSenderBootstrapper(t, sender)
+	// The events exceed the buffers of the socket, so writing them blocks.
+	for i := 0; i < 8; i++ {
+		if _, err := b.HandleCommand(context.Background(), &createUserCommand{UserID: strings.Repeat("x", 1<<20)}); err != nil {
+			t.Fatalf("want no error, got %v", err)
+		}
+	}
+
+	select {
+	case err := <-failed:
+		if errors.Is(err, os.ErrDeadlineExceeded) == false {
+			t.Errorf("want the write to time out, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("want the stalled connection to fail")
+	}
+}
@@ -0,0 +1,120 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"io"
+	"net"
+	"sync"
+)
+
+// Receiver handles the events forwarded by Senders with ddd.Bootstrapper.HandleEvent.
+// The events whose names are not registered in its ddd.Codec are reported to the error handler and dropped,
+// as are the events that failed, and the ones that exceeded the maximum number of hops (see WithMaxHops),
+// so they are not sent again.
+type Receiver struct {
+	bootstrapper *ddd.Bootstrapper
+	codec        *ddd.Codec
+	options      options
+}
+
+// NewReceiver initializes a new Receiver instance, which decodes the events with the codec.
+func NewReceiver(b *ddd.Bootstrapper, codec *ddd.Codec, options ...Option) *Receiver {
+	return &Receiver{bootstrapper: b, codec: codec, options: newOptions(options)}
+}
+
+// ServeConn handles the events of the connection in order, and acknowledges each of them once it was handled,
+// until the connection is closed or ctx is done.
+// Once the Bootstrapper is shutting down, it returns without acknowledging the event, so the Sender sends it again.
+func (r *Receiver) ServeConn(ctx context.Context, conn io.ReadWriter) error {
+	for ctx.Err() == nil {
+		f, err := readFrame(conn, r.options.maxFrameSize)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if err = r.handle(ctx, f); err != nil {
+			if errors.Is(err, ddd.ErrShuttingDown) || ctx.Err() != nil {
+				return err
+			}
+			r.options.errorHandler(err)
+		}
+		if err = writeFrame(conn, frame{Ack: f.Seq}, r.options.writeTimeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Receiver) handle(ctx context.Context, f frame) error {
+	if f.Hops > r.options.maxHops {
+		return fmt.Errorf("dropped forwarded event %q after %d hops", f.Type, f.Hops)
+	}
+	event, err := r.codec.DecodeEvent(f.Type, f.Payload)
+	if err != nil {
+		return err
+	}
+	if err = r.bootstrapper.HandleEvent(withReceived(ctx, event, f.Hops), event); err != nil {
+		return fmt.Errorf("failed to handle forwarded event %q: %w", f.Type, err)
+	}
+	return nil
+}
+
+// Serve accepts connections on the listener and serves each of them (see ServeConn), until ctx is done.
+func (r *Receiver) Serve(ctx context.Context, listener net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var mu sync.Mutex
+	conns := make(map[net.Conn]struct{})
+	// closed is set once the connections were closed, so the ones accepted later are closed right away.
+	closed := false
+	// Closing the connections lets wg.Wait return, no matter why Serve returns.
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
+		}
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		closed = true
+		for conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		mu.Lock()
+		if closed || ctx.Err() != nil {
+			mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		conns[conn] = struct{}{}
+		wg.Add(1)
+		mu.Unlock()
+		go func() {
+			defer wg.Done()
+			if err := r.ServeConn(ctx, conn); err != nil && ctx.Err() == nil {
+				r.options.errorHandler(err)
+			}
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
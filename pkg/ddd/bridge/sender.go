@@ -0,0 +1,212 @@
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"net"
+	"sync"
+	"time"
+)
+
+// Sender forwards events to the Receiver listening on its address, such as the path of a Unix domain socket.
+// The events are kept in memory until they are acknowledged, so the events that were not acknowledged yet
+// are lost when the process exits.
+type Sender struct {
+	network string
+	address string
+	options options
+	mu      sync.Mutex
+	// buffer holds the events that were not acknowledged yet, in the order of their sequence numbers.
+	buffer []frame
+	seq    uint64
+	// dropped counts the events that did not fit in the buffer.
+	dropped int
+	// changed is closed (and replaced) whenever events are buffered, to wake up the connection.
+	changed chan struct{}
+}
+
+// NewSender initializes a new Sender instance, which connects to the address on the network ("unix" or "tcp").
+func NewSender(network string, address string, options ...Option) *Sender {
+	return &Sender{
+		network: network,
+		address: address,
+		options: newOptions(options),
+		changed: make(chan struct{}),
+	}
+}
+
+// Forward registers an event handler for each of the events, which forwards the event once the unit of work
+// that raised it was committed (see ddd.UnitOfWork.AfterCommit). Forwarding is best-effort, so when the buffer is full
+// the event is dropped rather than failing the committed unit of work: the drop is reported to the error handler
+// with an error wrapping ErrBufferFull, and counted by Dropped. The events received by a Receiver are not forwarded.
+func (s *Sender) Forward(b *ddd.Bootstrapper, events ...ddd.Event) error {
+	for _, event := range events {
+		err := b.RegisterEventHandlerFactory(event, func() (ddd.EventHandler, error) {
+			return &forwarder{sender: s}, nil
+		}, ddd.JoinUnitOfWork())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dropped returns the number of events that were dropped, since the buffer was full.
+func (s *Sender) Dropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dropped
+}
+
+// Pending returns the number of events that were not acknowledged yet.
+func (s *Sender) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.buffer)
+}
+
+// Run connects to the Receiver and sends the buffered events until ctx is done.
+// Whenever the connection fails, it reconnects with an exponential backoff (see WithBackoff),
+// and sends the events that were not acknowledged again.
+func (s *Sender) Run(ctx context.Context) error {
+	var dialer net.Dialer
+	backoff := s.options.minBackoff
+	for {
+		conn, err := dialer.DialContext(ctx, s.network, s.address)
+		if err == nil {
+			backoff = s.options.minBackoff
+			err = s.send(ctx, conn)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		s.options.errorHandler(fmt.Errorf("connection to %s failed: %w", s.address, err))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+		if backoff *= 2; backoff > s.options.maxBackoff {
+			backoff = s.options.maxBackoff
+		}
+	}
+}
+
+// send writes the buffered events to the connection, and reads their acknowledgements, until either fails.
+func (s *Sender) send(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			f, err := readFrame(conn, s.options.maxFrameSize)
+			if err != nil {
+				failed <- err
+				return
+			}
+			s.ack(f.Ack)
+		}
+	}()
+
+	// sent is the sequence number of the last event written to this connection.
+	var sent uint64
+	for {
+		s.mu.Lock()
+		var frames []frame
+		for _, f := range s.buffer {
+			if f.Seq > sent {
+				frames = append(frames, f)
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+
+		for _, f := range frames {
+			if err := writeFrame(conn, f, s.options.writeTimeout); err != nil {
+				return err
+			}
+			sent = f.Seq
+		}
+		select {
+		case <-changed:
+		case err := <-failed:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// enqueue buffers the event, or drops it when the buffer is full.
+func (s *Sender) enqueue(f frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.buffer) >= s.options.bufferSize {
+		s.dropped++
+		s.options.errorHandler(fmt.Errorf("dropped event %q: %w, %d events are not acknowledged yet", f.Type, ErrBufferFull, len(s.buffer)))
+		return
+	}
+	s.seq++
+	f.Seq = s.seq
+	s.buffer = append(s.buffer, f)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// ack removes the events up to seq from the buffer.
+func (s *Sender) ack(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := 0
+	for i < len(s.buffer) && s.buffer[i].Seq <= seq {
+		i++
+	}
+	s.buffer = s.buffer[i:]
+}
+
+// forwarder is the event handler that forwards the events, once its unit of work was committed.
+type forwarder struct {
+	sender *Sender
+}
+
+func (f *forwarder) Handle(ctx context.Context, event ddd.Event) error {
+	hops, ok := forwardedHops(ctx, event)
+	if ok == false {
+		return nil
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event %q: %w", event.EventName(), err)
+	}
+	uow, ok := ddd.UnitOfWorkFromContext(ctx)
+	if ok == false {
+		return fmt.Errorf("event %q is not raised within a unit of work", event.EventName())
+	}
+	forwarded := frame{Type: event.EventName(), Payload: payload, Hops: hops}
+	uow.AfterCommit(func(ctx context.Context) {
+		f.sender.enqueue(forwarded)
+	})
+	return nil
+}
+
+func (f *forwarder) Events() []ddd.Event {
+	return nil
+}
+
+func (f *forwarder) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (f *forwarder) Rollback(ctx context.Context) error {
+	return nil
+}
+
+var _ ddd.EventHandler = (*forwarder)(nil)
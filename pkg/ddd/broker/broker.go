@@ -0,0 +1,254 @@
+// Package broker defines the interfaces of message brokers with topics and consumer groups,
+// and provides brokers that run without external services, for local development and tests:
+// InMemoryBroker within a process, and FileBroker across the processes of a machine.
+//
+// Messages published to a topic are delivered to every consumer group subscribed to it, and each group keeps
+// its own offsets. Within a group, messages with the same key are delivered in order, one at a time.
+// A delivered message that is neither acknowledged nor negatively acknowledged within the visibility timeout
+// is delivered again, and the acknowledgements of the earlier delivery are ignored from then on.
+// A negatively acknowledged message is delivered again after the redelivery delay, which doubles with every attempt.
+package broker
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"hash/fnv"
+	"time"
+)
+
+// ErrClosed is wrapped by the errors of brokers that were closed.
+var ErrClosed = errors.New("broker is closed")
+
+// DefaultPartitions is the default number of partitions of a topic.
+const DefaultPartitions = 4
+
+// DefaultVisibilityTimeout is the default time a delivered message has to be acknowledged, before it is delivered again.
+const DefaultVisibilityTimeout = 30 * time.Second
+
+// DefaultRedeliveryDelay is the default delay before a negatively acknowledged message is delivered again.
+const DefaultRedeliveryDelay = time.Second
+
+// DefaultPollInterval is the default interval at which a FileBroker checks for records appended by other processes.
+const DefaultPollInterval = 100 * time.Millisecond
+
+// Option configures the brokers created by NewInMemoryBroker and OpenFileBroker.
+type Option func(*options)
+
+type options struct {
+	partitions        int
+	visibilityTimeout time.Duration
+	redeliveryDelay   time.Duration
+	segmentSize       int64
+	retentionBytes    int64
+	retentionAge      time.Duration
+	pollInterval      time.Duration
+	errorHandler      func(err error)
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		partitions:        DefaultPartitions,
+		visibilityTimeout: DefaultVisibilityTimeout,
+		redeliveryDelay:   DefaultRedeliveryDelay,
+		segmentSize:       defaultSegmentSize,
+		pollInterval:      DefaultPollInterval,
+		errorHandler:      func(err error) {},
+	}
+	for _, option := range opts {
+		option(&o)
+	}
+	return o
+}
+
+// WithPartitions sets the number of partitions of new topics, which bounds the number of messages of a topic
+// that a consumer group handles concurrently. The default is DefaultPartitions.
+func WithPartitions(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.partitions = n
+		}
+	}
+}
+
+// WithVisibilityTimeout sets the time a delivered message has to be acknowledged, before it is delivered again.
+// The default is DefaultVisibilityTimeout.
+func WithVisibilityTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		if timeout > 0 {
+			o.visibilityTimeout = timeout
+		}
+	}
+}
+
+// WithRedeliveryDelay sets the delay before a negatively acknowledged message is delivered again for the first time,
+// which doubles with every further attempt, up to the visibility timeout. 0 delivers it again right away.
+// The default is DefaultRedeliveryDelay.
+func WithRedeliveryDelay(delay time.Duration) Option {
+	return func(o *options) {
+		if delay >= 0 {
+			o.redeliveryDelay = delay
+		}
+	}
+}
+
+// WithSegmentSize sets the size (in bytes) after which a FileBroker starts a new segment file of a partition.
+// The default is 8MB.
+func WithSegmentSize(bytes int64) Option {
+	return func(o *options) {
+		if bytes > 0 {
+			o.segmentSize = bytes
+		}
+	}
+}
+
+// WithRetention sets how long a FileBroker keeps the records of a partition (0 keeps them forever),
+// and up to which size (0 for any size). Records are deleted a whole segment at a time,
+// and the segment being written to is always kept.
+func WithRetention(maxBytes int64, maxAge time.Duration) Option {
+	return func(o *options) {
+		o.retentionBytes = maxBytes
+		o.retentionAge = maxAge
+	}
+}
+
+// WithPollInterval sets the interval at which a FileBroker checks for records appended by other processes.
+// The default is DefaultPollInterval.
+func WithPollInterval(interval time.Duration) Option {
+	return func(o *options) {
+		if interval > 0 {
+			o.pollInterval = interval
+		}
+	}
+}
+
+// WithErrorHandler sets a function that is called with the errors of the subscriptions of a FileBroker,
+// which retry after the poll interval.
+func WithErrorHandler(handler func(err error)) Option {
+	return func(o *options) {
+		o.errorHandler = handler
+	}
+}
+
+// Record is a message to be published to a topic.
+type Record struct {
+	// Key routes the record to its partition, so the records with the same key are delivered in order.
+	// Records without a key are spread over the partitions.
+	Key string
+	// Data is the encoded message, which is usually an ddd.Envelope (see ddd.NewEnvelope).
+	Data []byte
+	// Delay postpones the delivery of the record. Delayed records are only appended to their partition once due,
+	// so they are ordered by their due time.
+	Delay time.Duration
+}
+
+// Publisher is an interface that should be implemented by the adapters of message brokers that publish records.
+type Publisher interface {
+	// Publish appends the records to the topic.
+	Publish(ctx context.Context, topic string, records ...Record) error
+}
+
+// Subscriber is an interface that should be implemented by the adapters of message brokers that deliver records
+// to consumer groups.
+type Subscriber interface {
+	// Subscribe delivers the records of the topic that were not acknowledged by the consumer group yet.
+	// The subscribers of the same group share its records. The channel is closed once ctx is done.
+	Subscribe(ctx context.Context, topic string, group string) (<-chan ddd.Message, error)
+}
+
+// Broker is implemented by the message brokers of this package.
+type Broker interface {
+	Publisher
+	Subscriber
+	// Close ends the subscriptions, and releases the resources of the broker.
+	Close() error
+}
+
+// Delivery is implemented by the messages delivered by a Subscriber.
+type Delivery interface {
+	ddd.IdentifiedMessage
+	// Topic returns the topic the message was published to.
+	Topic() string
+	// Key returns the key of the record.
+	Key() string
+	// Attempt returns the number of times the message was delivered to the consumer group, starting with 1.
+	Attempt() int
+	// PublishedAt returns the time the record was appended to its partition.
+	PublishedAt() time.Time
+}
+
+// Subscription returns a ddd.Subscriber of the topic for the consumer group, such as for a ddd.Consumer.
+func Subscription(subscriber Subscriber, topic string, group string) ddd.Subscriber {
+	return &subscription{subscriber: subscriber, topic: topic, group: group}
+}
+
+type subscription struct {
+	subscriber Subscriber
+	topic      string
+	group      string
+}
+
+func (s *subscription) Subscribe(ctx context.Context) (<-chan ddd.Message, error) {
+	return s.subscriber.Subscribe(ctx, s.topic, s.group)
+}
+
+// waitChanged waits until records may have become available, and reports whether the subscription should go on.
+func waitChanged(ctx context.Context, changed <-chan struct{}, closed <-chan struct{}, timeout time.Duration) bool {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-changed:
+		return true
+	case <-expired:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-closed:
+		return false
+	}
+}
+
+// redeliveryDelay returns the delay before a message that was negatively acknowledged on the given attempt
+// is delivered again: the delay doubles with every attempt, up to the visibility timeout.
+func redeliveryDelay(delay time.Duration, attempt int, visibilityTimeout time.Duration) time.Duration {
+	for i := 1; i < attempt && delay < visibilityTimeout; i++ {
+		delay *= 2
+	}
+	if delay > visibilityTimeout {
+		return visibilityTimeout
+	}
+	return delay
+}
+
+// partition returns the partition of the key.
+func partition(key string, partitions int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(partitions))
+}
+
+// fileName returns the name of the file or directory of a topic or consumer group. Names with other characters
+// than letters, digits, '-' and '_' are hex encoded, so they cannot point outside of the broker's directory.
+func fileName(name string) string {
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return "hex-" + hex.EncodeToString([]byte(name))
+		}
+	}
+	return name
+}
+
+func validate(topic string, group string) error {
+	if topic == "" {
+		return ddd.NewError("topic cannot be empty", ddd.StatusCodeBadRequest)
+	}
+	if group == "" {
+		return ddd.NewError("consumer group cannot be empty", ddd.StatusCodeBadRequest)
+	}
+	return nil
+}
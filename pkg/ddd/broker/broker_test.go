@@ -0,0 +1,450 @@
+package broker_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"github.com/vklap/go_ddd/pkg/ddd/broker"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testVisibilityTimeout is the visibility timeout that the brokers under test are expected to be created with.
+const testVisibilityTimeout = 100 * time.Millisecond
+
+// testRedeliveryDelay is the redelivery delay that the brokers under test are expected to be created with.
+const testRedeliveryDelay = 30 * time.Millisecond
+
+func publish(t *testing.T, b broker.Publisher, topic string, records ...broker.Record) {
+	t.Helper()
+	if err := b.Publish(context.Background(), topic, records...); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+}
+
+func subscribe(t *testing.T, ctx context.Context, b broker.Subscriber, topic string, group string) <-chan ddd.Message {
+	t.Helper()
+	messages, err := b.Subscribe(ctx, topic, group)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	return messages
+}
+
+func receive(t *testing.T, messages <-chan ddd.Message) broker.Delivery {
+	t.Helper()
+	select {
+	case message := <-messages:
+		return message.(broker.Delivery)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("want a message, got none")
+		return nil
+	}
+}
+
+func assertNoMessage(t *testing.T, messages <-chan ddd.Message, wait time.Duration) {
+	t.Helper()
+	select {
+	case message := <-messages:
+		t.Fatalf("want no message, got %s", message.Data())
+	case <-time.After(wait):
+	}
+}
+
+func testBrokerConformance(t *testing.T, newBroker func(t *testing.T) broker.Broker) {
+	t.Run("consumer groups have independent offsets", func(t *testing.T) {
+		b := newBroker(t)
+		publish(t, b, "users", broker.Record{Key: "1", Data: []byte("a")}, broker.Record{Key: "1", Data: []byte("b")})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		for _, group := range []string{"mailer", "kpi"} {
+			messages := subscribe(t, ctx, b, "users", group)
+			for _, want := range []string{"a", "b"} {
+				message := receive(t, messages)
+				if string(message.Data()) != want || message.Topic() != "users" || message.Key() != "1" || message.Attempt() != 1 {
+					t.Errorf("want %s of group %s, got %s (%+v)", want, group, message.Data(), message)
+				}
+				message.Ack(ctx)
+			}
+		}
+	})
+
+	t.Run("group resumes from its offset", func(t *testing.T) {
+		b := newBroker(t)
+		publish(t, b, "users", broker.Record{Key: "1", Data: []byte("a")}, broker.Record{Key: "1", Data: []byte("b")})
+		ctx, cancel := context.WithCancel(context.Background())
+		message := receive(t, subscribe(t, ctx, b, "users", "mailer"))
+		message.Ack(ctx)
+		cancel()
+
+		ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+		if message = receive(t, subscribe(t, ctx, b, "users", "mailer")); string(message.Data()) != "b" {
+			t.Errorf("want b, got %s", message.Data())
+		}
+	})
+
+	t.Run("nacked message is delivered again", func(t *testing.T) {
+		b := newBroker(t)
+		publish(t, b, "users", broker.Record{Key: "1", Data: []byte("a")}, broker.Record{Key: "1", Data: []byte("b")})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		messages := subscribe(t, ctx, b, "users", "mailer")
+
+		first := receive(t, messages)
+		nacked := time.Now()
+		first.Nack(ctx, errors.New("mailer is down"))
+		again := receive(t, messages)
+		if string(again.Data()) != "a" || again.ID() != first.ID() || again.Attempt() != 2 {
+			t.Errorf("want a to be delivered again, got %s (attempt %d)", again.Data(), again.Attempt())
+		}
+		if elapsed := time.Since(nacked); elapsed < testRedeliveryDelay {
+			t.Errorf("want a to be delivered again after %v, got %v", testRedeliveryDelay, elapsed)
+		}
+		// The delay doubles with every attempt.
+		nacked = time.Now()
+		again.Nack(ctx, errors.New("mailer is down"))
+		again = receive(t, messages)
+		if elapsed := time.Since(nacked); again.Attempt() != 3 || elapsed < 2*testRedeliveryDelay {
+			t.Errorf("want a to be delivered again after %v, got attempt %d after %v", 2*testRedeliveryDelay, again.Attempt(), elapsed)
+		}
+		again.Ack(ctx)
+		if next := receive(t, messages); string(next.Data()) != "b" {
+			t.Errorf("want b, got %s", next.Data())
+		}
+	})
+
+	t.Run("unacknowledged message is delivered again after the visibility timeout", func(t *testing.T) {
+		b := newBroker(t)
+		publish(t, b, "users", broker.Record{Key: "1", Data: []byte("a")})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		messages := subscribe(t, ctx, b, "users", "mailer")
+
+		started := time.Now()
+		receive(t, messages)
+		again := receive(t, messages)
+		if elapsed := time.Since(started); elapsed < testVisibilityTimeout {
+			t.Errorf("want the message to be delivered again after %v, got %v", testVisibilityTimeout, elapsed)
+		}
+		if again.Attempt() != 2 {
+			t.Errorf("want attempt 2, got %d", again.Attempt())
+		}
+	})
+
+	t.Run("acknowledgement of an earlier delivery is ignored", func(t *testing.T) {
+		b := newBroker(t)
+		publish(t, b, "users", broker.Record{Key: "1", Data: []byte("a")}, broker.Record{Key: "1", Data: []byte("b")})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		messages := subscribe(t, ctx, b, "users", "mailer")
+
+		first := receive(t, messages)
+		again := receive(t, messages)
+		if again.Attempt() != 2 {
+			t.Fatalf("want a to be delivered again, got %s (attempt %d)", again.Data(), again.Attempt())
+		}
+		first.Ack(ctx)
+		first.Nack(ctx, errors.New("mailer is down"))
+		assertNoMessage(t, messages, testVisibilityTimeout/2)
+		again.Ack(ctx)
+		if next := receive(t, messages); string(next.Data()) != "b" {
+			t.Errorf("want b, got %s", next.Data())
+		}
+	})
+
+	t.Run("delayed record is delivered once due", func(t *testing.T) {
+		b := newBroker(t)
+		publish(t, b, "users", broker.Record{Key: "1", Data: []byte("later"), Delay: 150 * time.Millisecond}, broker.Record{Key: "1", Data: []byte("now")})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		messages := subscribe(t, ctx, b, "users", "mailer")
+
+		message := receive(t, messages)
+		if string(message.Data()) != "now" {
+			t.Fatalf("want the record without delay first, got %s", message.Data())
+		}
+		message.Ack(ctx)
+		assertNoMessage(t, messages, 50*time.Millisecond)
+		if message = receive(t, messages); string(message.Data()) != "later" {
+			t.Errorf("want the delayed record, got %s", message.Data())
+		}
+	})
+
+	t.Run("records with the same key are handled in order", func(t *testing.T) {
+		b := newBroker(t)
+		var records []broker.Record
+		for i := 0; i < 40; i++ {
+			records = append(records, broker.Record{Key: fmt.Sprintf("user-%d", i%4), Data: []byte(fmt.Sprint(i))})
+		}
+		publish(t, b, "users", records...)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		messages := subscribe(t, ctx, b, "users", "mailer")
+
+		var mu sync.Mutex
+		handled := make(map[string][]int)
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for message := range messages {
+					delivery := message.(broker.Delivery)
+					var i int
+					fmt.Sscan(string(delivery.Data()), &i)
+					time.Sleep(time.Millisecond)
+					mu.Lock()
+					handled[delivery.Key()] = append(handled[delivery.Key()], i)
+					count := 0
+					for _, values := range handled {
+						count += len(values)
+					}
+					mu.Unlock()
+					message.Ack(ctx)
+					if count == len(records) {
+						cancel()
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		for key, values := range handled {
+			for i := 1; i < len(values); i++ {
+				if values[i] < values[i-1] {
+					t.Errorf("want the records of %s in order, got %v", key, values)
+					break
+				}
+			}
+		}
+	})
+
+	t.Run("closed broker", func(t *testing.T) {
+		b := newBroker(t)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		messages := subscribe(t, ctx, b, "users", "mailer")
+		b.Close()
+
+		if _, ok := <-messages; ok {
+			t.Errorf("want the subscription to end")
+		}
+		if err := b.Publish(ctx, "users", broker.Record{Data: []byte("a")}); errors.Is(err, broker.ErrClosed) == false {
+			t.Errorf("want ErrClosed, got %v", err)
+		}
+	})
+}
+
+func TestInMemoryBroker(t *testing.T) {
+	testBrokerConformance(t, func(t *testing.T) broker.Broker {
+		return broker.NewInMemoryBroker(broker.WithVisibilityTimeout(testVisibilityTimeout), broker.WithRedeliveryDelay(testRedeliveryDelay))
+	})
+}
+
+func openFileBroker(t *testing.T, dir string, options ...broker.Option) *broker.FileBroker {
+	t.Helper()
+	options = append([]broker.Option{
+		broker.WithVisibilityTimeout(testVisibilityTimeout),
+		broker.WithRedeliveryDelay(testRedeliveryDelay),
+		broker.WithPollInterval(10 * time.Millisecond),
+	}, options...)
+	b, err := broker.OpenFileBroker(dir, options...)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	t.Cleanup(func() {
+		b.Close()
+	})
+	return b
+}
+
+func TestFileBroker(t *testing.T) {
+	testBrokerConformance(t, func(t *testing.T) broker.Broker {
+		return openFileBroker(t, t.TempDir())
+	})
+}
+
+func TestFileBrokerSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	b := openFileBroker(t, dir)
+	publish(t, b, "users", broker.Record{Key: "1", Data: []byte("a")}, broker.Record{Key: "1", Data: []byte("b")})
+	publish(t, b, "users", broker.Record{Key: "1", Data: []byte("later"), Delay: 100 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	message := receive(t, subscribe(t, ctx, b, "users", "mailer"))
+	if err := message.Ack(ctx); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	b.Close()
+
+	b = openFileBroker(t, dir)
+	messages := subscribe(t, ctx, b, "users", "mailer")
+	for _, want := range []string{"b", "later"} {
+		message = receive(t, messages)
+		if string(message.Data()) != want || message.ID() == "" {
+			t.Errorf("want %s, got %s", want, message.Data())
+		}
+		message.Ack(ctx)
+	}
+}
+
+func TestFileBrokerSharedByProcesses(t *testing.T) {
+	// Brokers opened separately on the same directory only share its files, like different processes.
+	dir := t.TempDir()
+	publisher := openFileBroker(t, dir)
+	first := openFileBroker(t, dir)
+	second := openFileBroker(t, dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	received := make(chan string)
+	for _, subscriber := range []*broker.FileBroker{first, second} {
+		messages := subscribe(t, ctx, subscriber, "users", "mailer")
+		go func() {
+			for message := range messages {
+				message.Ack(ctx)
+				received <- string(message.Data())
+			}
+		}()
+	}
+	var records []broker.Record
+	for i := 0; i < 20; i++ {
+		records = append(records, broker.Record{Key: fmt.Sprint(i), Data: []byte(fmt.Sprint(i))})
+	}
+	publish(t, publisher, "users", records...)
+
+	got := make(map[string]int)
+	for range records {
+		select {
+		case data := <-received:
+			got[data]++
+		case <-time.After(2 * time.Second):
+			t.Fatalf("want %d messages, got %d", len(records), len(got))
+		}
+	}
+	for _, record := range records {
+		if got[string(record.Data)] != 1 {
+			t.Errorf("want %s to be received once, got %d times", record.Data, got[string(record.Data)])
+		}
+	}
+}
+
+func TestFileBrokerRetention(t *testing.T) {
+	b := openFileBroker(t, t.TempDir(), broker.WithPartitions(1), broker.WithSegmentSize(100), broker.WithRetention(250, 0))
+	for i := 0; i < 10; i++ {
+		publish(t, b, "users", broker.Record{Data: []byte(fmt.Sprintf("record %d", i))})
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	message := receive(t, subscribe(t, ctx, b, "users", "mailer"))
+	if string(message.Data()) == "record 0" {
+		t.Errorf("want the oldest records to be deleted")
+	}
+	if string(message.Data()) == "record 9" {
+		t.Errorf("want the newest records to be kept, got only %s", message.Data())
+	}
+}
+
+func TestFileBrokerTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	b := openFileBroker(t, dir, broker.WithPartitions(1))
+	publish(t, b, "users", broker.Record{Data: []byte("a")})
+	b.Close()
+	segments, _ := filepath.Glob(filepath.Join(dir, "users", "partition-000", "*.log"))
+	if len(segments) != 1 {
+		t.Fatalf("want a segment, got %v", segments)
+	}
+	file, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	// A crash during an append leaves a partial record behind.
+	file.Write([]byte{0, 0, 0, 42, 1, 2})
+	file.Close()
+
+	b = openFileBroker(t, dir)
+	publish(t, b, "users", broker.Record{Data: []byte("b")})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages := subscribe(t, ctx, b, "users", "mailer")
+	for _, want := range []string{"a", "b"} {
+		message := receive(t, messages)
+		if string(message.Data()) != want {
+			t.Errorf("want %s, got %s", want, message.Data())
+		}
+		message.Ack(ctx)
+	}
+}
+
+func TestSubscriptionFeedsConsumer(t *testing.T) {
+	b := broker.NewInMemoryBroker()
+	codec := ddd.NewCodec()
+	codec.RegisterCommand(&pingCommand{})
+	bootstrapper := ddd.NewBootstrapper()
+	handled := make(chan string, 1)
+	bootstrapper.RegisterCommandHandlerFactory(&pingCommand{}, func() (ddd.CommandHandler, error) {
+		return &pingCommandHandler{handled: handled}, nil
+	})
+	data, _ := ddd.NewEnvelope("ping", &pingCommand{Value: "pong"})
+	publish(t, b, "commands", broker.Record{Data: data})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- ddd.NewConsumer(bootstrapper, broker.Subscription(b, "commands", "worker"), codec).Run(ctx)
+	}()
+	select {
+	case value := <-handled:
+		if value != "pong" {
+			t.Errorf("want pong, got %s", value)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("want the command to be handled")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("want no error, got %v", err)
+	}
+}
+
+type pingCommand struct {
+	Value string `json:"value"`
+}
+
+func (c *pingCommand) IsValid() error {
+	return nil
+}
+
+func (c *pingCommand) CommandName() string {
+	return "ping"
+}
+
+type pingCommandHandler struct {
+	handled chan<- string
+	value   string
+}
+
+func (h *pingCommandHandler) Handle(ctx context.Context, command ddd.Command) (any, error) {
+	h.value = command.(*pingCommand).Value
+	return nil, nil
+}
+
+func (h *pingCommandHandler) Commit(ctx context.Context) error {
+	h.handled <- h.value
+	return nil
+}
+
+func (h *pingCommandHandler) Rollback(ctx context.Context) error {
+	return nil
+}
+
+func (h *pingCommandHandler) Events() []ddd.Event {
+	return nil
+}
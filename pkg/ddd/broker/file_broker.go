@@ -0,0 +1,917 @@
+package broker
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentPrefix      = "segment-"
+	segmentSuffix      = ".log"
+	recordHeaderSize   = 8
+	maxRecordSize      = 64 << 20
+	defaultSegmentSize = 8 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FileBroker is a Broker that persists its topics within a directory, so the records and the offsets of the
+// consumer groups survive restarts, and the processes of a machine can talk through it.
+//
+// Every partition of a topic is an append-only log of segment files, whose records consist of their length
+// (4 bytes), their CRC-32C checksum (4 bytes) and a JSON payload. The directory is laid out as:
+//
+//	<topic>/topic.json                           the number of partitions of the topic
+//	<topic>/lock                                 the file that is locked while the topic is changed
+//	<topic>/delayed.json                         the delayed records that are not due yet
+//	<topic>/partition-<n>/segment-<offset>.log   the records of the partition, starting at offset
+//	<topic>/groups/<group>.json                  the offsets of the consumer group
+//
+// The processes lock a topic with an advisory file lock while they change it, and poll its files for the changes
+// of the other processes (see WithPollInterval). Old segments are deleted when records are published,
+// according to WithRetention. A record that was only partially written when a process crashed is truncated.
+type FileBroker struct {
+	// mu guards topics and changed. It is not held while a topic is changed, which is guarded by the topic itself.
+	mu      sync.Mutex
+	dir     string
+	options options
+	topics  map[string]*fileTopic
+	// changed is closed (and replaced) whenever records become available within the process,
+	// to wake up the subscriptions before their next poll.
+	changed chan struct{}
+	closed  chan struct{}
+}
+
+type fileTopic struct {
+	// mu serializes the changes of the topic within the process, while lock serializes them across the processes.
+	mu         sync.Mutex
+	dir        string
+	lock       *os.File
+	partitions []*filePartition
+	// next is the partition of the next record without a key.
+	next int
+}
+
+type filePartition struct {
+	dir      string
+	segments []*fileSegment
+}
+
+type fileSegment struct {
+	path string
+	file *os.File
+	// first is the offset of the first record of the segment.
+	first int64
+	size  int64
+	// positions are the positions of the records within the file.
+	positions []int64
+}
+
+type fileTopicMetadata struct {
+	Partitions int `json:"partitions"`
+}
+
+type fileRecord struct {
+	Key         string    `json:"key,omitempty"`
+	Data        []byte    `json:"data"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+type delayedRecord struct {
+	Key  string    `json:"key,omitempty"`
+	Data []byte    `json:"data"`
+	Due  time.Time `json:"due"`
+}
+
+type fileGroup struct {
+	Partitions []fileCursor `json:"partitions"`
+}
+
+// fileCursor is the position of a consumer group within a partition (see memoryCursor).
+type fileCursor struct {
+	Offset   int64 `json:"offset"`
+	InFlight bool  `json:"in_flight,omitempty"`
+	// VisibleAt is the time the record in flight is delivered again, unless it is acknowledged.
+	VisibleAt time.Time `json:"visible_at"`
+	Attempt   int       `json:"attempt,omitempty"`
+	// Delivery identifies the current delivery across the processes, so stale acknowledgements are ignored.
+	Delivery int64 `json:"delivery"`
+}
+
+// OpenFileBroker opens the broker in the given directory, which is created if needed.
+func OpenFileBroker(dir string, opts ...Option) (*FileBroker, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create broker directory: %w", err)
+	}
+	return &FileBroker{
+		dir:     dir,
+		options: newOptions(opts),
+		topics:  make(map[string]*fileTopic),
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+// Publish appends the records to the topic, and flushes them to stable storage.
+// It fails with an Error wrapping ErrClosed once the broker was closed.
+func (b *FileBroker) Publish(ctx context.Context, topic string, records ...Record) error {
+	if topic == "" {
+		return ddd.NewError("topic cannot be empty", ddd.StatusCodeBadRequest)
+	}
+	return b.withTopic(topic, func(t *fileTopic) error {
+		now := time.Now()
+		written := make(map[*fileSegment]struct{})
+		var delayed []delayedRecord
+		for _, record := range records {
+			if record.Delay > 0 {
+				delayed = append(delayed, delayedRecord{Key: record.Key, Data: record.Data, Due: now.Add(record.Delay)})
+				continue
+			}
+			segment, err := t.append(record.Key, record.Data, now, b.options.segmentSize)
+			if err != nil {
+				return err
+			}
+			written[segment] = struct{}{}
+		}
+		if err := syncSegments(written); err != nil {
+			return err
+		}
+		if len(delayed) > 0 {
+			pending, err := t.loadDelayed()
+			if err != nil {
+				return err
+			}
+			if err = t.saveDelayed(append(pending, delayed...)); err != nil {
+				return err
+			}
+		}
+		if err := t.enforceRetention(now, b.options); err != nil {
+			return err
+		}
+		b.broadcast()
+		return nil
+	})
+}
+
+// Subscribe delivers the records of the topic to the consumer group (see Subscriber), including the records
+// published by other processes. It fails with an Error wrapping ErrClosed once the broker was closed,
+// and its channel is closed by Close as well.
+func (b *FileBroker) Subscribe(ctx context.Context, topic string, group string) (<-chan ddd.Message, error) {
+	if err := validate(topic, group); err != nil {
+		return nil, err
+	}
+	if err := b.withTopic(topic, func(t *fileTopic) error { return nil }); err != nil {
+		return nil, err
+	}
+	messages := make(chan ddd.Message)
+	go b.deliver(ctx, topic, group, messages)
+	return messages, nil
+}
+
+// Close ends the subscriptions, and closes the files of the broker. The delayed records are kept.
+func (b *FileBroker) Close() error {
+	b.mu.Lock()
+	if b.checkClosed() != nil {
+		b.mu.Unlock()
+		return nil
+	}
+	close(b.closed)
+	topics := b.topics
+	b.topics = nil
+	b.mu.Unlock()
+
+	var err error
+	for _, t := range topics {
+		// Waits for the change in progress (if any); the later ones see that the broker is closed.
+		t.mu.Lock()
+		if closeErr := t.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		t.mu.Unlock()
+	}
+	return err
+}
+
+// deliver sends the available records to the subscription, until ctx is done or the broker is closed.
+func (b *FileBroker) deliver(ctx context.Context, topic string, group string, messages chan<- ddd.Message) {
+	defer close(messages)
+	// start is the partition that is checked first, so all the partitions get their turn.
+	start := 0
+	for {
+		b.mu.Lock()
+		changed := b.changed
+		b.mu.Unlock()
+
+		message, wait, err := b.next(topic, group, &start)
+		if err != nil {
+			if errors.Is(err, ErrClosed) {
+				return
+			}
+			b.options.errorHandler(err)
+		}
+		if message != nil {
+			select {
+			case messages <- message:
+				b.sent(message, true)
+				continue
+			case <-ctx.Done():
+			case <-b.closed:
+			}
+			b.sent(message, false)
+			return
+		}
+
+		if wait == 0 || wait > b.options.pollInterval {
+			wait = b.options.pollInterval
+		}
+		if waitChanged(ctx, changed, b.closed, wait) == false {
+			return
+		}
+	}
+}
+
+// next claims the next record that the group should handle, or else returns the time until a record in flight
+// becomes visible again or a delayed record is due (0 when there is none).
+func (b *FileBroker) next(topic string, group string, start *int) (message *fileMessage, wait time.Duration, err error) {
+	err = b.withTopic(topic, func(t *fileTopic) error {
+		now := time.Now()
+		moved, due, err := t.moveDue(now, b.options.segmentSize)
+		if err != nil {
+			return err
+		}
+		if moved {
+			b.broadcast()
+		}
+		wait = due
+		g, err := t.loadGroup(group)
+		if err != nil {
+			return err
+		}
+		changed := false
+		for i := range g.Partitions {
+			p := (*start + i) % len(g.Partitions)
+			cursor := &g.Partitions[p]
+			records := t.partitions[p]
+			if cursor.Offset < records.start() {
+				// The records were deleted by the retention before the group handled them.
+				*cursor = fileCursor{Offset: records.start(), Delivery: cursor.Delivery}
+				changed = true
+			}
+			if cursor.InFlight && now.Before(cursor.VisibleAt) {
+				if until := cursor.VisibleAt.Sub(now); wait == 0 || until < wait {
+					wait = until
+				}
+				continue
+			}
+			if cursor.InFlight == false && cursor.Offset >= records.end() {
+				continue
+			}
+			record, err := records.read(cursor.Offset)
+			if err != nil {
+				return err
+			}
+			cursor.InFlight = true
+			cursor.Attempt++
+			cursor.Delivery++
+			cursor.VisibleAt = now.Add(b.options.visibilityTimeout).Round(0)
+			*start = p + 1
+			message = &fileMessage{
+				broker:    b,
+				topic:     topic,
+				group:     group,
+				partition: p,
+				offset:    cursor.Offset,
+				delivery:  cursor.Delivery,
+				attempt:   cursor.Attempt,
+				visibleAt: cursor.VisibleAt,
+				record:    record,
+			}
+			return t.saveGroup(group, g)
+		}
+		if changed {
+			return t.saveGroup(group, g)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return message, wait, nil
+}
+
+// sent restarts the visibility timeout of the message once it was received,
+// or makes it available again if it could not be sent.
+func (b *FileBroker) sent(message *fileMessage, ok bool) {
+	err := b.withTopic(message.topic, func(t *fileTopic) error {
+		g, err := t.loadGroup(message.group)
+		if err != nil {
+			return err
+		}
+		cursor := &g.Partitions[message.partition]
+		if cursor.InFlight == false || cursor.Delivery != message.delivery || cursor.VisibleAt.Equal(message.visibleAt) == false {
+			// The message was acknowledged, negatively acknowledged or delivered again in the meantime.
+			return nil
+		}
+		if ok {
+			cursor.VisibleAt = time.Now().Add(b.options.visibilityTimeout).Round(0)
+			return t.saveGroup(message.group, g)
+		}
+		cursor.VisibleAt = time.Time{}
+		cursor.Attempt--
+		if err = t.saveGroup(message.group, g); err != nil {
+			return err
+		}
+		b.broadcast()
+		return nil
+	})
+	if err != nil && errors.Is(err, ErrClosed) == false {
+		b.options.errorHandler(err)
+	}
+}
+
+func (b *FileBroker) ack(message *fileMessage) error {
+	return b.withTopic(message.topic, func(t *fileTopic) error {
+		g, err := t.loadGroup(message.group)
+		if err != nil {
+			return err
+		}
+		cursor := &g.Partitions[message.partition]
+		if cursor.InFlight == false || cursor.Offset != message.offset || cursor.Delivery != message.delivery {
+			// The record was already acknowledged, or delivered again after its visibility timeout.
+			return nil
+		}
+		*cursor = fileCursor{Offset: cursor.Offset + 1, Delivery: cursor.Delivery}
+		if err = t.saveGroup(message.group, g); err != nil {
+			return err
+		}
+		b.broadcast()
+		return nil
+	})
+}
+
+func (b *FileBroker) nack(message *fileMessage) error {
+	return b.withTopic(message.topic, func(t *fileTopic) error {
+		g, err := t.loadGroup(message.group)
+		if err != nil {
+			return err
+		}
+		cursor := &g.Partitions[message.partition]
+		if cursor.InFlight == false || cursor.Offset != message.offset || cursor.Delivery != message.delivery {
+			// The record was acknowledged, or delivered again in the meantime.
+			return nil
+		}
+		delay := redeliveryDelay(b.options.redeliveryDelay, cursor.Attempt, b.options.visibilityTimeout)
+		cursor.VisibleAt = time.Now().Add(delay).Round(0)
+		if err = t.saveGroup(message.group, g); err != nil {
+			return err
+		}
+		b.broadcast()
+		return nil
+	})
+}
+
+// withTopic runs fn while holding the lock of the topic, both within the process and across the processes,
+// once the segments of its partitions were refreshed. The other topics are not blocked meanwhile.
+func (b *FileBroker) withTopic(name string, fn func(t *fileTopic) error) error {
+	b.mu.Lock()
+	t, err := b.topic(name)
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// The broker may have been closed while waiting for the topic, which closed its files.
+	if err = b.checkClosed(); err != nil {
+		return err
+	}
+	if err = lockFile(t.lock); err != nil {
+		return fmt.Errorf("failed to lock topic %q: %w", name, err)
+	}
+	defer unlockFile(t.lock)
+
+	if err = t.refresh(); err != nil {
+		return err
+	}
+	return fn(t)
+}
+
+// topic opens the topic, and creates it if needed. It fails once the broker was closed.
+func (b *FileBroker) topic(name string) (*fileTopic, error) {
+	if err := b.checkClosed(); err != nil {
+		return nil, err
+	}
+	if t, ok := b.topics[name]; ok {
+		return t, nil
+	}
+	dir := filepath.Join(b.dir, fileName(name))
+	if err := os.MkdirAll(filepath.Join(dir, "groups"), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create topic directory: %w", err)
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open topic lock: %w", err)
+	}
+	t := &fileTopic{dir: dir, lock: lock}
+	if err = t.open(b.options.partitions); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	b.topics[name] = t
+	return t, nil
+}
+
+func (b *FileBroker) broadcast() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *FileBroker) checkClosed() error {
+	select {
+	case <-b.closed:
+		return ddd.WrapError(ErrClosed, ErrClosed.Error(), ddd.StatusCodeUnavailable)
+	default:
+		return nil
+	}
+}
+
+// open reads the number of partitions of the topic, or stores it when the topic is new.
+func (t *fileTopic) open(partitions int) error {
+	if err := lockFile(t.lock); err != nil {
+		return fmt.Errorf("failed to lock topic: %w", err)
+	}
+	defer unlockFile(t.lock)
+
+	path := filepath.Join(t.dir, "topic.json")
+	var metadata fileTopicMetadata
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err = json.Unmarshal(data, &metadata); err != nil || metadata.Partitions <= 0 {
+			return fmt.Errorf("invalid topic metadata %s: %v", path, err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		metadata.Partitions = partitions
+		if err = writeFileAtomically(path, metadata); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("failed to read topic metadata: %w", err)
+	}
+	for i := 0; i < metadata.Partitions; i++ {
+		dir := filepath.Join(t.dir, fmt.Sprintf("partition-%03d", i))
+		if err = os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create partition directory: %w", err)
+		}
+		t.partitions = append(t.partitions, &filePartition{dir: dir})
+	}
+	return nil
+}
+
+func (t *fileTopic) refresh() error {
+	for _, p := range t.partitions {
+		if err := p.refresh(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append appends a record to its partition, and returns the segment it was written to.
+func (t *fileTopic) append(key string, data []byte, now time.Time, segmentSize int64) (*fileSegment, error) {
+	p := t.next
+	if key == "" {
+		t.next = (t.next + 1) % len(t.partitions)
+	} else {
+		p = partition(key, len(t.partitions))
+	}
+	return t.partitions[p].append(fileRecord{Key: key, Data: data, PublishedAt: now.UTC()}, segmentSize)
+}
+
+// moveDue appends the delayed records that are due, and returns the time until the next one is due.
+func (t *fileTopic) moveDue(now time.Time, segmentSize int64) (moved bool, wait time.Duration, err error) {
+	delayed, err := t.loadDelayed()
+	if err != nil || len(delayed) == 0 {
+		return false, 0, err
+	}
+	sort.SliceStable(delayed, func(i, j int) bool {
+		return delayed[i].Due.Before(delayed[j].Due)
+	})
+	written := make(map[*fileSegment]struct{})
+	i := 0
+	for ; i < len(delayed) && now.Before(delayed[i].Due) == false; i++ {
+		segment, err := t.append(delayed[i].Key, delayed[i].Data, now, segmentSize)
+		if err != nil {
+			return false, 0, err
+		}
+		written[segment] = struct{}{}
+	}
+	if i == 0 {
+		return false, delayed[0].Due.Sub(now), nil
+	}
+	if err = syncSegments(written); err != nil {
+		return false, 0, err
+	}
+	if err = t.saveDelayed(delayed[i:]); err != nil {
+		return false, 0, err
+	}
+	if i < len(delayed) {
+		wait = delayed[i].Due.Sub(now)
+	}
+	return true, wait, nil
+}
+
+func (t *fileTopic) loadDelayed() ([]delayedRecord, error) {
+	var delayed []delayedRecord
+	if err := readFile(filepath.Join(t.dir, "delayed.json"), &delayed); err != nil && errors.Is(err, os.ErrNotExist) == false {
+		return nil, err
+	}
+	return delayed, nil
+}
+
+func (t *fileTopic) saveDelayed(delayed []delayedRecord) error {
+	path := filepath.Join(t.dir, "delayed.json")
+	if len(delayed) == 0 {
+		if err := os.Remove(path); err != nil && errors.Is(err, os.ErrNotExist) == false {
+			return fmt.Errorf("failed to remove delayed records: %w", err)
+		}
+		return nil
+	}
+	return writeFileAtomically(path, delayed)
+}
+
+// loadGroup returns the offsets of the consumer group, which start at the first record of new groups.
+func (t *fileTopic) loadGroup(group string) (*fileGroup, error) {
+	g := &fileGroup{}
+	if err := readFile(t.groupPath(group), g); err != nil && errors.Is(err, os.ErrNotExist) == false {
+		return nil, err
+	}
+	for len(g.Partitions) < len(t.partitions) {
+		g.Partitions = append(g.Partitions, fileCursor{})
+	}
+	return g, nil
+}
+
+func (t *fileTopic) saveGroup(group string, g *fileGroup) error {
+	return writeFileAtomically(t.groupPath(group), g)
+}
+
+func (t *fileTopic) groupPath(group string) string {
+	return filepath.Join(t.dir, "groups", fileName(group)+".json")
+}
+
+// enforceRetention deletes the oldest segments of the partitions, as long as they exceed the retention.
+func (t *fileTopic) enforceRetention(now time.Time, o options) error {
+	if o.retentionBytes <= 0 && o.retentionAge <= 0 {
+		return nil
+	}
+	for _, p := range t.partitions {
+		var size int64
+		for _, segment := range p.segments {
+			size += segment.size
+		}
+		for len(p.segments) > 1 {
+			oldest := p.segments[0]
+			info, err := oldest.file.Stat()
+			if err != nil {
+				return fmt.Errorf("failed to stat segment %s: %w", oldest.path, err)
+			}
+			expired := o.retentionAge > 0 && now.Sub(info.ModTime()) > o.retentionAge
+			if expired == false && (o.retentionBytes <= 0 || size <= o.retentionBytes) {
+				break
+			}
+			oldest.file.Close()
+			if err = os.Remove(oldest.path); err != nil {
+				return fmt.Errorf("failed to remove segment %s: %w", oldest.path, err)
+			}
+			size -= oldest.size
+			p.segments = p.segments[1:]
+		}
+	}
+	return nil
+}
+
+func (t *fileTopic) close() error {
+	err := t.lock.Close()
+	for _, p := range t.partitions {
+		for _, segment := range p.segments {
+			if closeErr := segment.file.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// start returns the offset of the first record that was not deleted by the retention.
+func (p *filePartition) start() int64 {
+	if len(p.segments) == 0 {
+		return 0
+	}
+	return p.segments[0].first
+}
+
+// end returns the offset of the next record.
+func (p *filePartition) end() int64 {
+	if len(p.segments) == 0 {
+		return 0
+	}
+	last := p.segments[len(p.segments)-1]
+	return last.first + int64(len(last.positions))
+}
+
+// refresh picks up the segments created and deleted by other processes, and indexes the records they appended.
+func (p *filePartition) refresh() error {
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read partition directory: %w", err)
+	}
+	var firsts []int64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, segmentPrefix) == false || strings.HasSuffix(name, segmentSuffix) == false {
+			continue
+		}
+		if first, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64); err == nil {
+			firsts = append(firsts, first)
+		}
+	}
+	sort.Slice(firsts, func(i, j int) bool {
+		return firsts[i] < firsts[j]
+	})
+
+	existing := make(map[string]*fileSegment, len(p.segments))
+	for _, segment := range p.segments {
+		existing[segment.path] = segment
+	}
+	segments := make([]*fileSegment, 0, len(firsts))
+	for _, first := range firsts {
+		path := p.segmentPath(first)
+		segment, ok := existing[path]
+		if ok {
+			delete(existing, path)
+		} else {
+			file, err := os.OpenFile(path, os.O_RDWR, 0o644)
+			if err != nil {
+				return fmt.Errorf("failed to open segment: %w", err)
+			}
+			segment = &fileSegment{path: path, file: file, first: first}
+		}
+		segments = append(segments, segment)
+	}
+	// The remaining segments were deleted by the retention of another process.
+	for _, segment := range existing {
+		segment.file.Close()
+	}
+	p.segments = segments
+
+	for i, segment := range p.segments {
+		if err = segment.scan(i == len(p.segments)-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// append writes the record to the last segment, and rolls over to a new one if needed.
+// A failed write is truncated, so it does not leave a torn record behind.
+func (p *filePartition) append(record fileRecord, segmentSize int64) (*fileSegment, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode record: %w", err)
+	}
+	if len(payload) > maxRecordSize {
+		return nil, fmt.Errorf("record of %d bytes exceeds the maximum of %d bytes", len(payload), maxRecordSize)
+	}
+	buf := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[recordHeaderSize:], payload)
+
+	var segment *fileSegment
+	if len(p.segments) > 0 {
+		last := p.segments[len(p.segments)-1]
+		if last.size == 0 || last.size+int64(len(buf)) <= segmentSize {
+			segment = last
+		}
+	}
+	if segment == nil {
+		first := p.end()
+		path := p.segmentPath(first)
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create segment: %w", err)
+		}
+		segment = &fileSegment{path: path, file: file, first: first}
+		p.segments = append(p.segments, segment)
+	}
+
+	if _, err = segment.file.WriteAt(buf, segment.size); err != nil {
+		_ = segment.file.Truncate(segment.size)
+		return nil, fmt.Errorf("failed to write record to %s: %w", segment.path, err)
+	}
+	segment.positions = append(segment.positions, segment.size)
+	segment.size += int64(len(buf))
+	return segment, nil
+}
+
+// read returns the record at the offset, which should be between start and end.
+func (p *filePartition) read(offset int64) (fileRecord, error) {
+	var record fileRecord
+	for i := len(p.segments) - 1; i >= 0; i-- {
+		segment := p.segments[i]
+		if offset < segment.first {
+			continue
+		}
+		index := offset - segment.first
+		position := segment.positions[index]
+		end := segment.size
+		if index+1 < int64(len(segment.positions)) {
+			end = segment.positions[index+1]
+		}
+		payload := make([]byte, end-position-recordHeaderSize)
+		if _, err := segment.file.ReadAt(payload, position+recordHeaderSize); err != nil {
+			return record, fmt.Errorf("failed to read record %d of %s: %w", offset, segment.path, err)
+		}
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return record, fmt.Errorf("failed to decode record %d of %s: %w", offset, segment.path, err)
+		}
+		return record, nil
+	}
+	return record, fmt.Errorf("record %d of %s is not found", offset, p.dir)
+}
+
+func (p *filePartition) segmentPath(first int64) string {
+	return filepath.Join(p.dir, fmt.Sprintf("%s%020d%s", segmentPrefix, first, segmentSuffix))
+}
+
+// scan indexes the records appended since the last scan. A corrupted record is only tolerated at the end
+// of the last segment, where it is the result of a crash during an append, and is truncated.
+func (s *fileSegment) scan(last bool) error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat segment %s: %w", s.path, err)
+	}
+	fileSize := info.Size()
+	if fileSize < s.size {
+		// The segment was truncated by another process, so it is indexed again.
+		s.size = 0
+		s.positions = nil
+	}
+	reader := io.NewSectionReader(s.file, 0, fileSize)
+	header := make([]byte, recordHeaderSize)
+	for s.size < fileSize {
+		size, err := scanRecord(reader, header, s.size, fileSize)
+		if err != nil {
+			if last == false {
+				return fmt.Errorf("segment %s is corrupted at position %d: %w", s.path, s.size, err)
+			}
+			if err = s.file.Truncate(s.size); err != nil {
+				return fmt.Errorf("failed to truncate torn tail of segment %s: %w", s.path, err)
+			}
+			if err = s.file.Sync(); err != nil {
+				return fmt.Errorf("failed to sync segment %s: %w", s.path, err)
+			}
+			break
+		}
+		s.positions = append(s.positions, s.size)
+		s.size += recordHeaderSize + size
+	}
+	return nil
+}
+
+func scanRecord(reader *io.SectionReader, header []byte, position int64, fileSize int64) (int64, error) {
+	if _, err := reader.ReadAt(header, position); err != nil {
+		return 0, fmt.Errorf("incomplete record header: %w", err)
+	}
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	if size > maxRecordSize || position+recordHeaderSize+size > fileSize {
+		return 0, errors.New("incomplete record")
+	}
+	payload := make([]byte, size)
+	if _, err := reader.ReadAt(payload, position+recordHeaderSize); err != nil {
+		return 0, fmt.Errorf("incomplete record: %w", err)
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, errors.New("checksum mismatch")
+	}
+	return size, nil
+}
+
+func syncSegments(segments map[*fileSegment]struct{}) error {
+	for segment := range segments {
+		if err := segment.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync segment %s: %w", segment.path, err)
+		}
+	}
+	return nil
+}
+
+func readFile(path string, value any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeFileAtomically writes the value as JSON to a temporary file, and renames it to path.
+// Both the temporary file and the directory are flushed to stable storage, so after a crash
+// path holds either the previous or the new value.
+func writeFileAtomically(path string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", path, err)
+	}
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// fileMessage is a record delivered to a consumer group.
+type fileMessage struct {
+	broker    *FileBroker
+	topic     string
+	group     string
+	partition int
+	offset    int64
+	delivery  int64
+	attempt   int
+	visibleAt time.Time
+	record    fileRecord
+}
+
+func (m *fileMessage) ID() string {
+	return fmt.Sprintf("%s-%d-%d", m.topic, m.partition, m.offset)
+}
+
+func (m *fileMessage) Data() []byte {
+	return m.record.Data
+}
+
+func (m *fileMessage) Topic() string {
+	return m.topic
+}
+
+func (m *fileMessage) Key() string {
+	return m.record.Key
+}
+
+func (m *fileMessage) Attempt() int {
+	return m.attempt
+}
+
+func (m *fileMessage) PublishedAt() time.Time {
+	return m.record.PublishedAt
+}
+
+// Ack acknowledges the message, so the next record of its partition can be delivered.
+// It is ignored once the message was delivered again, since the later delivery is the one to acknowledge.
+func (m *fileMessage) Ack(ctx context.Context) error {
+	return m.broker.ack(m)
+}
+
+// Nack makes the message available to be delivered again after the redelivery delay (see WithRedeliveryDelay).
+func (m *fileMessage) Nack(ctx context.Context, err error) error {
+	return m.broker.nack(m)
+}
+
+var _ Broker = (*FileBroker)(nil)
+var _ Delivery = (*fileMessage)(nil)
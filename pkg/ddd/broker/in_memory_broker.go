@@ -0,0 +1,354 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"sync"
+	"time"
+)
+
+// InMemoryBroker is an in-process message broker, which implements both Publisher and Subscriber.
+// Topics and consumer groups are created on first use, and new consumer groups start from the first record.
+// The records are kept until the broker is garbage collected, so it is meant for tests and demos.
+type InMemoryBroker struct {
+	mu                sync.Mutex
+	partitions        int
+	visibilityTimeout time.Duration
+	redeliveryDelay   time.Duration
+	topics            map[string]*memoryTopic
+	// changed is closed (and replaced) whenever records become available, to wake up the subscriptions.
+	changed chan struct{}
+	closed  chan struct{}
+	timers  map[*time.Timer]struct{}
+}
+
+type memoryRecord struct {
+	key         string
+	data        []byte
+	publishedAt time.Time
+}
+
+type memoryTopic struct {
+	partitions [][]memoryRecord
+	groups     map[string]*memoryGroup
+	// next is the partition of the next record without a key.
+	next int
+}
+
+type memoryGroup struct {
+	partitions []memoryCursor
+	// start is the partition that is checked first, so all the partitions get their turn.
+	start int
+}
+
+// memoryCursor is the position of a consumer group within a partition.
+// Only the record at offset may be in flight, so the records of a partition are handled in order.
+type memoryCursor struct {
+	offset   int
+	inFlight bool
+	// sending is set while the record is being sent to a subscriber, which may already acknowledge it.
+	sending bool
+	nacked  bool
+	// visibleAt is the time the record in flight is delivered again, unless it is acknowledged.
+	visibleAt time.Time
+	attempt   int
+	// delivery identifies the current delivery, so stale acknowledgements are ignored.
+	delivery int
+}
+
+// NewInMemoryBroker initializes a new InMemoryBroker instance.
+// Of the options, only WithPartitions, WithVisibilityTimeout and WithRedeliveryDelay apply to it.
+func NewInMemoryBroker(opts ...Option) *InMemoryBroker {
+	o := newOptions(opts)
+	return &InMemoryBroker{
+		partitions:        o.partitions,
+		visibilityTimeout: o.visibilityTimeout,
+		redeliveryDelay:   o.redeliveryDelay,
+		topics:            make(map[string]*memoryTopic),
+		changed:           make(chan struct{}),
+		closed:            make(chan struct{}),
+		timers:            make(map[*time.Timer]struct{}),
+	}
+}
+
+// Publish appends the records to the topic. It fails with an Error wrapping ErrClosed once the broker was closed.
+func (b *InMemoryBroker) Publish(ctx context.Context, topic string, records ...Record) error {
+	if topic == "" {
+		return ddd.NewError("topic cannot be empty", ddd.StatusCodeBadRequest)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkClosed(); err != nil {
+		return err
+	}
+	t := b.topic(topic)
+	for _, record := range records {
+		if record.Delay <= 0 {
+			b.append(t, record)
+			continue
+		}
+		record := record
+		var timer *time.Timer
+		timer = time.AfterFunc(record.Delay, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+
+			delete(b.timers, timer)
+			if b.checkClosed() == nil {
+				b.append(t, record)
+				b.broadcast()
+			}
+		})
+		b.timers[timer] = struct{}{}
+	}
+	b.broadcast()
+	return nil
+}
+
+// Subscribe delivers the records of the topic to the consumer group (see Subscriber).
+// It fails with an Error wrapping ErrClosed once the broker was closed, and its channel is closed by Close as well.
+func (b *InMemoryBroker) Subscribe(ctx context.Context, topic string, group string) (<-chan ddd.Message, error) {
+	if err := validate(topic, group); err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.checkClosed(); err != nil {
+		return nil, err
+	}
+	t := b.topic(topic)
+	g, ok := t.groups[group]
+	if ok == false {
+		g = &memoryGroup{partitions: make([]memoryCursor, len(t.partitions))}
+		t.groups[group] = g
+	}
+	messages := make(chan ddd.Message)
+	go b.deliver(ctx, topic, t, g, messages)
+	return messages, nil
+}
+
+// Close ends the subscriptions, and drops the delayed records that are not due yet.
+func (b *InMemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.checkClosed() != nil {
+		return nil
+	}
+	close(b.closed)
+	for timer := range b.timers {
+		timer.Stop()
+	}
+	b.timers = nil
+	return nil
+}
+
+// deliver sends the available records to the subscription, until ctx is done or the broker is closed.
+func (b *InMemoryBroker) deliver(ctx context.Context, topic string, t *memoryTopic, g *memoryGroup, messages chan<- ddd.Message) {
+	defer close(messages)
+	for {
+		b.mu.Lock()
+		message, wait := b.next(topic, t, g, time.Now())
+		changed := b.changed
+		b.mu.Unlock()
+
+		if message != nil {
+			select {
+			case messages <- message:
+				b.sent(g, message, true)
+				continue
+			case <-ctx.Done():
+			case <-b.closed:
+			}
+			b.sent(g, message, false)
+			return
+		}
+
+		if waitChanged(ctx, changed, b.closed, wait) == false {
+			return
+		}
+	}
+}
+
+// next returns the next record that the group should handle, or else the time until a record in flight
+// becomes visible again (0 when there is none).
+func (b *InMemoryBroker) next(topic string, t *memoryTopic, g *memoryGroup, now time.Time) (*memoryMessage, time.Duration) {
+	var wait time.Duration
+	for i := range g.partitions {
+		p := (g.start + i) % len(g.partitions)
+		cursor := &g.partitions[p]
+		if cursor.sending {
+			continue
+		}
+		if cursor.inFlight && now.Before(cursor.visibleAt) {
+			if until := cursor.visibleAt.Sub(now); wait == 0 || until < wait {
+				wait = until
+			}
+			continue
+		}
+		if cursor.inFlight == false && cursor.offset >= len(t.partitions[p]) {
+			continue
+		}
+		cursor.inFlight = true
+		cursor.sending = true
+		cursor.nacked = false
+		cursor.attempt++
+		cursor.delivery++
+		g.start = p + 1
+		record := t.partitions[p][cursor.offset]
+		return &memoryMessage{
+			broker:    b,
+			topic:     topic,
+			group:     g,
+			partition: p,
+			offset:    cursor.offset,
+			delivery:  cursor.delivery,
+			attempt:   cursor.attempt,
+			record:    record,
+		}, 0
+	}
+	return nil, wait
+}
+
+// sent starts the visibility timeout of the message (or its redelivery delay, if it was already nacked),
+// or makes it available again if it could not be sent.
+func (b *InMemoryBroker) sent(g *memoryGroup, message *memoryMessage, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cursor := &g.partitions[message.partition]
+	if cursor.delivery != message.delivery {
+		return
+	}
+	cursor.sending = false
+	switch {
+	case ok && cursor.nacked == false:
+		cursor.visibleAt = time.Now().Add(b.visibilityTimeout)
+		return
+	case ok:
+		cursor.visibleAt = time.Now().Add(redeliveryDelay(b.redeliveryDelay, cursor.attempt, b.visibilityTimeout))
+	default:
+		cursor.attempt--
+		cursor.visibleAt = time.Time{}
+	}
+	b.broadcast()
+}
+
+func (b *InMemoryBroker) ack(message *memoryMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cursor := &message.group.partitions[message.partition]
+	if cursor.inFlight == false || cursor.offset != message.offset || cursor.delivery != message.delivery {
+		// The record was already acknowledged, or delivered again after its visibility timeout.
+		return
+	}
+	// Bumping the delivery lets sent ignore the acknowledged record.
+	*cursor = memoryCursor{offset: cursor.offset + 1, delivery: cursor.delivery + 1}
+	b.broadcast()
+}
+
+func (b *InMemoryBroker) nack(message *memoryMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cursor := &message.group.partitions[message.partition]
+	if cursor.inFlight == false || cursor.offset != message.offset || cursor.delivery != message.delivery {
+		// The record was acknowledged, or delivered again in the meantime.
+		return
+	}
+	if cursor.sending {
+		cursor.nacked = true
+		return
+	}
+	cursor.visibleAt = time.Now().Add(redeliveryDelay(b.redeliveryDelay, cursor.attempt, b.visibilityTimeout))
+	b.broadcast()
+}
+
+func (b *InMemoryBroker) topic(name string) *memoryTopic {
+	t, ok := b.topics[name]
+	if ok == false {
+		t = &memoryTopic{partitions: make([][]memoryRecord, b.partitions), groups: make(map[string]*memoryGroup)}
+		b.topics[name] = t
+	}
+	return t
+}
+
+func (b *InMemoryBroker) append(t *memoryTopic, record Record) {
+	p := t.next
+	if record.Key == "" {
+		t.next = (t.next + 1) % len(t.partitions)
+	} else {
+		p = partition(record.Key, len(t.partitions))
+	}
+	t.partitions[p] = append(t.partitions[p], memoryRecord{key: record.Key, data: record.Data, publishedAt: time.Now()})
+}
+
+func (b *InMemoryBroker) broadcast() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *InMemoryBroker) checkClosed() error {
+	select {
+	case <-b.closed:
+		return ddd.WrapError(ErrClosed, ErrClosed.Error(), ddd.StatusCodeUnavailable)
+	default:
+		return nil
+	}
+}
+
+// memoryMessage is a record delivered to a consumer group.
+type memoryMessage struct {
+	broker    *InMemoryBroker
+	topic     string
+	group     *memoryGroup
+	partition int
+	offset    int
+	delivery  int
+	attempt   int
+	record    memoryRecord
+}
+
+func (m *memoryMessage) ID() string {
+	return fmt.Sprintf("%s-%d-%d", m.topic, m.partition, m.offset)
+}
+
+func (m *memoryMessage) Data() []byte {
+	return m.record.data
+}
+
+func (m *memoryMessage) Topic() string {
+	return m.topic
+}
+
+func (m *memoryMessage) Key() string {
+	return m.record.key
+}
+
+func (m *memoryMessage) Attempt() int {
+	return m.attempt
+}
+
+func (m *memoryMessage) PublishedAt() time.Time {
+	return m.record.publishedAt
+}
+
+// Ack acknowledges the message, so the next record of its partition can be delivered.
+// It is ignored once the message was delivered again, since the later delivery is the one to acknowledge.
+func (m *memoryMessage) Ack(ctx context.Context) error {
+	m.broker.ack(m)
+	return nil
+}
+
+// Nack makes the message available to be delivered again after the redelivery delay (see WithRedeliveryDelay).
+func (m *memoryMessage) Nack(ctx context.Context, err error) error {
+	m.broker.nack(m)
+	return nil
+}
+
+var _ Broker = (*InMemoryBroker)(nil)
+var _ Delivery = (*memoryMessage)(nil)
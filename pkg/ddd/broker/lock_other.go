@@ -0,0 +1,22 @@
+//go:build !unix
+
+package broker
+
+import (
+	"os"
+)
+
+// lockFile does nothing on platforms without advisory locks, where a FileBroker directory
+// should only be used by a single process.
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
+
+// syncDir does nothing on platforms whose directories cannot be synced.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build unix
+
+package broker
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile acquires an exclusive advisory lock of the file, which is shared with the other processes.
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
+
+// syncDir flushes the entries of the directory to stable storage, such as a file that was renamed into it.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %w", dir, err)
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package ddd
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Codec encodes and decodes registered commands and events (as JSON), so they can be stored or sent over the wire,
+// and then decoded back into their concrete types.
+type Codec struct {
+	mu       sync.RWMutex
+	commands map[string]reflect.Type
+	events   map[string]reflect.Type
+}
+
+// NewCodec initializes a new Codec instance.
+func NewCodec() *Codec {
+	return &Codec{commands: make(map[string]reflect.Type), events: make(map[string]reflect.Type)}
+}
+
+// RegisterCommand registers the type of the given command under its CommandName.
+// Commands are expected to be pointers to structs, such as &SaveUserCommand{}.
+func (c *Codec) RegisterCommand(command Command) error {
+	t, err := messageType(command)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.commands[command.CommandName()] = t
+	return nil
+}
+
+// CommandNames returns the names of the registered commands, sorted alphabetically.
+func (c *Codec) CommandNames() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return sortedNames(c.commands)
+}
+
+// HasCommand reports whether a command is registered under the given name.
+func (c *Codec) HasCommand(name string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok := c.commands[name]
+	return ok
+}
+
+// DecodeCommand decodes the JSON data into a new instance of the command registered under the given name.
+// It fails with an Error with StatusCodeBadRequest if the command is not registered, or the data is invalid.
+func (c *Codec) DecodeCommand(name string, data []byte) (Command, error) {
+	c.mu.RLock()
+	t, ok := c.commands[name]
+	c.mu.RUnlock()
+	if ok == false {
+		return nil, NewError(fmt.Sprintf("command %q is not registered in codec", name), StatusCodeBadRequest)
+	}
+	value := reflect.New(t)
+	if err := json.Unmarshal(data, value.Interface()); err != nil {
+		return nil, WrapError(err, fmt.Sprintf("failed to decode command %q: %v", name, err), StatusCodeBadRequest)
+	}
+	return value.Interface().(Command), nil
+}
+
+// RegisterEvent registers the type of the given event under its EventName.
+// Events are expected to be pointers to structs, such as &EmailSetEvent{}.
+func (c *Codec) RegisterEvent(event Event) error {
+	t, err := messageType(event)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.events[event.EventName()] = t
+	return nil
+}
+
+// EventNames returns the names of the registered events, sorted alphabetically.
+func (c *Codec) EventNames() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return sortedNames(c.events)
+}
+
+// EncodeEvent encodes the event as JSON.
+func (c *Codec) EncodeEvent(event Event) ([]byte, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode event %q: %w", event.EventName(), err)
+	}
+	return data, nil
+}
+
+// DecodeEvent decodes the JSON data into a new instance of the event registered under the given name.
+func (c *Codec) DecodeEvent(name string, data []byte) (Event, error) {
+	c.mu.RLock()
+	t, ok := c.events[name]
+	c.mu.RUnlock()
+	if ok == false {
+		return nil, fmt.Errorf("event %q is not registered in codec", name)
+	}
+	value := reflect.New(t)
+	if err := json.Unmarshal(data, value.Interface()); err != nil {
+		return nil, fmt.Errorf("failed to decode event %q: %w", name, err)
+	}
+	return value.Interface().(Event), nil
+}
+
+// Envelope wraps an encoded message with the name of its type, so it can be routed and decoded by its receiver.
+type Envelope struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// NewEnvelope encodes the message as the JSON payload of an Envelope of the given type, and encodes the Envelope.
+func NewEnvelope(messageType string, message any) ([]byte, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %q: %w", messageType, err)
+	}
+	data, err := json.Marshal(Envelope{Type: messageType, Payload: payload})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode envelope of %q: %w", messageType, err)
+	}
+	return data, nil
+}
+
+// ParseEnvelope decodes an Envelope. It fails with an Error with StatusCodeBadRequest if the data is not a valid Envelope.
+func ParseEnvelope(data []byte) (Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return Envelope{}, WrapError(err, fmt.Sprintf("invalid envelope: %v", err), StatusCodeBadRequest)
+	}
+	if envelope.Type == "" {
+		return Envelope{}, NewError("invalid envelope: missing type", StatusCodeBadRequest)
+	}
+	return envelope, nil
+}
+
+// DecodeCommandEnvelope decodes the command wrapped by the Envelope encoded in data (see NewEnvelope).
+func (c *Codec) DecodeCommandEnvelope(data []byte) (Command, error) {
+	envelope, err := ParseEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	return c.DecodeCommand(envelope.Type, envelope.Payload)
+}
+
+// messageType returns the struct type that the given message points to.
+func messageType(message any) (reflect.Type, error) {
+	t := reflect.TypeOf(message)
+	if t == nil || t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("want a pointer to a struct, got %T", message)
+	}
+	return t.Elem(), nil
+}
+
+func sortedNames(types map[string]reflect.Type) []string {
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
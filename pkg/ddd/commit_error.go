@@ -0,0 +1,101 @@
+package ddd
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrCommitOutcomeUnknown can be wrapped by Commit implementations that cannot tell whether the commit was applied,
+// such as when the connection to the database was lost while committing.
+var ErrCommitOutcomeUnknown = errors.New("commit outcome is unknown")
+
+// CommitError is returned when the commit of a unit of work fails.
+// The framework then rolls the unit of work back (on a best-effort basis), and records whether that succeeded.
+type CommitError struct {
+	where       string
+	err         error
+	rollbackErr error
+	partial     bool
+}
+
+// Error returns the error message.
+func (e *CommitError) Error() string {
+	if e.rollbackErr != nil {
+		return fmt.Sprintf("%s commit failed with %q, and rollback failed with %q", e.where, e.err, e.rollbackErr)
+	}
+	return fmt.Sprintf("%s commit failed: %v", e.where, e.err)
+}
+
+// Unwrap returns the error returned by Commit.
+func (e *CommitError) Unwrap() error {
+	return e.err
+}
+
+// RollbackError returns the error of the rollback that followed the failed commit (if any).
+func (e *CommitError) RollbackError() error {
+	return e.rollbackErr
+}
+
+// StateKnown reports whether the changes of the unit of work are known to be discarded.
+// It is false when the rollback failed as well, when Commit returned an error wrapping ErrCommitOutcomeUnknown,
+// or when other resources enlisted in the same UnitOfWork were already committed -
+// in which case the changes may or may not have been applied.
+func (e *CommitError) StateKnown() bool {
+	return e.rollbackErr == nil && e.partial == false && errors.Is(e.err, ErrCommitOutcomeUnknown) == false
+}
+
+// CompensationError is returned when a compensation ran after a failure and failed as well.
+type CompensationError struct {
+	err             error
+	compensationErr error
+	compensator     Compensator
+}
+
+// Error returns the error message.
+func (e *CompensationError) Error() string {
+	return fmt.Sprintf("compensation of %T failed with %q after getting %q", e.compensator, e.compensationErr, e.err)
+}
+
+// Unwrap returns the error that triggered the compensation.
+func (e *CompensationError) Unwrap() error {
+	return e.err
+}
+
+// CompensationErr returns the error returned by Compensate.
+func (e *CompensationError) CompensationErr() error {
+	return e.compensationErr
+}
+
+// RollbackError is returned when rolling back a unit of work after a failure failed as well.
+// Both errors can be inspected with errors.Is and errors.As.
+type RollbackError struct {
+	err         error
+	rollbackErr error
+}
+
+// Error returns the error message.
+func (e *RollbackError) Error() string {
+	return fmt.Sprintf("rollback failed with %q after getting %q", e.rollbackErr, e.err)
+}
+
+// Unwrap returns the error that triggered the rollback.
+func (e *RollbackError) Unwrap() error {
+	return e.err
+}
+
+// RollbackErr returns the error returned by Rollback.
+func (e *RollbackError) RollbackErr() error {
+	return e.rollbackErr
+}
+
+// Is reports whether the error of the rollback matches target.
+// The error that triggered the rollback is matched through Unwrap.
+func (e *RollbackError) Is(target error) bool {
+	return errors.Is(e.rollbackErr, target)
+}
+
+// As finds the first error in the chain of the rollback error that matches target.
+// The error that triggered the rollback is matched through Unwrap.
+func (e *RollbackError) As(target any) bool {
+	return errors.As(e.rollbackErr, target)
+}
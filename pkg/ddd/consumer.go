@@ -0,0 +1,208 @@
+package ddd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrGracePeriodExceeded is wrapped by the error returned from Consumer.Run,
+// when the messages being handled did not finish within the grace period.
+var ErrGracePeriodExceeded = errors.New("grace period exceeded")
+
+// Message is an interface that should be implemented by the messages received from a Subscriber.
+type Message interface {
+	// Data returns the encoded message, which is usually an Envelope (see NewEnvelope).
+	Data() []byte
+	// Ack acknowledges that the message was handled, so it is not delivered again.
+	Ack(ctx context.Context) error
+	// Nack negatively acknowledges the message, which was not handled because of err.
+	// Depending on the source, the message may then be delivered again, preferably after a delay (a backoff),
+	// so that a failing message is not handled over and over.
+	Nack(ctx context.Context, err error) error
+}
+
+// Subscriber is an interface that should be implemented by sources of messages, such as message brokers.
+type Subscriber interface {
+	// Subscribe returns a channel of the received messages, which is closed once the subscription ends.
+	Subscribe(ctx context.Context) (<-chan Message, error)
+}
+
+// ConsumerOption configures a Consumer created by NewConsumer.
+type ConsumerOption func(*Consumer)
+
+// WithConcurrency sets the number of messages that are handled concurrently. The default is 1.
+func WithConcurrency(n int) ConsumerOption {
+	return func(c *Consumer) {
+		if n > 0 {
+			c.concurrency = n
+		}
+	}
+}
+
+// WithGracePeriod sets the time that the messages being handled are given to finish once the context of Run is done,
+// before their context is canceled as well. The default is 0, which cancels them right away.
+func WithGracePeriod(gracePeriod time.Duration) ConsumerOption {
+	return func(c *Consumer) {
+		c.gracePeriod = gracePeriod
+	}
+}
+
+// WithConsumerErrorHandler sets a function that is called with the errors of the messages that were not handled,
+// or could not be acknowledged, such as for logging them.
+func WithConsumerErrorHandler(handler func(ctx context.Context, message Message, err error)) ConsumerOption {
+	return func(c *Consumer) {
+		c.onError = handler
+	}
+}
+
+// Consumer receives messages from a Subscriber, decodes the commands wrapped by their envelopes with a Codec,
+// and handles them with a Bootstrapper.
+// A message is acknowledged when its command was handled and committed,
+// and negatively acknowledged when it could not be decoded or its command failed (see WithQuarantine).
+type Consumer struct {
+	bootstrapper *Bootstrapper
+	subscriber   Subscriber
+	codec        *Codec
+	concurrency  int
+	gracePeriod  time.Duration
+	onError      func(ctx context.Context, message Message, err error)
+	quarantine   Quarantine
+	maxAttempts  int
+	attemptTTL   time.Duration
+	mu           sync.Mutex
+	attempts     map[string]*failedAttempts
+}
+
+// NewConsumer initializes a new Consumer instance.
+func NewConsumer(bootstrapper *Bootstrapper, subscriber Subscriber, codec *Codec, options ...ConsumerOption) *Consumer {
+	c := &Consumer{
+		bootstrapper: bootstrapper,
+		subscriber:   subscriber,
+		codec:        codec,
+		concurrency:  1,
+		attemptTTL:   DefaultAttemptTTL,
+		onError:      func(ctx context.Context, message Message, err error) {},
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Run consumes messages until the subscription ends or ctx is done, and then waits for the messages being handled.
+// Once ctx is done, no new messages are pulled, and the messages being handled are given the grace period
+// (see WithGracePeriod) to finish. The ones that do not finish are canceled through their context,
+// and Run then returns an Error wrapping ErrGracePeriodExceeded.
+func (c *Consumer) Run(ctx context.Context) error {
+	messages, err := c.subscriber.Subscribe(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+	// Messages are handled with a context that outlives ctx by the grace period.
+	handleCtx, cancel := context.WithCancel(detachedContext{parent: ctx})
+	defer cancel()
+
+	var interrupted int32
+	var wg sync.WaitGroup
+	for i := 0; i < c.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case message, ok := <-messages:
+					if ok == false {
+						return
+					}
+					c.Handle(handleCtx, message)
+					if handleCtx.Err() != nil {
+						atomic.StoreInt32(&interrupted, 1)
+					}
+				}
+			}
+		}()
+	}
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+	timer := time.NewTimer(c.gracePeriod)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		return nil
+	case <-timer.C:
+		cancel()
+		<-drained
+		if atomic.LoadInt32(&interrupted) == 0 {
+			return nil
+		}
+		message := fmt.Sprintf("consumer: messages being handled did not finish within the grace period of %v", c.gracePeriod)
+		return WrapError(ErrGracePeriodExceeded, message, StatusCodeTimeout)
+	}
+}
+
+// Handle decodes and handles a single message, and then acknowledges it according to the outcome.
+func (c *Consumer) Handle(ctx context.Context, message Message) {
+	err := c.handle(ctx, message)
+	// Attempts that were interrupted by the consumer being stopped are not counted as failures.
+	interrupted := ctx.Err() != nil
+	// The message is acknowledged even when its handling was canceled.
+	ctx = rollbackContext(ctx)
+	if err == nil {
+		c.ack(ctx, message)
+		return
+	}
+	c.onError(ctx, message, err)
+	if c.quarantine != nil && interrupted == false {
+		if quarantined := c.failed(message, err); quarantined != nil {
+			if putErr := c.quarantine.Put(ctx, *quarantined); putErr != nil {
+				c.onError(ctx, message, fmt.Errorf("failed to quarantine message: %w", putErr))
+			} else {
+				c.ack(ctx, message)
+				return
+			}
+		}
+	}
+	if nackErr := message.Nack(ctx, err); nackErr != nil {
+		c.onError(ctx, message, fmt.Errorf("failed to nack message: %w", nackErr))
+	}
+}
+
+// ack acknowledges the message, and forgets its failed delivery attempts.
+func (c *Consumer) ack(ctx context.Context, message Message) {
+	c.forget(message)
+	if ackErr := message.Ack(ctx); ackErr != nil {
+		c.onError(ctx, message, fmt.Errorf("failed to ack message: %w", ackErr))
+	}
+}
+
+// handle decodes and handles the message, and turns panics into errors like the message bus does
+// (see WithPanicPropagation).
+func (c *Consumer) handle(ctx context.Context, message Message) error {
+	err := recoverPanic("consumer", func() error {
+		command, err := c.codec.DecodeCommandEnvelope(message.Data())
+		if err != nil {
+			return err
+		}
+		_, err = c.bootstrapper.HandleCommand(ctx, command)
+		return err
+	})
+	if c.bootstrapper.propagatePanics {
+		repanic(err)
+	}
+	return err
+}
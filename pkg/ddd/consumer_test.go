@@ -0,0 +1,284 @@
+package ddd_test
+
+import (
+	"context"
+	"errors"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type routedCommand struct {
+	Value string `json:"value"`
+}
+
+func (c *routedCommand) IsValid() error {
+	if c.Value == "" {
+		return ddd.NewError("value cannot be empty", ddd.StatusCodeBadRequest)
+	}
+	return nil
+}
+
+func (c *routedCommand) CommandName() string {
+	return "routedCommand"
+}
+
+type testMessage struct {
+	data   []byte
+	mu     sync.Mutex
+	acked  bool
+	nacked error
+}
+
+func (m *testMessage) Data() []byte {
+	return m.data
+}
+
+func (m *testMessage) Ack(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.acked = true
+	return nil
+}
+
+func (m *testMessage) Nack(ctx context.Context, err error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nacked = err
+	return nil
+}
+
+type testSubscriber struct {
+	messages []*testMessage
+}
+
+func (s *testSubscriber) Subscribe(ctx context.Context) (<-chan ddd.Message, error) {
+	messages := make(chan ddd.Message)
+	go func() {
+		defer close(messages)
+		for _, message := range s.messages {
+			select {
+			case messages <- message:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return messages, nil
+}
+
+func newTestMessage(t *testing.T, messageType string, payload any) *testMessage {
+	t.Helper()
+	data, err := ddd.NewEnvelope(messageType, payload)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	return &testMessage{data: data}
+}
+
+func TestConsumerRoutesAndAcknowledgesMessages(t *testing.T) {
+	codec := ddd.NewCodec()
+	codec.RegisterCommand(&routedCommand{})
+	codec.RegisterCommand(&testCommand{})
+
+	b := ddd.NewBootstrapper()
+	var mu sync.Mutex
+	var values []string
+	b.RegisterCommandHandlerFactoryWithContext(&routedCommand{}, func(ctx context.Context, command ddd.Command) (ddd.CommandHandler, error) {
+		return &testCommandHandler{handle: func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			values = append(values, command.(*routedCommand).Value)
+			return nil
+		}}, nil
+	})
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{commitErr: errors.New("commit failed")}, nil
+	})
+
+	ok := newTestMessage(t, "routedCommand", &routedCommand{Value: "a"})
+	invalid := newTestMessage(t, "routedCommand", &routedCommand{})
+	unknown := newTestMessage(t, "unknownCommand", &routedCommand{Value: "b"})
+	failed := newTestMessage(t, "testCommand", &testCommand{})
+	garbage := &testMessage{data: []byte("not json")}
+	subscriber := &testSubscriber{messages: []*testMessage{ok, invalid, unknown, failed, garbage}}
+
+	var errorCount int32
+	consumer := ddd.NewConsumer(b, subscriber, codec, ddd.WithConcurrency(3), ddd.WithConsumerErrorHandler(func(ctx context.Context, message ddd.Message, err error) {
+		atomic.AddInt32(&errorCount, 1)
+	}))
+	if err := consumer.Run(context.Background()); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+
+	if ok.acked == false || ok.nacked != nil {
+		t.Errorf("want the handled message to be acked")
+	}
+	if len(values) != 1 || values[0] != "a" {
+		t.Errorf("want the command to be routed to its handler, got %v", values)
+	}
+	for _, message := range []*testMessage{invalid, unknown, garbage} {
+		if message.acked {
+			t.Errorf("want message %s not to be acked", message.data)
+		}
+		assertStatusCode(t, message.nacked, ddd.StatusCodeBadRequest)
+	}
+	if failed.acked || failed.nacked == nil {
+		t.Errorf("want the message whose unit of work failed to be nacked")
+	}
+	if errorCount != 4 {
+		t.Errorf("want 4 errors to be reported, got %d", errorCount)
+	}
+}
+
+func TestConsumerCommandWithoutRegisteredHandler(t *testing.T) {
+	codec := ddd.NewCodec()
+	codec.RegisterCommand(&routedCommand{})
+	codec.RegisterCommand(&testCommand{})
+	b := ddd.NewBootstrapper()
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{}, nil
+	})
+	unregistered := newTestMessage(t, "routedCommand", &routedCommand{Value: "a"})
+	next := newTestMessage(t, "testCommand", &testCommand{})
+	subscriber := &testSubscriber{messages: []*testMessage{unregistered, next}}
+
+	if err := ddd.NewConsumer(b, subscriber, codec).Run(context.Background()); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+
+	if unregistered.acked || errors.Is(unregistered.nacked, ddd.ErrCommandNotRegistered) == false {
+		t.Errorf("want the command without a handler to be nacked with ErrCommandNotRegistered, got %v", unregistered.nacked)
+	}
+	assertStatusCode(t, unregistered.nacked, ddd.StatusCodeNotFound)
+	if next.acked == false {
+		t.Errorf("want the consumer to keep handling the following messages")
+	}
+}
+
+func TestConsumerHandlesMessagesConcurrently(t *testing.T) {
+	codec := ddd.NewCodec()
+	codec.RegisterCommand(&routedCommand{})
+	b := ddd.NewBootstrapper()
+	var running, maxRunning int32
+	b.RegisterCommandHandlerFactory(&routedCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{handle: func(ctx context.Context) error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				current := atomic.LoadInt32(&maxRunning)
+				if n <= current || atomic.CompareAndSwapInt32(&maxRunning, current, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		}}, nil
+	})
+	subscriber := &testSubscriber{}
+	for i := 0; i < 8; i++ {
+		subscriber.messages = append(subscriber.messages, newTestMessage(t, "routedCommand", &routedCommand{Value: "a"}))
+	}
+
+	ddd.NewConsumer(b, subscriber, codec, ddd.WithConcurrency(4)).Run(context.Background())
+
+	if maxRunning < 2 || maxRunning > 4 {
+		t.Errorf("want up to 4 messages to be handled concurrently, got %d", maxRunning)
+	}
+	for _, message := range subscriber.messages {
+		if message.acked == false {
+			t.Errorf("want all the messages to be acked")
+		}
+	}
+}
+
+// blockingSubscriber delivers its messages, and keeps the subscription open until ctx is done.
+type blockingSubscriber struct {
+	messages []*testMessage
+}
+
+func (s *blockingSubscriber) Subscribe(ctx context.Context) (<-chan ddd.Message, error) {
+	messages := make(chan ddd.Message)
+	go func() {
+		defer close(messages)
+		for _, message := range s.messages {
+			select {
+			case messages <- message:
+			case <-ctx.Done():
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+	return messages, nil
+}
+
+func TestConsumerGracePeriod(t *testing.T) {
+	tests := []struct {
+		name        string
+		gracePeriod time.Duration
+		wantAcked   bool
+	}{
+		{name: "in-flight message finishes within the grace period", gracePeriod: time.Second, wantAcked: true},
+		{name: "in-flight message is canceled after the grace period", gracePeriod: 10 * time.Millisecond, wantAcked: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			codec := ddd.NewCodec()
+			codec.RegisterCommand(&routedCommand{})
+			b := ddd.NewBootstrapper()
+			started := make(chan struct{})
+			b.RegisterCommandHandlerFactory(&routedCommand{}, func() (ddd.CommandHandler, error) {
+				return &testCommandHandler{handle: func(ctx context.Context) error {
+					close(started)
+					select {
+					case <-time.After(100 * time.Millisecond):
+						return nil
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}}, nil
+			})
+			message := newTestMessage(t, "routedCommand", &routedCommand{Value: "a"})
+			subscriber := &blockingSubscriber{messages: []*testMessage{message}}
+			consumer := ddd.NewConsumer(b, subscriber, codec, ddd.WithGracePeriod(tc.gracePeriod))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() {
+				done <- consumer.Run(ctx)
+			}()
+			<-started
+			cancel()
+			err := <-done
+
+			if tc.wantAcked {
+				if err != nil {
+					t.Errorf("want no error, got %v", err)
+				}
+				if message.acked == false {
+					t.Errorf("want the in-flight message to be acked")
+				}
+				return
+			}
+			if errors.Is(err, ddd.ErrGracePeriodExceeded) == false {
+				t.Errorf("want ErrGracePeriodExceeded, got %v", err)
+			}
+			if message.acked || errors.Is(message.nacked, context.Canceled) == false {
+				t.Errorf("want the canceled message to be nacked, got %v", message.nacked)
+			}
+		})
+	}
+}
+
+func TestConsumerStopsWithoutInFlightMessages(t *testing.T) {
+	codec := ddd.NewCodec()
+	consumer := ddd.NewConsumer(ddd.NewBootstrapper(), &blockingSubscriber{}, codec)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := consumer.Run(ctx); err != nil {
+		t.Errorf("want no error, got %v", err)
+	}
+}
@@ -0,0 +1,258 @@
+package ddd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Lifetime defines how long a dependency registered with Provide lives.
+type Lifetime int
+
+const (
+	// Singleton dependencies are created once, and shared by all the scopes.
+	Singleton Lifetime = iota
+	// Scoped dependencies are created once per Scope, so all the handlers run by one HandleCommand call
+	// share them (such as a DB transaction), while different calls stay isolated.
+	// The ones that implement io.Closer are closed with the Scope (see Scope.Close).
+	Scoped
+	// Transient dependencies are created every time they are resolved.
+	Transient
+)
+
+func (l Lifetime) String() string {
+	switch l {
+	case Singleton:
+		return "singleton"
+	case Scoped:
+		return "scoped"
+	case Transient:
+		return "transient"
+	}
+	return fmt.Sprintf("Lifetime(%d)", int(l))
+}
+
+// ErrDuplicateProvider is returned when a dependency of the same type was already provided.
+var ErrDuplicateProvider = errors.New("dependency is already provided")
+
+// ErrDependencyNotProvided is returned when resolving a dependency that was not provided.
+var ErrDependencyNotProvided = errors.New("dependency is not provided")
+
+// ErrDependencyCycle is returned when resolving a dependency that depends on itself.
+var ErrDependencyCycle = errors.New("dependency cycle")
+
+// ErrScopedDependency is returned when a singleton depends on a scoped dependency,
+// which would otherwise be shared by all the scopes.
+var ErrScopedDependency = errors.New("scoped dependency cannot be resolved by a singleton")
+
+// Scope resolves the dependencies registered with Provide (see Resolve).
+// HandleCommand creates a new Scope for every call, which is passed to the scoped factories of its handlers,
+// and can be found in their context with ScopeFromContext. It is safe for concurrent use.
+type Scope struct {
+	state *scopeState
+	// path holds the types that are being resolved, in order to detect dependency cycles.
+	path []reflect.Type
+}
+
+type scopeState struct {
+	container *container
+	root      bool
+	mu        sync.Mutex
+	instances map[reflect.Type]*instance
+	// created holds the scoped dependencies in the order they were created, so they are closed in reverse order.
+	created []any
+}
+
+// instance holds a dependency created by a singleton or scoped provider.
+type instance struct {
+	mu    sync.Mutex
+	built bool
+	value any
+}
+
+type provider struct {
+	lifetime Lifetime
+	factory  func(scope *Scope) (any, error)
+	// singleton is shared by all the scopes.
+	singleton instance
+}
+
+type container struct {
+	mu        sync.RWMutex
+	sealed    bool
+	providers map[reflect.Type]*provider
+	root      *Scope
+}
+
+func newContainer() *container {
+	c := &container{providers: make(map[reflect.Type]*provider)}
+	c.root = c.newScope(true)
+	return c
+}
+
+func (c *container) newScope(root bool) *Scope {
+	return &Scope{state: &scopeState{container: c, root: root, instances: make(map[reflect.Type]*instance)}}
+}
+
+func (c *container) Seal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sealed = true
+}
+
+// Provide registers the factory of the dependencies of type T (which is usually an interface or a pointer),
+// so they can be resolved with Resolve, according to the given lifetime.
+// Singleton factories receive a scope that cannot resolve scoped dependencies.
+// It fails with ErrDuplicateProvider if T is already provided, and with ErrRegistrySealed once Seal was called.
+func Provide[T any](b *Bootstrapper, lifetime Lifetime, factory func(scope *Scope) (T, error)) error {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	c := b.container
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sealed {
+		return fmt.Errorf("failed to provide %v: %w", t, ErrRegistrySealed)
+	}
+	if _, ok := c.providers[t]; ok {
+		return fmt.Errorf("failed to provide %v: %w", t, ErrDuplicateProvider)
+	}
+	c.providers[t] = &provider{lifetime: lifetime, factory: func(scope *Scope) (any, error) {
+		return factory(scope)
+	}}
+	return nil
+}
+
+// Resolve returns the dependency of type T, which was registered with Provide.
+func Resolve[T any](scope *Scope) (T, error) {
+	var zero T
+	value, err := scope.resolve(reflect.TypeOf((*T)(nil)).Elem())
+	if err != nil {
+		return zero, err
+	}
+	if value == nil {
+		return zero, nil
+	}
+	return value.(T), nil
+}
+
+// NewScope creates a new Scope, for resolving dependencies outside of HandleCommand, such as in entrypoints.
+func (b *Bootstrapper) NewScope() *Scope {
+	return b.container.newScope(false)
+}
+
+func (s *Scope) resolve(t reflect.Type) (any, error) {
+	for _, resolving := range s.path {
+		if resolving == t {
+			return nil, fmt.Errorf("failed to resolve %v: %w: %s", t, ErrDependencyCycle, s.describePath(t))
+		}
+	}
+	c := s.state.container
+	c.mu.RLock()
+	p, ok := c.providers[t]
+	c.mu.RUnlock()
+	if ok == false {
+		return nil, fmt.Errorf("failed to resolve %v: %w", t, ErrDependencyNotProvided)
+	}
+
+	switch p.lifetime {
+	case Singleton:
+		return p.singleton.get(func() (any, error) {
+			return p.factory(c.root.child(s.path, t))
+		})
+	case Scoped:
+		if s.state.root {
+			return nil, fmt.Errorf("failed to resolve %v: %w", t, ErrScopedDependency)
+		}
+		s.state.mu.Lock()
+		scoped, ok := s.state.instances[t]
+		if ok == false {
+			scoped = &instance{}
+			s.state.instances[t] = scoped
+		}
+		s.state.mu.Unlock()
+		return scoped.get(func() (any, error) {
+			value, err := p.factory(s.child(s.path, t))
+			if err == nil {
+				s.state.mu.Lock()
+				s.state.created = append(s.state.created, value)
+				s.state.mu.Unlock()
+			}
+			return value, err
+		})
+	}
+	return p.factory(s.child(s.path, t))
+}
+
+// Close closes the scoped dependencies created by the Scope that implement io.Closer,
+// in the reverse order they were created, so dependencies are closed after the ones that depend on them.
+// It returns the first error, and closing again has no effect.
+// HandleCommand and HandleEvent close their Scope once they return.
+func (s *Scope) Close() error {
+	s.state.mu.Lock()
+	created := s.state.created
+	s.state.created = nil
+	s.state.mu.Unlock()
+
+	var err error
+	for i := len(created) - 1; i >= 0; i-- {
+		closer, ok := created[i].(io.Closer)
+		if ok == false {
+			continue
+		}
+		closeErr := recoverPanic(fmt.Sprintf("closing %T", closer), closer.Close)
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// child returns a Scope that shares the state of s, and that is resolving t.
+func (s *Scope) child(path []reflect.Type, t reflect.Type) *Scope {
+	childPath := make([]reflect.Type, len(path), len(path)+1)
+	copy(childPath, path)
+	return &Scope{state: s.state, path: append(childPath, t)}
+}
+
+func (s *Scope) describePath(t reflect.Type) string {
+	names := make([]string, 0, len(s.path)+1)
+	for _, resolving := range s.path {
+		names = append(names, resolving.String())
+	}
+	return strings.Join(append(names, t.String()), " -> ")
+}
+
+// get returns the instance, and creates it on first use. A failed creation is retried by the next call.
+func (i *instance) get(create func() (any, error)) (any, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.built {
+		return i.value, nil
+	}
+	value, err := create()
+	if err != nil {
+		return nil, err
+	}
+	i.value = value
+	i.built = true
+	return value, nil
+}
+
+type scopeKey struct{}
+
+// ScopeFromContext returns the Scope of the HandleCommand call that ctx belongs to,
+// or nil when ctx does not belong to one.
+func ScopeFromContext(ctx context.Context) *Scope {
+	scope, _ := ctx.Value(scopeKey{}).(*Scope)
+	return scope
+}
+
+func withScope(ctx context.Context, scope *Scope) context.Context {
+	return context.WithValue(ctx, scopeKey{}, scope)
+}
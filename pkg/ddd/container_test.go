@@ -0,0 +1,270 @@
+package ddd_test
+
+import (
+	"context"
+	"errors"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type testDependency struct {
+	id int
+}
+
+type testTransaction struct {
+	id int
+}
+
+type testCounter struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *testCounter) next() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.n++
+	return c.n
+}
+
+func mustResolve[T any](t *testing.T, scope *ddd.Scope) T {
+	t.Helper()
+	value, err := ddd.Resolve[T](scope)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	return value
+}
+
+func TestLifetimes(t *testing.T) {
+	tests := []struct {
+		name            string
+		lifetime        ddd.Lifetime
+		sameWithinScope bool
+		sameAcrossScope bool
+	}{
+		{name: "singleton", lifetime: ddd.Singleton, sameWithinScope: true, sameAcrossScope: true},
+		{name: "scoped", lifetime: ddd.Scoped, sameWithinScope: true, sameAcrossScope: false},
+		{name: "transient", lifetime: ddd.Transient, sameWithinScope: false, sameAcrossScope: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := ddd.NewBootstrapper()
+			counter := &testCounter{}
+			ddd.Provide(b, tc.lifetime, func(scope *ddd.Scope) (*testDependency, error) {
+				return &testDependency{id: counter.next()}, nil
+			})
+			scope := b.NewScope()
+			first := mustResolve[*testDependency](t, scope)
+			second := mustResolve[*testDependency](t, scope)
+			other := mustResolve[*testDependency](t, b.NewScope())
+
+			if got := first == second; got != tc.sameWithinScope {
+				t.Errorf("want same instance within scope %v, got %v", tc.sameWithinScope, got)
+			}
+			if got := first == other; got != tc.sameAcrossScope {
+				t.Errorf("want same instance across scopes %v, got %v", tc.sameAcrossScope, got)
+			}
+		})
+	}
+}
+
+func TestScopedDependencyIsSharedByTheHandlersOfOneCommand(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	counter := &testCounter{}
+	ddd.Provide(b, ddd.Scoped, func(scope *ddd.Scope) (*testTransaction, error) {
+		return &testTransaction{id: counter.next()}, nil
+	})
+	var mu sync.Mutex
+	var seen []int
+	record := func(tx *testTransaction) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, tx.id)
+	}
+	b.RegisterScopedCommandHandlerFactory(&testCommand{}, func(scope *ddd.Scope) (ddd.CommandHandler, error) {
+		tx, err := ddd.Resolve[*testTransaction](scope)
+		if err != nil {
+			return nil, err
+		}
+		record(tx)
+		return &testCommandHandler{events: []ddd.Event{&testEvent{name: "a"}}}, nil
+	})
+	b.RegisterScopedEventHandlerFactory(&testEvent{name: "a"}, func(scope *ddd.Scope) (ddd.EventHandler, error) {
+		return &testEventHandler{handle: func(ctx context.Context) error {
+			record(mustResolve[*testTransaction](t, ddd.ScopeFromContext(ctx)))
+			return nil
+		}}, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := b.HandleCommand(context.Background(), &testCommand{}); err != nil {
+			t.Fatalf("want no error, got %v", err)
+		}
+	}
+	want := []int{1, 1, 2, 2}
+	if len(seen) != len(want) {
+		t.Fatalf("want %v, got %v", want, seen)
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Fatalf("want %v, got %v", want, seen)
+		}
+	}
+}
+
+// testCloser records when it is closed.
+type testCloser struct {
+	name string
+	log  *[]string
+}
+
+func (c *testCloser) Close() error {
+	*c.log = append(*c.log, "close "+c.name)
+	return nil
+}
+
+type testConnection struct {
+	testCloser
+}
+
+type testPool struct {
+	testCloser
+}
+
+func TestScopedDependenciesAreClosed(t *testing.T) {
+	var log []string
+	b := ddd.NewBootstrapper()
+	ddd.Provide(b, ddd.Singleton, func(scope *ddd.Scope) (*testPool, error) {
+		return &testPool{testCloser{name: "pool", log: &log}}, nil
+	})
+	ddd.Provide(b, ddd.Scoped, func(scope *ddd.Scope) (*testConnection, error) {
+		if _, err := ddd.Resolve[*testPool](scope); err != nil {
+			return nil, err
+		}
+		return &testConnection{testCloser{name: "connection", log: &log}}, nil
+	})
+	ddd.Provide(b, ddd.Scoped, func(scope *ddd.Scope) (*testCloser, error) {
+		if _, err := ddd.Resolve[*testConnection](scope); err != nil {
+			return nil, err
+		}
+		return &testCloser{name: "transaction", log: &log}, nil
+	})
+	b.RegisterScopedCommandHandlerFactory(&testCommand{}, func(scope *ddd.Scope) (ddd.CommandHandler, error) {
+		if _, err := ddd.Resolve[*testCloser](scope); err != nil {
+			return nil, err
+		}
+		return &testCommandHandler{handle: func(ctx context.Context) error {
+			log = append(log, "handle")
+			return nil
+		}}, nil
+	})
+
+	if _, err := b.HandleCommand(context.Background(), &testCommand{}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+
+	want := "handle,close transaction,close connection"
+	if got := strings.Join(log, ","); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestProvideErrors(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	factory := func(scope *ddd.Scope) (*testDependency, error) {
+		return &testDependency{}, nil
+	}
+	if err := ddd.Provide(b, ddd.Singleton, factory); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if err := ddd.Provide(b, ddd.Transient, factory); errors.Is(err, ddd.ErrDuplicateProvider) == false {
+		t.Errorf("want ErrDuplicateProvider, got %v", err)
+	}
+	b.Seal()
+	err := ddd.Provide(b, ddd.Singleton, func(scope *ddd.Scope) (*testTransaction, error) {
+		return &testTransaction{}, nil
+	})
+	if errors.Is(err, ddd.ErrRegistrySealed) == false {
+		t.Errorf("want ErrRegistrySealed, got %v", err)
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	t.Run("not provided", func(t *testing.T) {
+		b := ddd.NewBootstrapper()
+		if _, err := ddd.Resolve[*testDependency](b.NewScope()); errors.Is(err, ddd.ErrDependencyNotProvided) == false {
+			t.Errorf("want ErrDependencyNotProvided, got %v", err)
+		}
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		b := ddd.NewBootstrapper()
+		ddd.Provide(b, ddd.Singleton, func(scope *ddd.Scope) (*testDependency, error) {
+			_, err := ddd.Resolve[*testTransaction](scope)
+			return &testDependency{}, err
+		})
+		ddd.Provide(b, ddd.Transient, func(scope *ddd.Scope) (*testTransaction, error) {
+			_, err := ddd.Resolve[*testDependency](scope)
+			return &testTransaction{}, err
+		})
+		if _, err := ddd.Resolve[*testDependency](b.NewScope()); errors.Is(err, ddd.ErrDependencyCycle) == false {
+			t.Errorf("want ErrDependencyCycle, got %v", err)
+		}
+	})
+
+	t.Run("singleton depending on a scoped dependency", func(t *testing.T) {
+		b := ddd.NewBootstrapper()
+		ddd.Provide(b, ddd.Singleton, func(scope *ddd.Scope) (*testDependency, error) {
+			_, err := ddd.Resolve[*testTransaction](scope)
+			return &testDependency{}, err
+		})
+		ddd.Provide(b, ddd.Scoped, func(scope *ddd.Scope) (*testTransaction, error) {
+			return &testTransaction{}, nil
+		})
+		if _, err := ddd.Resolve[*testDependency](b.NewScope()); errors.Is(err, ddd.ErrScopedDependency) == false {
+			t.Errorf("want ErrScopedDependency, got %v", err)
+		}
+	})
+
+	t.Run("failed creation is retried", func(t *testing.T) {
+		b := ddd.NewBootstrapper()
+		fail := true
+		ddd.Provide(b, ddd.Singleton, func(scope *ddd.Scope) (*testDependency, error) {
+			if fail {
+				return nil, errors.New("not yet")
+			}
+			return &testDependency{}, nil
+		})
+		if _, err := ddd.Resolve[*testDependency](b.NewScope()); err == nil {
+			t.Fatalf("want an error")
+		}
+		fail = false
+		if dependency := mustResolve[*testDependency](t, b.NewScope()); dependency == nil {
+			t.Errorf("want a dependency")
+		}
+	})
+}
+
+func TestConcurrentSingletonResolution(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	counter := &testCounter{}
+	ddd.Provide(b, ddd.Singleton, func(scope *ddd.Scope) (*testDependency, error) {
+		return &testDependency{id: counter.next()}, nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ddd.Resolve[*testDependency](b.NewScope())
+		}()
+	}
+	wg.Wait()
+	if counter.n != 1 {
+		t.Errorf("want a single instance, got %d", counter.n)
+	}
+}
@@ -0,0 +1,54 @@
+package ddd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// newContextError describes where a canceled or timed out context interrupted the message bus.
+// The returned Error wraps the context error, so errors.Is(err, context.Canceled) keeps working.
+func newContextError(ctx context.Context, parent context.Context, where string, timeout time.Duration) error {
+	err := ctx.Err()
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		if timeout > 0 && parent.Err() == nil {
+			return WrapError(err, fmt.Sprintf("%s: handler timed out after %v", where, timeout), StatusCodeTimeout)
+		}
+		return WrapError(err, fmt.Sprintf("%s: %v", where, err), StatusCodeTimeout)
+	}
+	return WrapError(err, fmt.Sprintf("%s: %v", where, err), StatusCodeCanceled)
+}
+
+// detachedContext keeps the values of its parent, but is never canceled.
+// It is used to roll back a unit of work after its context was canceled.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (deadline time.Time, ok bool) {
+	return time.Time{}, false
+}
+
+func (c detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (c detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key any) any {
+	return c.parent.Value(key)
+}
+
+// rollbackContext returns a context that can still be used to roll back when ctx is done.
+func rollbackContext(ctx context.Context) context.Context {
+	if ctx.Err() == nil {
+		return ctx
+	}
+	return detachedContext{parent: ctx}
+}
@@ -1,15 +1,29 @@
 package ddd
 
+import "fmt"
+
 // StatusCodeNotFound is a string that represents a "not found" error.
 const StatusCodeNotFound = "not_found"
 
 // StatusCodeBadRequest is a string that represents a "not found" error.
 const StatusCodeBadRequest = "bad_request"
 
+// StatusCodeCanceled is a string that represents an error caused by a canceled context.
+const StatusCodeCanceled = "canceled"
+
+// StatusCodeTimeout is a string that represents an error caused by an exceeded context deadline.
+const StatusCodeTimeout = "timeout"
+
+// StatusCodeInternal is a string that represents an unexpected error, such as a recovered panic.
+const StatusCodeInternal = "internal"
+
 // Error is a struct that contains both a message and a status code.
 type Error struct {
 	message    string
 	statusCode string
+	cause      error
+	stackTrace string
+	panicValue any
 }
 
 // Error returns the error message.
@@ -22,7 +36,32 @@ func (e *Error) StatusCode() string {
 	return e.statusCode
 }
 
+// Unwrap returns the underlying error (if any), so that Error can be inspected with errors.Is and errors.As.
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// StackTrace returns the stack trace captured when the error was created from a recovered panic.
+// It is empty for all other errors.
+func (e *Error) StackTrace() string {
+	return e.stackTrace
+}
+
 // NewError initializes a new Error instance.
 func NewError(message string, statusCode string) *Error {
 	return &Error{message: message, statusCode: statusCode}
 }
+
+// WrapError initializes a new Error instance that wraps the given cause.
+func WrapError(cause error, message string, statusCode string) *Error {
+	return &Error{message: message, statusCode: statusCode, cause: cause}
+}
+
+func newPanicError(where string, value any, stackTrace []byte) *Error {
+	return &Error{
+		message:    fmt.Sprintf("%s panicked: %v", where, value),
+		statusCode: StatusCodeInternal,
+		stackTrace: string(stackTrace),
+		panicValue: value,
+	}
+}
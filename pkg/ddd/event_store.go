@@ -0,0 +1,281 @@
+package ddd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// StatusCodeConflict is a string that represents a conflict with the current state, such as a concurrent update.
+const StatusCodeConflict = "conflict"
+
+// ExpectAnyVersion can be passed to EventStore.Append to skip the optimistic concurrency check.
+const ExpectAnyVersion int64 = -1
+
+// ErrVersionConflict is wrapped by the error returned from EventStore.Append,
+// when the version of the stream differs from the expected version.
+var ErrVersionConflict = errors.New("stream version conflict")
+
+// RecordedEvent is an event that was appended to an EventStore.
+type RecordedEvent struct {
+	StreamID string
+	// Version is the position of the event within its stream, starting at 1.
+	Version int64
+	// Position is the position of the event within the whole store, starting at 1.
+	Position   int64
+	RecordedAt time.Time
+	Event      Event
+}
+
+// EventStore is an interface that should be implemented by append-only event stores.
+type EventStore interface {
+	// Append appends the events to the stream, provided that the version of the stream equals expectedVersion
+	// (0 for a new stream, or ExpectAnyVersion), and returns the new version of the stream.
+	// The events are appended atomically: either all of them are appended, or none.
+	Append(ctx context.Context, streamID string, expectedVersion int64, events ...Event) (int64, error)
+	// Load returns the events of the stream, starting at fromVersion.
+	Load(ctx context.Context, streamID string, fromVersion int64) ([]RecordedEvent, error)
+	// LoadAll returns the events of all the streams in the order they were appended, starting at fromPosition.
+	LoadAll(ctx context.Context, fromPosition int64) ([]RecordedEvent, error)
+	// Version returns the current version of the stream (0 for a new stream), without loading its events.
+	Version(ctx context.Context, streamID string) (int64, error)
+}
+
+// InMemoryEventStore is an EventStore that keeps the events in memory. It is safe for concurrent use.
+type InMemoryEventStore struct {
+	mu      sync.RWMutex
+	now     func() time.Time
+	events  []RecordedEvent
+	streams map[string][]int
+}
+
+// NewInMemoryEventStore initializes a new InMemoryEventStore instance.
+func NewInMemoryEventStore() *InMemoryEventStore {
+	return &InMemoryEventStore{now: time.Now, streams: make(map[string][]int)}
+}
+
+// Append appends the events to the stream.
+func (s *InMemoryEventStore) Append(ctx context.Context, streamID string, expectedVersion int64, events ...Event) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	version := int64(len(s.streams[streamID]))
+	if err := checkVersion(streamID, expectedVersion, version); err != nil {
+		return version, err
+	}
+	recordedAt := s.now().UTC()
+	for _, event := range events {
+		version++
+		s.events = append(s.events, RecordedEvent{
+			StreamID:   streamID,
+			Version:    version,
+			Position:   int64(len(s.events)) + 1,
+			RecordedAt: recordedAt,
+			Event:      event,
+		})
+		s.streams[streamID] = append(s.streams[streamID], len(s.events)-1)
+	}
+	return version, nil
+}
+
+// Load returns the events of the stream, starting at fromVersion.
+func (s *InMemoryEventStore) Load(ctx context.Context, streamID string, fromVersion int64) ([]RecordedEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	indexes := s.streams[streamID]
+	events := make([]RecordedEvent, 0)
+	for i := firstIndex(fromVersion); i < len(indexes); i++ {
+		events = append(events, s.events[indexes[i]])
+	}
+	return events, nil
+}
+
+// LoadAll returns the events of all the streams, starting at fromPosition.
+func (s *InMemoryEventStore) LoadAll(ctx context.Context, fromPosition int64) ([]RecordedEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	events := make([]RecordedEvent, 0)
+	for i := firstIndex(fromPosition); i < len(s.events); i++ {
+		events = append(events, s.events[i])
+	}
+	return events, nil
+}
+
+// Version returns the current version of the stream.
+func (s *InMemoryEventStore) Version(ctx context.Context, streamID string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return int64(len(s.streams[streamID])), nil
+}
+
+// checkVersion implements the optimistic concurrency check of EventStore.Append.
+func checkVersion(streamID string, expectedVersion int64, version int64) error {
+	if expectedVersion == ExpectAnyVersion || expectedVersion == version {
+		return nil
+	}
+	message := fmt.Sprintf("stream %q is at version %d, expected version %d", streamID, version, expectedVersion)
+	return WrapError(ErrVersionConflict, message, StatusCodeConflict)
+}
+
+// firstIndex converts a 1-based version or position into a slice index.
+func firstIndex(from int64) int {
+	if from <= 1 {
+		return 0
+	}
+	return int(from - 1)
+}
+
+// VersionedEvent is implemented by the events that know the version of their stream at the time their
+// aggregate was loaded, which the event recorder expects the stream to still be at when it appends them.
+type VersionedEvent interface {
+	Event
+	StreamVersion() int64
+}
+
+// NewEventRecorder returns a factory of event handlers that append the events they handle to the store
+// once they are committed. The stream function returns the ID of the stream each event belongs to.
+// It can be registered with Bootstrapper.RegisterEventHandlerFactory for every event that should be recorded.
+//
+// The recorders of the store that join the same unit of work (see JoinUnitOfWork) append their events together:
+// the events of each stream with a single EventStore.Append, which expects the version of the first VersionedEvent
+// of the stream, or else the version the stream was at when its first event was handled.
+// So a concurrent append to the stream fails the commit with an Error wrapping ErrVersionConflict.
+func NewEventRecorder(store EventStore, stream func(event Event) string) CreateEventHandler {
+	return func() (EventHandler, error) {
+		return &eventRecorder{store: store, stream: stream}, nil
+	}
+}
+
+type eventRecorder struct {
+	store  EventStore
+	stream func(event Event) string
+	// batch is the recorder that appends the events of the unit of work: the first recorder of the store
+	// that was enlisted in it, which may be the recorder itself.
+	batch *eventRecorder
+	// handled are the events handled by the recorder, which are dropped from the batch when it is rolled back.
+	handled []Event
+	// streams are the events to append, in the order their streams were first handled.
+	streams []*recordedStream
+}
+
+// recordedStream holds the events to append to a stream.
+type recordedStream struct {
+	id              string
+	expectedVersion int64
+	versioned       bool
+	events          []Event
+}
+
+func (r *eventRecorder) Handle(ctx context.Context, event Event) error {
+	if r.batch == nil {
+		r.batch = r.findBatch(ctx)
+	}
+	if err := r.batch.add(ctx, r.stream(event), event); err != nil {
+		return err
+	}
+	r.handled = append(r.handled, event)
+	return nil
+}
+
+// findBatch returns the recorder of the same store that appends the events of the unit of work in ctx.
+func (r *eventRecorder) findBatch(ctx context.Context) *eventRecorder {
+	uow, ok := UnitOfWorkFromContext(ctx)
+	if ok == false || reflect.TypeOf(r.store).Comparable() == false {
+		return r
+	}
+	for _, rc := range uow.enlisted() {
+		if other, ok := rc.(*eventRecorder); ok && other.batch == other && other.store == r.store {
+			return other
+		}
+	}
+	return r
+}
+
+// add adds the event to its stream, whose expected version is determined by its first event.
+func (r *eventRecorder) add(ctx context.Context, id string, event Event) error {
+	versioned, isVersioned := event.(VersionedEvent)
+	for _, s := range r.streams {
+		if s.id != id {
+			continue
+		}
+		if isVersioned && s.versioned == false {
+			s.expectedVersion, s.versioned = versioned.StreamVersion(), true
+		}
+		s.events = append(s.events, event)
+		return nil
+	}
+	s := &recordedStream{id: id, events: []Event{event}}
+	if isVersioned {
+		s.expectedVersion, s.versioned = versioned.StreamVersion(), true
+	} else {
+		version, err := r.store.Version(ctx, id)
+		if err != nil {
+			return err
+		}
+		s.expectedVersion = version
+	}
+	r.streams = append(r.streams, s)
+	return nil
+}
+
+// drop removes the events from their streams.
+func (r *eventRecorder) drop(events []Event) {
+	for _, s := range r.streams {
+		kept := s.events[:0]
+		for _, event := range s.events {
+			if containsEvent(events, event) == false {
+				kept = append(kept, event)
+			}
+		}
+		s.events = kept
+	}
+}
+
+func (r *eventRecorder) Events() []Event {
+	return nil
+}
+
+func (r *eventRecorder) Commit(ctx context.Context) error {
+	for _, s := range r.streams {
+		if len(s.events) == 0 {
+			continue
+		}
+		if _, err := r.store.Append(ctx, s.id, s.expectedVersion, s.events...); err != nil {
+			return err
+		}
+	}
+	r.streams = nil
+	return nil
+}
+
+func (r *eventRecorder) Rollback(ctx context.Context) error {
+	if r.batch != nil && r.batch != r {
+		r.batch.drop(r.handled)
+	}
+	r.batch = nil
+	r.handled = nil
+	r.streams = nil
+	return nil
+}
+
+// containsEvent reports whether events contains the very same event.
+func containsEvent(events []Event, event Event) bool {
+	if reflect.TypeOf(event).Comparable() == false {
+		return false
+	}
+	for _, e := range events {
+		if reflect.TypeOf(e) == reflect.TypeOf(event) && e == event {
+			return true
+		}
+	}
+	return false
+}
+
+var _ EventStore = (*InMemoryEventStore)(nil)
+var _ EventHandler = (*eventRecorder)(nil)
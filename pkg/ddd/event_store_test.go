@@ -0,0 +1,457 @@
+package ddd_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+type storedEvent struct {
+	Name  string `json:"name"`
+	Value int    `json:"value"`
+}
+
+func (e *storedEvent) EventName() string {
+	return "StoredEvent"
+}
+
+func newTestCodec(t *testing.T) *ddd.Codec {
+	t.Helper()
+	codec := ddd.NewCodec()
+	if err := codec.RegisterEvent(&storedEvent{}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	return codec
+}
+
+func assertEvents(t *testing.T, events []ddd.RecordedEvent, streamID string, values ...int) {
+	t.Helper()
+	if len(events) != len(values) {
+		t.Fatalf("want %d events, got %d", len(values), len(events))
+	}
+	for i, value := range values {
+		event, ok := events[i].Event.(*storedEvent)
+		if ok == false {
+			t.Fatalf("want *storedEvent, got %T", events[i].Event)
+		}
+		if event.Value != value {
+			t.Errorf("want event %d to have value %d, got %d", i, value, event.Value)
+		}
+		if streamID != "" && events[i].StreamID != streamID {
+			t.Errorf("want event %d in stream %q, got %q", i, streamID, events[i].StreamID)
+		}
+	}
+}
+
+// testEventStoreConformance verifies the behavior that all the EventStore implementations share.
+func testEventStoreConformance(t *testing.T, newStore func(t *testing.T) ddd.EventStore) {
+	ctx := context.Background()
+
+	t.Run("append and load", func(t *testing.T) {
+		store := newStore(t)
+		version, err := store.Append(ctx, "a", 0, &storedEvent{Value: 1}, &storedEvent{Value: 2})
+		if err != nil {
+			t.Fatalf("want no error, got %v", err)
+		}
+		if version != 2 {
+			t.Errorf("want version 2, got %d", version)
+		}
+		if version, err = store.Append(ctx, "a", 2, &storedEvent{Value: 3}); err != nil || version != 3 {
+			t.Fatalf("want version 3 and no error, got %d and %v", version, err)
+		}
+
+		events, err := store.Load(ctx, "a", 0)
+		if err != nil {
+			t.Fatalf("want no error, got %v", err)
+		}
+		assertEvents(t, events, "a", 1, 2, 3)
+		for i, event := range events {
+			if event.Version != int64(i+1) {
+				t.Errorf("want version %d, got %d", i+1, event.Version)
+			}
+			if event.RecordedAt.IsZero() {
+				t.Errorf("want RecordedAt to be set")
+			}
+		}
+
+		events, _ = store.Load(ctx, "a", 3)
+		assertEvents(t, events, "a", 3)
+		events, _ = store.Load(ctx, "a", 4)
+		assertEvents(t, events, "a")
+		events, _ = store.Load(ctx, "missing", 0)
+		assertEvents(t, events, "missing")
+
+		if version, err = store.Version(ctx, "a"); err != nil || version != 3 {
+			t.Errorf("want version 3 and no error, got %d and %v", version, err)
+		}
+		if version, err = store.Version(ctx, "missing"); err != nil || version != 0 {
+			t.Errorf("want version 0 and no error, got %d and %v", version, err)
+		}
+	})
+
+	t.Run("load all in append order", func(t *testing.T) {
+		store := newStore(t)
+		store.Append(ctx, "a", 0, &storedEvent{Value: 1})
+		store.Append(ctx, "b", 0, &storedEvent{Value: 2}, &storedEvent{Value: 3})
+		store.Append(ctx, "a", 1, &storedEvent{Value: 4})
+
+		events, err := store.LoadAll(ctx, 0)
+		if err != nil {
+			t.Fatalf("want no error, got %v", err)
+		}
+		assertEvents(t, events, "", 1, 2, 3, 4)
+		for i, event := range events {
+			if event.Position != int64(i+1) {
+				t.Errorf("want position %d, got %d", i+1, event.Position)
+			}
+		}
+		if events[3].StreamID != "a" || events[3].Version != 2 {
+			t.Errorf("want the last event to be version 2 of stream a, got version %d of %q", events[3].Version, events[3].StreamID)
+		}
+
+		events, _ = store.LoadAll(ctx, 3)
+		assertEvents(t, events, "", 3, 4)
+	})
+
+	t.Run("version conflict", func(t *testing.T) {
+		store := newStore(t)
+		store.Append(ctx, "a", 0, &storedEvent{Value: 1})
+
+		version, err := store.Append(ctx, "a", 0, &storedEvent{Value: 2})
+		if errors.Is(err, ddd.ErrVersionConflict) == false {
+			t.Fatalf("want ErrVersionConflict, got %v", err)
+		}
+		assertStatusCode(t, err, ddd.StatusCodeConflict)
+		if version != 1 {
+			t.Errorf("want the current version 1, got %d", version)
+		}
+		events, _ := store.Load(ctx, "a", 0)
+		assertEvents(t, events, "a", 1)
+
+		if version, err = store.Append(ctx, "a", ddd.ExpectAnyVersion, &storedEvent{Value: 2}); err != nil || version != 2 {
+			t.Fatalf("want version 2 and no error, got %d and %v", version, err)
+		}
+	})
+
+	t.Run("concurrent appends", func(t *testing.T) {
+		store := newStore(t)
+		var wg sync.WaitGroup
+		conflicts := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if _, err := store.Append(ctx, "a", 0, &storedEvent{Value: i}); err != nil {
+					conflicts <- err
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(conflicts)
+
+		if len(conflicts) != 9 {
+			t.Errorf("want 9 conflicts, got %d", len(conflicts))
+		}
+		events, _ := store.Load(ctx, "a", 0)
+		if len(events) != 1 {
+			t.Errorf("want a single event, got %d", len(events))
+		}
+	})
+}
+
+func TestInMemoryEventStore(t *testing.T) {
+	testEventStoreConformance(t, func(t *testing.T) ddd.EventStore {
+		return ddd.NewInMemoryEventStore()
+	})
+}
+
+func openTestFileEventStore(t *testing.T, dir string, options ...ddd.FileEventStoreOption) *ddd.FileEventStore {
+	t.Helper()
+	store, err := ddd.OpenFileEventStore(dir, newTestCodec(t), options...)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestFileEventStore(t *testing.T) {
+	testEventStoreConformance(t, func(t *testing.T) ddd.EventStore {
+		return openTestFileEventStore(t, t.TempDir())
+	})
+}
+
+func TestFileEventStoreWithFsyncInterval(t *testing.T) {
+	testEventStoreConformance(t, func(t *testing.T) ddd.EventStore {
+		return openTestFileEventStore(t, t.TempDir(), ddd.WithFsyncPolicy(ddd.FsyncInterval))
+	})
+}
+
+func TestFileEventStoreSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store := openTestFileEventStore(t, dir, ddd.WithSegmentSize(128), ddd.WithFsyncPolicy(ddd.FsyncNever))
+	for i := 1; i <= 10; i++ {
+		stream := fmt.Sprintf("stream-%d", i%2)
+		if _, err := store.Append(ctx, stream, ddd.ExpectAnyVersion, &storedEvent{Name: stream, Value: i}); err != nil {
+			t.Fatalf("want no error, got %v", err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	if len(segments) < 2 {
+		t.Errorf("want several segments, got %d", len(segments))
+	}
+
+	store = openTestFileEventStore(t, dir, ddd.WithSegmentSize(128))
+	events, err := store.LoadAll(ctx, 0)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	assertEvents(t, events, "", 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	events, _ = store.Load(ctx, "stream-1", 0)
+	assertEvents(t, events, "stream-1", 1, 3, 5, 7, 9)
+
+	if _, err = store.Append(ctx, "stream-1", 5, &storedEvent{Value: 11}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	events, _ = store.LoadAll(ctx, 11)
+	assertEvents(t, events, "stream-1", 11)
+	if events[0].Position != 11 || events[0].Version != 6 {
+		t.Errorf("want position 11 and version 6, got %d and %d", events[0].Position, events[0].Version)
+	}
+}
+
+func TestFileEventStoreTruncatesTornTail(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store := openTestFileEventStore(t, dir)
+	store.Append(ctx, "a", 0, &storedEvent{Value: 1})
+	store.Append(ctx, "a", 1, &storedEvent{Value: 2}, &storedEvent{Value: 3})
+	store.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	info, _ := os.Stat(segments[0])
+	// Simulate a crash in the middle of writing the second record.
+	if err := os.Truncate(segments[0], info.Size()-5); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+
+	store = openTestFileEventStore(t, dir)
+	if store.RecoveredBytes() == 0 {
+		t.Errorf("want the torn tail to be recovered")
+	}
+	events, _ := store.Load(ctx, "a", 0)
+	assertEvents(t, events, "a", 1)
+	if _, err := store.Append(ctx, "a", 1, &storedEvent{Value: 4}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	store.Close()
+
+	store = openTestFileEventStore(t, dir)
+	events, _ = store.Load(ctx, "a", 0)
+	assertEvents(t, events, "a", 1, 4)
+}
+
+func TestFileEventStoreDetectsCorruptedSegment(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store := openTestFileEventStore(t, dir, ddd.WithSegmentSize(64))
+	for i := 1; i <= 3; i++ {
+		store.Append(ctx, "a", ddd.ExpectAnyVersion, &storedEvent{Value: i})
+	}
+	store.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	if len(segments) != 3 {
+		t.Fatalf("want 3 segments, got %d", len(segments))
+	}
+	data, _ := os.ReadFile(segments[0])
+	data[len(data)-2] ^= 0xff
+	os.WriteFile(segments[0], data, 0o644)
+
+	if _, err := ddd.OpenFileEventStore(dir, newTestCodec(t)); err == nil {
+		t.Errorf("want an error for a corrupted segment that is not the last one")
+	}
+}
+
+func TestFileEventStoreDetectsCorruptedRecordBeforeTail(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store := openTestFileEventStore(t, dir)
+	for i := 1; i <= 3; i++ {
+		store.Append(ctx, "a", ddd.ExpectAnyVersion, &storedEvent{Value: i})
+	}
+	store.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	if len(segments) != 1 {
+		t.Fatalf("want a single segment, got %d", len(segments))
+	}
+	data, _ := os.ReadFile(segments[0])
+	// Flip a byte in the payload of the second record, which is followed by the third one.
+	first := binary.BigEndian.Uint32(data[0:4])
+	data[8+first+8+2] ^= 0xff
+	os.WriteFile(segments[0], data, 0o644)
+
+	_, err := ddd.OpenFileEventStore(dir, newTestCodec(t))
+	if errors.Is(err, ddd.ErrEventStoreCorrupted) == false {
+		t.Fatalf("want ErrEventStoreCorrupted, got %v", err)
+	}
+	if info, _ := os.Stat(segments[0]); info.Size() != int64(len(data)) {
+		t.Errorf("want the segment not to be truncated, got %d of %d bytes", info.Size(), len(data))
+	}
+}
+
+func TestFileEventStoreLocksDirectory(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestFileEventStore(t, dir)
+
+	if _, err := ddd.OpenFileEventStore(dir, newTestCodec(t)); errors.Is(err, ddd.ErrEventStoreLocked) == false {
+		t.Fatalf("want ErrEventStoreLocked, got %v", err)
+	}
+
+	store.Close()
+	openTestFileEventStore(t, dir)
+}
+
+func TestEventRecorder(t *testing.T) {
+	store := ddd.NewInMemoryEventStore()
+	b := ddd.NewBootstrapper()
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{events: []ddd.Event{&storedEvent{Name: "a", Value: 1}, &storedEvent{Name: "b", Value: 2}}}, nil
+	})
+	b.RegisterEventHandlerFactory(&storedEvent{}, ddd.NewEventRecorder(store, func(event ddd.Event) string {
+		return event.(*storedEvent).Name
+	}))
+
+	if _, err := b.HandleCommand(context.Background(), &testCommand{}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	events, _ := store.Load(context.Background(), "b", 0)
+	assertEvents(t, events, "b", 2)
+	events, _ = store.LoadAll(context.Background(), 0)
+	assertEvents(t, events, "", 1, 2)
+}
+
+// versionedEvent is raised by an aggregate that was loaded at the given version of its stream.
+type versionedEvent struct {
+	storedEvent
+	version int64
+}
+
+func (e *versionedEvent) EventName() string {
+	return "VersionedEvent"
+}
+
+func (e *versionedEvent) StreamVersion() int64 {
+	return e.version
+}
+
+// countingEventStore counts the appends of each stream, and the loads of the streams.
+type countingEventStore struct {
+	ddd.EventStore
+	appends map[string]int
+	loads   int
+}
+
+func (s *countingEventStore) Append(ctx context.Context, streamID string, expectedVersion int64, events ...ddd.Event) (int64, error) {
+	s.appends[streamID]++
+	return s.EventStore.Append(ctx, streamID, expectedVersion, events...)
+}
+
+func (s *countingEventStore) Load(ctx context.Context, streamID string, fromVersion int64) ([]ddd.RecordedEvent, error) {
+	s.loads++
+	return s.EventStore.Load(ctx, streamID, fromVersion)
+}
+
+func TestEventRecorderAppendsEachStreamOnce(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name        string
+		events      []ddd.Event
+		handle      func(store ddd.EventStore)
+		wantErr     bool
+		wantVersion int64
+	}{
+		{
+			name:        "grouped by stream",
+			events:      []ddd.Event{&storedEvent{Name: "a", Value: 2}, &storedEvent{Name: "b", Value: 3}, &storedEvent{Name: "a", Value: 4}},
+			wantVersion: 3,
+		},
+		{
+			name:        "loaded at the current version",
+			events:      []ddd.Event{&versionedEvent{storedEvent: storedEvent{Name: "a", Value: 2}, version: 1}, &storedEvent{Name: "a", Value: 3}},
+			wantVersion: 3,
+		},
+		{
+			name:        "loaded at an older version",
+			events:      []ddd.Event{&versionedEvent{storedEvent: storedEvent{Name: "a", Value: 2}, version: 0}},
+			wantErr:     true,
+			wantVersion: 1,
+		},
+		{
+			name:   "appended concurrently",
+			events: []ddd.Event{&storedEvent{Name: "a", Value: 2}},
+			handle: func(store ddd.EventStore) {
+				store.Append(ctx, "a", ddd.ExpectAnyVersion, &storedEvent{Value: 3})
+			},
+			wantErr:     true,
+			wantVersion: 2,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &countingEventStore{EventStore: ddd.NewInMemoryEventStore(), appends: make(map[string]int)}
+			store.EventStore.Append(ctx, "a", 0, &storedEvent{Value: 1})
+			b := ddd.NewBootstrapper()
+			b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+				return &testCommandHandler{events: tc.events}, nil
+			})
+			stream := func(event ddd.Event) string {
+				if versioned, ok := event.(*versionedEvent); ok {
+					return versioned.Name
+				}
+				return event.(*storedEvent).Name
+			}
+			for _, event := range []ddd.Event{&storedEvent{}, &versionedEvent{}} {
+				b.RegisterEventHandlerFactory(event, ddd.NewEventRecorder(store, stream), ddd.JoinUnitOfWork())
+			}
+			if tc.handle != nil {
+				b.RegisterEventHandlerFactory(&storedEvent{}, func() (ddd.EventHandler, error) {
+					return &testEventHandler{handle: func(ctx context.Context) error {
+						tc.handle(store.EventStore)
+						return nil
+					}}, nil
+				}, ddd.JoinUnitOfWork())
+			}
+
+			_, err := b.HandleCommand(ctx, &testCommand{})
+
+			if tc.wantErr {
+				if errors.Is(err, ddd.ErrVersionConflict) == false {
+					t.Fatalf("want ErrVersionConflict, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("want no error, got %v", err)
+			}
+			if store.appends["a"] != 1 {
+				t.Errorf("want the events of the stream to be appended at once, got %d appends", store.appends["a"])
+			}
+			if store.loads != 0 {
+				t.Errorf("want the recorder not to load the streams, got %d loads", store.loads)
+			}
+			if version, _ := store.Version(ctx, "a"); version != tc.wantVersion {
+				t.Errorf("want stream a at version %d, got %d", tc.wantVersion, version)
+			}
+		})
+	}
+}
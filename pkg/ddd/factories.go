@@ -1,73 +1,188 @@
 package ddd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 )
 
+// ErrRegistrySealed is returned when registering a handler after the Bootstrapper was sealed.
+var ErrRegistrySealed = errors.New("handler registry is sealed")
+
+// ErrDuplicateCommandHandler is returned when a command already has a registered handler.
+var ErrDuplicateCommandHandler = errors.New("command handler is already registered")
+
+// ErrCommandNotRegistered is wrapped by the Error returned when handling a command that has no registered handler.
+var ErrCommandNotRegistered = errors.New("command handler is not registered")
+
 // CreateCommandHandler is a function based factory method signature for creating command handlers.
 type CreateCommandHandler func() (CommandHandler, error)
 
 // CreateEventHandler is a function based factory method signature for creating event handlers.
 type CreateEventHandler func() (EventHandler, error)
 
+// CreateScopedCommandHandler is a factory method signature for creating command handlers,
+// whose dependencies are resolved from the Scope of the HandleCommand call (see Resolve).
+type CreateScopedCommandHandler func(scope *Scope) (CommandHandler, error)
+
+// CreateScopedEventHandler is a factory method signature for creating event handlers,
+// whose dependencies are resolved from the Scope of the HandleCommand call (see Resolve).
+type CreateScopedEventHandler func(scope *Scope) (EventHandler, error)
+
+// CreateCommandHandlerWithContext is a factory method signature for creating command handlers,
+// which receives the context of the HandleCommand call and the command to be handled.
+// It lets the factory pick the handler or its dependencies per command, such as a tenant specific repository.
+type CreateCommandHandlerWithContext func(ctx context.Context, command Command) (CommandHandler, error)
+
+// CreateEventHandlerWithContext is a factory method signature for creating event handlers,
+// which receives the context of the handler that raised the event, and the event to be handled.
+type CreateEventHandlerWithContext func(ctx context.Context, event Event) (EventHandler, error)
+
+type commandRegistration struct {
+	factory CreateCommandHandlerWithContext
+	options handlerOptions
+}
+
+type eventRegistration struct {
+	factory CreateEventHandlerWithContext
+	options handlerOptions
+}
+
+type eventHandlerEntry struct {
+	handler EventHandler
+	options handlerOptions
+}
+
 type commandHandlerFactory struct {
-	mu               sync.Mutex
-	handlerFactories map[string]CreateCommandHandler
+	mu               sync.RWMutex
+	sealed           bool
+	handlerFactories map[string]commandRegistration
 }
 
-func (f *commandHandlerFactory) Register(command Command, factory CreateCommandHandler) {
+func (f *commandHandlerFactory) Register(command Command, factory CreateCommandHandlerWithContext, options ...HandlerOption) error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	f.handlerFactories[command.CommandName()] = factory
+	if f.sealed {
+		return fmt.Errorf("failed to register command %q: %w", command.CommandName(), ErrRegistrySealed)
+	}
+	if _, ok := f.handlerFactories[command.CommandName()]; ok {
+		return fmt.Errorf("failed to register command %q: %w", command.CommandName(), ErrDuplicateCommandHandler)
+	}
+	f.handlerFactories[command.CommandName()] = commandRegistration{factory: factory, options: newHandlerOptions(options)}
+	return nil
 }
 
-func (f *commandHandlerFactory) CreateHandler(command Command) (CommandHandler, error) {
-	factory, ok := f.handlerFactories[command.CommandName()]
+func (f *commandHandlerFactory) Seal() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sealed = true
+}
+
+func (f *commandHandlerFactory) CreateHandler(ctx context.Context, command Command) (CommandHandler, handlerOptions, error) {
+	f.mu.RLock()
+	registration, ok := f.handlerFactories[command.CommandName()]
+	f.mu.RUnlock()
 	if ok == false {
-		panic(fmt.Sprintf("command is not registered in executor: %q", command.CommandName()))
+		message := fmt.Sprintf("command %q has no registered handler", command.CommandName())
+		return nil, handlerOptions{}, WrapError(ErrCommandNotRegistered, message, StatusCodeNotFound)
 	}
-	handler, err := factory()
+	handler, err := registration.factory(ctx, command)
 	if err != nil {
-		return nil, err
+		return nil, handlerOptions{}, err
+	}
+	return handler, registration.options, nil
+}
+
+// Names returns the names of the registered commands, sorted alphabetically.
+func (f *commandHandlerFactory) Names() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	names := make([]string, 0, len(f.handlerFactories))
+	for name := range f.handlerFactories {
+		names = append(names, name)
 	}
-	return handler, nil
+	sort.Strings(names)
+	return names
 }
 
 func newCommandHandlerFactory() *commandHandlerFactory {
 	return &commandHandlerFactory{
-		handlerFactories: make(map[string]CreateCommandHandler),
+		handlerFactories: make(map[string]commandRegistration),
 	}
 }
 
 type eventHandlersFactory struct {
-	mu               sync.Mutex
-	handlerFactories map[string][]CreateEventHandler
+	mu               sync.RWMutex
+	sealed           bool
+	handlerFactories map[string][]eventRegistration
+}
+
+func (f *eventHandlersFactory) Register(event Event, factory CreateEventHandlerWithContext, options ...HandlerOption) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.sealed {
+		return fmt.Errorf("failed to register event %q: %w", event.EventName(), ErrRegistrySealed)
+	}
+	// Registrations are copied on write, so readers can keep iterating over the slice they already hold.
+	existing := f.handlerFactories[event.EventName()]
+	registrations := make([]eventRegistration, len(existing), len(existing)+1)
+	copy(registrations, existing)
+	registration := eventRegistration{factory: factory, options: newHandlerOptions(options)}
+	f.handlerFactories[event.EventName()] = append(registrations, registration)
+	return nil
 }
 
-func (f *eventHandlersFactory) Register(event Event, factory CreateEventHandler) {
+func (f *eventHandlersFactory) Seal() {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	f.handlerFactories[event.EventName()] = append(f.handlerFactories[event.EventName()], factory)
+	f.sealed = true
 }
 
-func (f *eventHandlersFactory) CreateHandlers(event Event) ([]EventHandler, error) {
-	factories := f.handlerFactories[event.EventName()]
-	handlers := make([]EventHandler, 0)
-	for _, factory := range factories {
-		handler, err := factory()
+func (f *eventHandlersFactory) CreateHandlers(ctx context.Context, event Event) ([]eventHandlerEntry, error) {
+	f.mu.RLock()
+	registrations := f.handlerFactories[event.EventName()]
+	f.mu.RUnlock()
+	handlers := make([]eventHandlerEntry, 0)
+	for _, registration := range registrations {
+		handler, err := registration.factory(ctx, event)
 		if err != nil {
 			return nil, err
 		}
-		handlers = append(handlers, handler)
+		handlers = append(handlers, eventHandlerEntry{handler: handler, options: registration.options})
 	}
 	return handlers, nil
 }
 
+// Names returns the names of the events that have registered handlers, sorted alphabetically.
+func (f *eventHandlersFactory) Names() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	names := make([]string, 0, len(f.handlerFactories))
+	for name := range f.handlerFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Count returns the number of handlers registered for the event with the given name.
+func (f *eventHandlersFactory) Count(name string) int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return len(f.handlerFactories[name])
+}
+
 func newEventHandlersFactory() *eventHandlersFactory {
 	return &eventHandlersFactory{
-		handlerFactories: make(map[string][]CreateEventHandler),
+		handlerFactories: make(map[string][]eventRegistration),
 	}
 }
@@ -0,0 +1,120 @@
+package ddd_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"sync"
+	"testing"
+)
+
+func TestRegisterDuplicateCommandHandler(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	factory := func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{}, nil
+	}
+
+	if err := b.RegisterCommandHandlerFactory(&testCommand{}, factory); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	err := b.RegisterCommandHandlerFactory(&testCommand{}, factory)
+
+	if errors.Is(err, ddd.ErrDuplicateCommandHandler) == false {
+		t.Errorf("want ErrDuplicateCommandHandler, got %v", err)
+	}
+}
+
+func TestRegisterAfterSeal(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	b.Seal()
+
+	commandErr := b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{}, nil
+	})
+	eventErr := b.RegisterEventHandlerFactory(&testEvent{name: "sealed"}, func() (ddd.EventHandler, error) {
+		return &testEventHandler{}, nil
+	})
+
+	if errors.Is(commandErr, ddd.ErrRegistrySealed) == false {
+		t.Errorf("want command registration to fail with ErrRegistrySealed, got %v", commandErr)
+	}
+	if errors.Is(eventErr, ddd.ErrRegistrySealed) == false {
+		t.Errorf("want event registration to fail with ErrRegistrySealed, got %v", eventErr)
+	}
+}
+
+// TestConcurrentHandleCommand is meant to be run with the -race flag.
+func TestConcurrentHandleCommand(t *testing.T) {
+	const workers = 20
+	b := ddd.NewBootstrapper()
+	_ = b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{events: []ddd.Event{&testEvent{name: "concurrent"}}}, nil
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := b.HandleCommand(context.Background(), &testCommand{})
+			errs <- err
+		}()
+		go func(i int) {
+			defer wg.Done()
+			_ = b.RegisterEventHandlerFactory(&testEvent{name: "concurrent"}, func() (ddd.EventHandler, error) {
+				return &testEventHandler{}, nil
+			})
+			_ = b.RegisterEventHandlerFactory(&testEvent{name: fmt.Sprintf("other-%d", i)}, func() (ddd.EventHandler, error) {
+				return &testEventHandler{}, nil
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("want no error, got %v", err)
+		}
+	}
+}
+
+type tenantKey struct{}
+
+func TestFactoriesWithContext(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	var tenants []string
+	var eventNames []string
+	b.RegisterCommandHandlerFactoryWithContext(&testCommand{}, func(ctx context.Context, command ddd.Command) (ddd.CommandHandler, error) {
+		if _, ok := command.(*testCommand); ok == false {
+			return nil, fmt.Errorf("want *testCommand, got %T", command)
+		}
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		tenants = append(tenants, tenant)
+		if tenant == "" {
+			return nil, ddd.NewError("missing tenant", ddd.StatusCodeBadRequest)
+		}
+		return &testCommandHandler{events: []ddd.Event{&testEvent{name: tenant}}}, nil
+	})
+	b.RegisterEventHandlerFactoryWithContext(&testEvent{name: "acme"}, func(ctx context.Context, event ddd.Event) (ddd.EventHandler, error) {
+		tenant, _ := ctx.Value(tenantKey{}).(string)
+		eventNames = append(eventNames, tenant+":"+event.(*testEvent).name)
+		return &testEventHandler{}, nil
+	})
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+	if _, err := b.HandleCommand(ctx, &testCommand{}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	_, err := b.HandleCommand(context.Background(), &testCommand{})
+	assertStatusCode(t, err, ddd.StatusCodeBadRequest)
+
+	if fmt.Sprint(tenants) != "[acme ]" {
+		t.Errorf("want the factory to see the tenants [acme ], got %v", tenants)
+	}
+	if fmt.Sprint(eventNames) != "[acme:acme]" {
+		t.Errorf("want the event factory to see [acme:acme], got %v", eventNames)
+	}
+}
@@ -0,0 +1,558 @@
+package ddd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy defines when a FileEventStore flushes appended events to stable storage.
+type FsyncPolicy int
+
+const (
+	// FsyncAlways flushes every append before it returns. This is the safest and slowest policy.
+	FsyncAlways FsyncPolicy = iota
+	// FsyncInterval flushes appended events periodically (see WithFsyncInterval),
+	// so a crash of the machine may lose the events appended during the last interval.
+	FsyncInterval
+	// FsyncNever leaves flushing to the operating system.
+	FsyncNever
+)
+
+// FileEventStoreOption configures a FileEventStore created by OpenFileEventStore.
+type FileEventStoreOption func(*fileEventStoreOptions)
+
+type fileEventStoreOptions struct {
+	segmentSize   int64
+	fsyncPolicy   FsyncPolicy
+	fsyncInterval time.Duration
+}
+
+// WithSegmentSize sets the size (in bytes) after which a new segment file is started. The default is 64MB.
+func WithSegmentSize(bytes int64) FileEventStoreOption {
+	return func(o *fileEventStoreOptions) {
+		o.segmentSize = bytes
+	}
+}
+
+// WithFsyncPolicy sets the FsyncPolicy. The default is FsyncAlways.
+func WithFsyncPolicy(policy FsyncPolicy) FileEventStoreOption {
+	return func(o *fileEventStoreOptions) {
+		o.fsyncPolicy = policy
+	}
+}
+
+// WithFsyncInterval sets the interval of the FsyncInterval policy. The default is one second.
+func WithFsyncInterval(interval time.Duration) FileEventStoreOption {
+	return func(o *fileEventStoreOptions) {
+		o.fsyncInterval = interval
+	}
+}
+
+const (
+	segmentPrefix      = "segment-"
+	segmentSuffix      = ".log"
+	lockFileName       = "lock"
+	recordHeaderSize   = 8
+	maxRecordSize      = 64 << 20
+	defaultSegmentSize = 64 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrEventStoreLocked is returned by OpenFileEventStore, when the directory is already used by another FileEventStore.
+var ErrEventStoreLocked = errors.New("event store is locked by another process")
+
+// ErrEventStoreCorrupted is wrapped by the error returned from OpenFileEventStore,
+// when a record that was completely written is damaged, which cannot be the result of a crash during an append.
+var ErrEventStoreCorrupted = errors.New("event store is corrupted")
+
+// errIncompleteRecord is returned by scanRecord when a record runs past the end of its segment.
+var errIncompleteRecord = errors.New("incomplete record")
+
+// FileEventStore is an EventStore that persists events in segmented append-only files within a directory.
+//
+// Every Append writes a single record, so that its events are appended atomically.
+// A record consists of its length (4 bytes), its CRC-32C checksum (4 bytes) and a JSON payload,
+// which holds the encoded events (see Codec). When a segment file grows beyond the segment size,
+// the following records are written to a new segment file.
+//
+// The index of the streams is kept in memory, and is rebuilt when the store is opened.
+// A record that was only partially written when the process crashed (a torn tail) is truncated on recovery.
+// It is safe for concurrent use within a single process, and the directory is locked, so that another process
+// cannot open it at the same time.
+type FileEventStore struct {
+	mu        sync.RWMutex
+	dir       string
+	lock      *os.File
+	codec     *Codec
+	options   fileEventStoreOptions
+	now       func() time.Time
+	segments  []*fileSegment
+	positions []fileEventLocation
+	streams   map[string][]fileEventLocation
+	dirty     bool
+	closed    bool
+	stop      chan struct{}
+	done      chan struct{}
+	recovered int64
+}
+
+type fileSegment struct {
+	path string
+	file *os.File
+	size int64
+}
+
+// fileEventLocation locates an event within a record.
+type fileEventLocation struct {
+	segment *fileSegment
+	offset  int64
+	size    int64
+	index   int
+}
+
+type fileRecord struct {
+	StreamID      string            `json:"stream_id"`
+	FirstVersion  int64             `json:"first_version"`
+	FirstPosition int64             `json:"first_position"`
+	RecordedAt    time.Time         `json:"recorded_at"`
+	Events        []fileRecordEvent `json:"events"`
+}
+
+type fileRecordEvent struct {
+	Name string          `json:"name"`
+	Data json.RawMessage `json:"data"`
+}
+
+// OpenFileEventStore opens the store in the given directory (which is created if needed),
+// recovers it from a previous crash if needed, and rebuilds its index.
+// It returns ErrEventStoreLocked when the directory is already opened by another FileEventStore.
+func OpenFileEventStore(dir string, codec *Codec, options ...FileEventStoreOption) (*FileEventStore, error) {
+	o := fileEventStoreOptions{segmentSize: defaultSegmentSize, fsyncPolicy: FsyncAlways, fsyncInterval: time.Second}
+	for _, option := range options {
+		option(&o)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create event store directory: %w", err)
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event store lock: %w", err)
+	}
+	if err = tryLockFile(lock); err != nil {
+		_ = lock.Close()
+		return nil, err
+	}
+	s := &FileEventStore{
+		dir:     dir,
+		lock:    lock,
+		codec:   codec,
+		options: o,
+		now:     time.Now,
+		streams: make(map[string][]fileEventLocation),
+	}
+	if err = s.recover(); err != nil {
+		s.closeSegments()
+		_ = lock.Close()
+		return nil, err
+	}
+	if o.fsyncPolicy == FsyncInterval {
+		s.stop = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.syncPeriodically()
+	}
+	return s, nil
+}
+
+// RecoveredBytes returns the number of bytes of a torn tail that were truncated when the store was opened.
+func (s *FileEventStore) RecoveredBytes() int64 {
+	return s.recovered
+}
+
+// Append appends the events to the stream.
+func (s *FileEventStore) Append(ctx context.Context, streamID string, expectedVersion int64, events ...Event) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return 0, errors.New("event store is closed")
+	}
+	version := int64(len(s.streams[streamID]))
+	if err := checkVersion(streamID, expectedVersion, version); err != nil {
+		return version, err
+	}
+	if len(events) == 0 {
+		return version, nil
+	}
+
+	record := fileRecord{
+		StreamID:      streamID,
+		FirstVersion:  version + 1,
+		FirstPosition: int64(len(s.positions)) + 1,
+		RecordedAt:    s.now().UTC(),
+	}
+	for _, event := range events {
+		data, err := s.codec.EncodeEvent(event)
+		if err != nil {
+			return version, err
+		}
+		record.Events = append(record.Events, fileRecordEvent{Name: event.EventName(), Data: data})
+	}
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return version, fmt.Errorf("failed to encode record: %w", err)
+	}
+	if len(payload) > maxRecordSize {
+		return version, fmt.Errorf("record of %d bytes exceeds the maximum of %d bytes", len(payload), maxRecordSize)
+	}
+
+	segment, err := s.writableSegment(int64(recordHeaderSize+len(payload)), record.FirstPosition)
+	if err != nil {
+		return version, err
+	}
+	offset := segment.size
+	if err = s.write(segment, payload); err != nil {
+		return version, err
+	}
+
+	for i := range events {
+		location := fileEventLocation{segment: segment, offset: offset, size: int64(len(payload)), index: i}
+		s.positions = append(s.positions, location)
+		s.streams[streamID] = append(s.streams[streamID], location)
+	}
+	return version + int64(len(events)), nil
+}
+
+// Load returns the events of the stream, starting at fromVersion.
+func (s *FileEventStore) Load(ctx context.Context, streamID string, fromVersion int64) ([]RecordedEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	locations := s.streams[streamID]
+	return s.read(locations[minInt(firstIndex(fromVersion), len(locations)):])
+}
+
+// LoadAll returns the events of all the streams, starting at fromPosition.
+func (s *FileEventStore) LoadAll(ctx context.Context, fromPosition int64) ([]RecordedEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.read(s.positions[minInt(firstIndex(fromPosition), len(s.positions)):])
+}
+
+// Version returns the current version of the stream.
+func (s *FileEventStore) Version(ctx context.Context, streamID string) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return int64(len(s.streams[streamID])), nil
+}
+
+// Sync flushes the appended events to stable storage.
+func (s *FileEventStore) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sync()
+}
+
+// Close flushes the appended events, closes the segment files and releases the lock of the directory.
+func (s *FileEventStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	err := s.sync()
+	s.mu.Unlock()
+
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+	}
+	if closeErr := s.closeSegments(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	// Closing the lock file releases its lock.
+	if closeErr := s.lock.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// read decodes the events at the given locations. Events of the same record are decoded together.
+func (s *FileEventStore) read(locations []fileEventLocation) ([]RecordedEvent, error) {
+	events := make([]RecordedEvent, 0, len(locations))
+	var record *fileRecord
+	var recordLocation fileEventLocation
+	for _, location := range locations {
+		if record == nil || location.segment != recordLocation.segment || location.offset != recordLocation.offset {
+			var err error
+			if record, err = readRecord(location.segment.file, location.offset, location.size); err != nil {
+				return nil, err
+			}
+			recordLocation = location
+		}
+		recordEvent := record.Events[location.index]
+		event, err := s.codec.DecodeEvent(recordEvent.Name, recordEvent.Data)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, RecordedEvent{
+			StreamID:   record.StreamID,
+			Version:    record.FirstVersion + int64(location.index),
+			Position:   record.FirstPosition + int64(location.index),
+			RecordedAt: record.RecordedAt,
+			Event:      event,
+		})
+	}
+	return events, nil
+}
+
+func readRecord(file *os.File, offset int64, size int64) (*fileRecord, error) {
+	payload := make([]byte, size)
+	if _, err := file.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return nil, fmt.Errorf("failed to read record at offset %d of %s: %w", offset, file.Name(), err)
+	}
+	var record fileRecord
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return nil, fmt.Errorf("failed to decode record at offset %d of %s: %w", offset, file.Name(), err)
+	}
+	return &record, nil
+}
+
+// writableSegment returns the segment the next record should be written to, and rolls over to a new one if needed.
+func (s *FileEventStore) writableSegment(recordSize int64, firstPosition int64) (*fileSegment, error) {
+	if len(s.segments) > 0 {
+		last := s.segments[len(s.segments)-1]
+		if last.size == 0 || last.size+recordSize <= s.options.segmentSize {
+			return last, nil
+		}
+		// The previous segment will not be written to anymore, so it is flushed before rolling over.
+		if s.options.fsyncPolicy != FsyncNever {
+			if err := last.file.Sync(); err != nil {
+				return nil, fmt.Errorf("failed to sync segment %s: %w", last.path, err)
+			}
+		}
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%s%020d%s", segmentPrefix, firstPosition, segmentSuffix))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create segment: %w", err)
+	}
+	if s.options.fsyncPolicy == FsyncAlways {
+		if err = syncDir(s.dir); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	}
+	segment := &fileSegment{path: path, file: file}
+	s.segments = append(s.segments, segment)
+	return segment, nil
+}
+
+// write appends a record to the segment. A failed write is truncated, so it does not leave a torn record behind.
+func (s *FileEventStore) write(segment *fileSegment, payload []byte) error {
+	buf := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[recordHeaderSize:], payload)
+
+	if _, err := segment.file.WriteAt(buf, segment.size); err != nil {
+		_ = segment.file.Truncate(segment.size)
+		return fmt.Errorf("failed to write record to %s: %w", segment.path, err)
+	}
+	if s.options.fsyncPolicy == FsyncAlways {
+		if err := segment.file.Sync(); err != nil {
+			_ = segment.file.Truncate(segment.size)
+			return fmt.Errorf("failed to sync segment %s: %w", segment.path, err)
+		}
+	} else {
+		s.dirty = true
+	}
+	segment.size += int64(len(buf))
+	return nil
+}
+
+// recover opens the existing segments, truncates a torn tail of the last segment, and rebuilds the index.
+func (s *FileEventStore) recover() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read event store directory: %w", err)
+	}
+	var paths []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() == false && strings.HasPrefix(name, segmentPrefix) && strings.HasSuffix(name, segmentSuffix) {
+			if _, err = strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64); err == nil {
+				paths = append(paths, filepath.Join(s.dir, name))
+			}
+		}
+	}
+	sort.Strings(paths)
+
+	for i, path := range paths {
+		file, err := os.OpenFile(path, os.O_RDWR, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open segment: %w", err)
+		}
+		segment := &fileSegment{path: path, file: file}
+		s.segments = append(s.segments, segment)
+		if err = s.scan(segment, i == len(paths)-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan indexes the records of the segment. A damaged record is only tolerated at the end of the last segment,
+// where it is the result of a crash during an append, and is truncated: either a record that runs past the end
+// of the file, or the last record of the file, whose payload may not have been flushed completely.
+// A damaged record that is followed by other records fails with ErrEventStoreCorrupted.
+func (s *FileEventStore) scan(segment *fileSegment, last bool) error {
+	info, err := segment.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat segment %s: %w", segment.path, err)
+	}
+	fileSize := info.Size()
+	reader := io.NewSectionReader(segment.file, 0, fileSize)
+	header := make([]byte, recordHeaderSize)
+	var offset int64
+	for offset < fileSize {
+		record, size, err := scanRecord(reader, header, offset, fileSize)
+		if err == nil {
+			err = s.checkRecord(record)
+		}
+		if err != nil {
+			torn := errors.Is(err, errIncompleteRecord) || offset+recordHeaderSize+size == fileSize
+			if last == false || torn == false {
+				return fmt.Errorf("%w: segment %s at offset %d: %v", ErrEventStoreCorrupted, segment.path, offset, err)
+			}
+			if err = segment.file.Truncate(offset); err != nil {
+				return fmt.Errorf("failed to truncate torn tail of segment %s: %w", segment.path, err)
+			}
+			if err = segment.file.Sync(); err != nil {
+				return fmt.Errorf("failed to sync segment %s: %w", segment.path, err)
+			}
+			s.recovered = fileSize - offset
+			break
+		}
+		for i := range record.Events {
+			location := fileEventLocation{segment: segment, offset: offset, size: size, index: i}
+			s.positions = append(s.positions, location)
+			s.streams[record.StreamID] = append(s.streams[record.StreamID], location)
+		}
+		offset += recordHeaderSize + size
+	}
+	segment.size = offset
+	return nil
+}
+
+func scanRecord(reader *io.SectionReader, header []byte, offset int64, fileSize int64) (*fileRecord, int64, error) {
+	if _, err := reader.ReadAt(header, offset); err != nil {
+		return nil, 0, fmt.Errorf("%w: header: %v", errIncompleteRecord, err)
+	}
+	size := int64(binary.BigEndian.Uint32(header[0:4]))
+	if offset+recordHeaderSize+size > fileSize {
+		return nil, 0, errIncompleteRecord
+	}
+	if size > maxRecordSize {
+		return nil, size, fmt.Errorf("record of %d bytes exceeds the maximum of %d bytes", size, maxRecordSize)
+	}
+	payload := make([]byte, size)
+	if _, err := reader.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", errIncompleteRecord, err)
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, size, errors.New("checksum mismatch")
+	}
+	var record fileRecord
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	if err := decoder.Decode(&record); err != nil {
+		return nil, size, fmt.Errorf("invalid record: %w", err)
+	}
+	return &record, size, nil
+}
+
+// checkRecord verifies that the record continues the store and its stream.
+func (s *FileEventStore) checkRecord(record *fileRecord) error {
+	if record.FirstPosition != int64(len(s.positions))+1 {
+		return fmt.Errorf("want position %d, got %d", len(s.positions)+1, record.FirstPosition)
+	}
+	if record.FirstVersion != int64(len(s.streams[record.StreamID]))+1 {
+		return fmt.Errorf("want version %d of stream %q, got %d", len(s.streams[record.StreamID])+1, record.StreamID, record.FirstVersion)
+	}
+	return nil
+}
+
+func (s *FileEventStore) sync() error {
+	if s.dirty == false || len(s.segments) == 0 {
+		return nil
+	}
+	last := s.segments[len(s.segments)-1]
+	if err := last.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync segment %s: %w", last.path, err)
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *FileEventStore) syncPeriodically() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.options.fsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			_ = s.Sync()
+		}
+	}
+}
+
+func (s *FileEventStore) closeSegments() error {
+	var err error
+	for _, segment := range s.segments {
+		if closeErr := segment.file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// syncDir flushes the directory entry of newly created files.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s: %w", dir, err)
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+var _ EventStore = (*FileEventStore)(nil)
@@ -17,3 +17,10 @@ type EventHandler interface {
 	Events() []Event
 	RollbackCommitter
 }
+
+// Compensator can optionally be implemented by command and event handlers.
+// Once a handler was committed, a failure of a later step (such as another event handler) cannot roll it back anymore,
+// so the framework calls Compensate instead, in the reverse order of the commits.
+type Compensator interface {
+	Compensate(ctx context.Context) error
+}
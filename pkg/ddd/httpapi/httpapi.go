@@ -0,0 +1,237 @@
+// Package httpapi exposes the commands of a ddd.Bootstrapper (and optional queries) over HTTP.
+//
+// Commands registered in a ddd.Codec are mounted as `POST /commands/{name}`, and queries as `GET /queries/{name}`.
+// Failures are reported as RFC 7807 problem details (application/problem+json),
+// whose HTTP status is derived from the ddd.Error status code.
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// StatusClientClosedRequest is the (non standard) HTTP status of requests whose client went away,
+// which is reported for errors with ddd.StatusCodeCanceled.
+const StatusClientClosedRequest = 499
+
+// DefaultMaxBodySize is the default maximum size of a command's request body.
+const DefaultMaxBodySize = 1 << 20
+
+// Query returns the result of a read-only request, such as an entity fetched from a repository.
+type Query func(ctx context.Context, params url.Values) (any, error)
+
+// Problem is an RFC 7807 problem details object, extended with the ddd.Error status code (if any).
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Code   string `json:"code,omitempty"`
+}
+
+// Option configures a Handler.
+type Option func(h *Handler)
+
+// WithQuery mounts the query as `GET /queries/{name}`.
+func WithQuery(name string, query Query) Option {
+	return func(h *Handler) {
+		h.queries[name] = query
+	}
+}
+
+// WithMaxBodySize limits the size of the request bodies, which defaults to DefaultMaxBodySize.
+func WithMaxBodySize(n int64) Option {
+	return func(h *Handler) {
+		h.maxBodySize = n
+	}
+}
+
+// WithStatusCode maps the ddd.Error status code to the given HTTP status,
+// such as the status codes of an app's own errors.
+func WithStatusCode(statusCode string, httpStatus int) Option {
+	return func(h *Handler) {
+		h.statusCodes[statusCode] = httpStatus
+	}
+}
+
+// WithErrorHandler sets a function that is called with the errors of the requests (such as for logging).
+// The details of internal errors are not sent to clients, so this is the place to report them.
+func WithErrorHandler(handler func(r *http.Request, err error)) Option {
+	return func(h *Handler) {
+		h.onError = handler
+	}
+}
+
+// Handler is an http.Handler that decodes commands through a ddd.Codec, and handles them with a ddd.Bootstrapper.
+type Handler struct {
+	bootstrapper *ddd.Bootstrapper
+	codec        *ddd.Codec
+	queries      map[string]Query
+	maxBodySize  int64
+	statusCodes  map[string]int
+	onError      func(r *http.Request, err error)
+}
+
+// NewHandler initializes a new Handler instance, which serves the commands registered in the codec.
+func NewHandler(bootstrapper *ddd.Bootstrapper, codec *ddd.Codec, options ...Option) *Handler {
+	h := &Handler{
+		bootstrapper: bootstrapper,
+		codec:        codec,
+		queries:      make(map[string]Query),
+		maxBodySize:  DefaultMaxBodySize,
+		statusCodes: map[string]int{
+			ddd.StatusCodeBadRequest:  http.StatusBadRequest,
+			ddd.StatusCodeNotFound:    http.StatusNotFound,
+			ddd.StatusCodeConflict:    http.StatusConflict,
+			ddd.StatusCodeCanceled:    StatusClientClosedRequest,
+			ddd.StatusCodeTimeout:     http.StatusGatewayTimeout,
+			ddd.StatusCodeUnavailable: http.StatusServiceUnavailable,
+			ddd.StatusCodeInternal:    http.StatusInternalServerError,
+		},
+		onError: func(r *http.Request, err error) {},
+	}
+	for _, option := range options {
+		option(h)
+	}
+	return h
+}
+
+// ServeHTTP routes the request to its command or query.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if name, ok := route(r.URL.Path, "/commands/"); ok {
+		h.serveCommand(w, r, name)
+		return
+	}
+	if name, ok := route(r.URL.Path, "/queries/"); ok {
+		h.serveQuery(w, r, name)
+		return
+	}
+	h.writeError(w, r, ddd.NewError(fmt.Sprintf("path %q is not found", r.URL.Path), ddd.StatusCodeNotFound))
+}
+
+func (h *Handler) serveCommand(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeProblem(w, http.StatusMethodNotAllowed, "", fmt.Sprintf("method %s is not allowed", r.Method))
+		return
+	}
+	if h.codec.HasCommand(name) == false {
+		h.writeError(w, r, ddd.NewError(fmt.Sprintf("command %q is not found", name), ddd.StatusCodeNotFound))
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+			writeProblem(w, http.StatusUnsupportedMediaType, "", "want Content-Type application/json")
+			return
+		}
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.maxBodySize))
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeProblem(w, http.StatusRequestEntityTooLarge, "", fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit))
+			return
+		}
+		h.writeError(w, r, ddd.WrapError(err, fmt.Sprintf("failed to read request body: %v", err), ddd.StatusCodeBadRequest))
+		return
+	}
+	command, err := h.codec.DecodeCommand(name, data)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	result, err := h.bootstrapper.HandleCommand(r.Context(), command)
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	h.writeResult(w, r, result)
+}
+
+func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeProblem(w, http.StatusMethodNotAllowed, "", fmt.Sprintf("method %s is not allowed", r.Method))
+		return
+	}
+	query, ok := h.queries[name]
+	if ok == false {
+		h.writeError(w, r, ddd.NewError(fmt.Sprintf("query %q is not found", name), ddd.StatusCodeNotFound))
+		return
+	}
+	result, err := query(r.Context(), r.URL.Query())
+	if err != nil {
+		h.writeError(w, r, err)
+		return
+	}
+	h.writeResult(w, r, result)
+}
+
+// writeResult writes the result as JSON, or no content when there is no result.
+func (h *Handler) writeResult(w http.ResponseWriter, r *http.Request, result any) {
+	if result == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		h.writeError(w, r, fmt.Errorf("failed to encode result: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+// writeError writes the error as a problem. Errors that are not a ddd.Error are treated as internal errors,
+// and the details of internal errors are hidden from the client.
+func (h *Handler) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	h.onError(r, err)
+	statusCode := ddd.StatusCodeInternal
+	var e *ddd.Error
+	if errors.As(err, &e) {
+		statusCode = e.StatusCode()
+	}
+	status, ok := h.statusCodes[statusCode]
+	if ok == false {
+		status = http.StatusInternalServerError
+	}
+	detail := err.Error()
+	if status == http.StatusInternalServerError {
+		detail = ""
+	}
+	writeProblem(w, status, statusCode, detail)
+}
+
+func writeProblem(w http.ResponseWriter, status int, code string, detail string) {
+	title := http.StatusText(status)
+	if status == StatusClientClosedRequest {
+		title = "Client Closed Request"
+	}
+	data, _ := json.Marshal(Problem{Type: "about:blank", Title: title, Status: status, Detail: detail, Code: code})
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// route returns the name that follows the prefix of the path, if it has one.
+func route(path string, prefix string) (string, bool) {
+	if strings.HasPrefix(path, prefix) == false {
+		return "", false
+	}
+	name := strings.TrimPrefix(path, prefix)
+	if name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+	return name, true
+}
+
+var _ http.Handler = (*Handler)(nil)
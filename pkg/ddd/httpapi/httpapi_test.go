@@ -0,0 +1,152 @@
+package httpapi_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"github.com/vklap/go_ddd/pkg/ddd/httpapi"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type greetCommand struct {
+	Name string `json:"name"`
+}
+
+func (c *greetCommand) IsValid() error {
+	if c.Name == "" {
+		return ddd.NewError("name cannot be empty", ddd.StatusCodeBadRequest)
+	}
+	return nil
+}
+
+func (c *greetCommand) CommandName() string {
+	return "greet"
+}
+
+type greetCommandHandler struct{}
+
+func (h *greetCommandHandler) Handle(ctx context.Context, command ddd.Command) (any, error) {
+	name := command.(*greetCommand).Name
+	switch name {
+	case "nobody":
+		return nil, ddd.NewError("nobody is not found", ddd.StatusCodeNotFound)
+	case "silent":
+		return nil, nil
+	case "broken":
+		return nil, errors.New("database password is wrong")
+	}
+	return map[string]string{"greeting": "hello " + name}, nil
+}
+
+func (h *greetCommandHandler) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (h *greetCommandHandler) Rollback(ctx context.Context) error {
+	return nil
+}
+
+func (h *greetCommandHandler) Events() []ddd.Event {
+	return nil
+}
+
+func newTestHandler(t *testing.T) *httpapi.Handler {
+	t.Helper()
+	b := ddd.NewBootstrapper()
+	if err := b.RegisterCommandHandlerFactory(&greetCommand{}, func() (ddd.CommandHandler, error) {
+		return &greetCommandHandler{}, nil
+	}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	codec := ddd.NewCodec()
+	codec.RegisterCommand(&greetCommand{})
+	return httpapi.NewHandler(b, codec,
+		httpapi.WithMaxBodySize(64),
+		httpapi.WithQuery("greeting", func(ctx context.Context, params url.Values) (any, error) {
+			if params.Get("name") == "" {
+				return nil, ddd.NewError("name cannot be empty", ddd.StatusCodeBadRequest)
+			}
+			return map[string]string{"greeting": "hello " + params.Get("name")}, nil
+		}),
+	)
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantCode    string
+		wantBody    string
+	}{
+		{name: "command succeeds", method: http.MethodPost, path: "/commands/greet", body: `{"name":"eli"}`, wantStatus: http.StatusOK, wantBody: `{"greeting":"hello eli"}`},
+		{name: "command without result", method: http.MethodPost, path: "/commands/greet", body: `{"name":"silent"}`, wantStatus: http.StatusNoContent},
+		{name: "invalid command", method: http.MethodPost, path: "/commands/greet", body: `{}`, wantStatus: http.StatusBadRequest, wantCode: ddd.StatusCodeBadRequest},
+		{name: "invalid json", method: http.MethodPost, path: "/commands/greet", body: `{`, wantStatus: http.StatusBadRequest, wantCode: ddd.StatusCodeBadRequest},
+		{name: "handler not found error", method: http.MethodPost, path: "/commands/greet", body: `{"name":"nobody"}`, wantStatus: http.StatusNotFound, wantCode: ddd.StatusCodeNotFound},
+		{name: "internal error", method: http.MethodPost, path: "/commands/greet", body: `{"name":"broken"}`, wantStatus: http.StatusInternalServerError, wantCode: ddd.StatusCodeInternal},
+		{name: "unknown command", method: http.MethodPost, path: "/commands/unknown", body: `{}`, wantStatus: http.StatusNotFound, wantCode: ddd.StatusCodeNotFound},
+		{name: "wrong method", method: http.MethodGet, path: "/commands/greet", wantStatus: http.StatusMethodNotAllowed},
+		{name: "wrong content type", method: http.MethodPost, path: "/commands/greet", contentType: "text/plain", body: `{"name":"eli"}`, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "body too large", method: http.MethodPost, path: "/commands/greet", body: `{"name":"` + strings.Repeat("a", 100) + `"}`, wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "query succeeds", method: http.MethodGet, path: "/queries/greeting?name=eli", wantStatus: http.StatusOK, wantBody: `{"greeting":"hello eli"}`},
+		{name: "query fails", method: http.MethodGet, path: "/queries/greeting", wantStatus: http.StatusBadRequest, wantCode: ddd.StatusCodeBadRequest},
+		{name: "unknown path", method: http.MethodGet, path: "/unknown", wantStatus: http.StatusNotFound, wantCode: ddd.StatusCodeNotFound},
+	}
+	handler := newTestHandler(t)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				r.Header.Set("Content-Type", tc.contentType)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("want status %d, got %d (%s)", tc.wantStatus, w.Code, w.Body)
+			}
+			if tc.wantBody != "" && w.Body.String() != tc.wantBody {
+				t.Errorf("want body %s, got %s", tc.wantBody, w.Body)
+			}
+			if w.Code < 400 {
+				return
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != "application/problem+json" {
+				t.Errorf("want a problem, got content type %q", contentType)
+			}
+			var problem httpapi.Problem
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+				t.Fatalf("want a problem, got %v", err)
+			}
+			if problem.Status != tc.wantStatus || problem.Code != tc.wantCode || problem.Title == "" {
+				t.Errorf("want a problem with status %d and code %q, got %+v", tc.wantStatus, tc.wantCode, problem)
+			}
+			if tc.wantCode == ddd.StatusCodeInternal && problem.Detail != "" {
+				t.Errorf("want the details of internal errors to be hidden, got %q", problem.Detail)
+			}
+		})
+	}
+}
+
+func TestHandlerWhileShuttingDown(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	codec := ddd.NewCodec()
+	codec.RegisterCommand(&greetCommand{})
+	b.Shutdown(context.Background())
+
+	w := httptest.NewRecorder()
+	httpapi.NewHandler(b, codec).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/commands/greet", strings.NewReader(`{"name":"eli"}`)))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("want status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+}
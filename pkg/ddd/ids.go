@@ -0,0 +1,266 @@
+package ddd
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IDGenerator is an interface that should be implemented by entity ID generators.
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+// UUIDv4Generator generates random (version 4) UUIDs, as defined by RFC 9562.
+type UUIDv4Generator struct {
+	random io.Reader
+}
+
+// NewUUIDv4Generator initializes a new UUIDv4Generator instance.
+func NewUUIDv4Generator() *UUIDv4Generator {
+	return &UUIDv4Generator{random: rand.Reader}
+}
+
+// NewID returns a new UUID, such as "7d444840-9dc0-41d0-a1f2-c4c2c4b3a4a4".
+func (g *UUIDv4Generator) NewID() (string, error) {
+	var uuid [16]byte
+	if _, err := io.ReadFull(g.random, uuid[:]); err != nil {
+		return "", fmt.Errorf("failed to generate UUIDv4: %w", err)
+	}
+	return formatUUID(uuid, 4), nil
+}
+
+// UUIDv7Generator generates time ordered (version 7) UUIDs, as defined by RFC 9562.
+// UUIDs generated by the same generator are strictly increasing, even within the same millisecond.
+type UUIDv7Generator struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	random  io.Reader
+	lastMs  int64
+	counter uint16
+}
+
+// NewUUIDv7Generator initializes a new UUIDv7Generator instance.
+func NewUUIDv7Generator() *UUIDv7Generator {
+	return &UUIDv7Generator{now: time.Now, random: rand.Reader}
+}
+
+// NewID returns a new UUID, such as "018b8f2e-4a35-7cc3-9b1e-35a7a2c1f0d2".
+func (g *UUIDv7Generator) NewID() (string, error) {
+	var uuid [16]byte
+	if _, err := io.ReadFull(g.random, uuid[6:]); err != nil {
+		return "", fmt.Errorf("failed to generate UUIDv7: %w", err)
+	}
+
+	g.mu.Lock()
+	ms := g.now().UnixMilli()
+	if ms <= g.lastMs {
+		// The 12 bits following the timestamp are used as a counter, to keep the UUIDs ordered.
+		if g.counter == 0xfff {
+			g.lastMs++
+			g.counter = 0
+		} else {
+			g.counter++
+		}
+		ms = g.lastMs
+	} else {
+		g.lastMs = ms
+		g.counter = binary.BigEndian.Uint16(uuid[6:8]) & 0x7ff
+	}
+	counter := g.counter
+	g.mu.Unlock()
+
+	putUint48(uuid[0:6], uint64(ms))
+	binary.BigEndian.PutUint16(uuid[6:8], counter)
+	return formatUUID(uuid, 7), nil
+}
+
+// ULIDGenerator generates ULIDs (Universally Unique Lexicographically Sortable Identifiers).
+// ULIDs generated by the same generator are strictly increasing, even within the same millisecond.
+type ULIDGenerator struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	random  io.Reader
+	lastMs  int64
+	entropy [10]byte
+}
+
+// NewULIDGenerator initializes a new ULIDGenerator instance.
+func NewULIDGenerator() *ULIDGenerator {
+	return &ULIDGenerator{now: time.Now, random: rand.Reader}
+}
+
+// NewID returns a new ULID, such as "01HE7Z1X8V3YF4Q9N2B6KMPRST".
+func (g *ULIDGenerator) NewID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := g.now().UnixMilli()
+	if ms <= g.lastMs {
+		// The entropy of the previous ULID is incremented, to keep the ULIDs ordered.
+		if incrementBytes(g.entropy[:]) == false {
+			return "", errors.New("failed to generate ULID: entropy overflow within the same millisecond")
+		}
+		ms = g.lastMs
+	} else {
+		if _, err := io.ReadFull(g.random, g.entropy[:]); err != nil {
+			return "", fmt.Errorf("failed to generate ULID: %w", err)
+		}
+		g.lastMs = ms
+	}
+
+	var ulid [16]byte
+	putUint48(ulid[0:6], uint64(ms))
+	copy(ulid[6:], g.entropy[:])
+	return encodeCrockford(ulid), nil
+}
+
+// SnowflakeEpoch is the default epoch of the SnowflakeGenerator (2010-11-04T01:42:54.657Z).
+var SnowflakeEpoch = time.UnixMilli(1288834974657)
+
+const (
+	snowflakeNodeBits     = 10
+	snowflakeSequenceBits = 12
+	snowflakeMaxNodeID    = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSequence  = 1<<snowflakeSequenceBits - 1
+)
+
+// SnowflakeGenerator generates Snowflake IDs: 64-bit integers that consist of a 41-bit millisecond timestamp,
+// a 10-bit node ID and a 12-bit sequence number. Every node generating IDs should have its own node ID.
+type SnowflakeGenerator struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	epoch    time.Time
+	nodeID   int64
+	lastMs   int64
+	sequence int64
+}
+
+// NewSnowflakeGenerator initializes a new SnowflakeGenerator instance for the given node ID (0 to 1023).
+func NewSnowflakeGenerator(nodeID int64) (*SnowflakeGenerator, error) {
+	if nodeID < 0 || nodeID > snowflakeMaxNodeID {
+		return nil, fmt.Errorf("snowflake node ID must be between 0 and %d, got %d", snowflakeMaxNodeID, nodeID)
+	}
+	return &SnowflakeGenerator{now: time.Now, epoch: SnowflakeEpoch, nodeID: nodeID}, nil
+}
+
+// NewID returns a new Snowflake ID in its decimal representation, such as "1724913539221487616".
+func (g *SnowflakeGenerator) NewID() (string, error) {
+	id, err := g.NewInt64()
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+// NewInt64 returns a new Snowflake ID.
+func (g *SnowflakeGenerator) NewInt64() (int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := g.now().Sub(g.epoch).Milliseconds()
+	if ms < g.lastMs {
+		return 0, fmt.Errorf("failed to generate snowflake ID: clock moved backwards by %dms", g.lastMs-ms)
+	}
+	if ms == g.lastMs {
+		g.sequence = (g.sequence + 1) & snowflakeMaxSequence
+		if g.sequence == 0 {
+			// The sequence is exhausted for this millisecond, so wait for the next one.
+			for ms <= g.lastMs {
+				time.Sleep(100 * time.Microsecond)
+				ms = g.now().Sub(g.epoch).Milliseconds()
+			}
+		}
+	} else {
+		g.sequence = 0
+	}
+	g.lastMs = ms
+	return ms<<(snowflakeNodeBits+snowflakeSequenceBits) | g.nodeID<<snowflakeSequenceBits | g.sequence, nil
+}
+
+// SequenceGenerator generates deterministic IDs, consisting of a prefix and an incrementing number
+// (such as "user-1", "user-2", etc.). It is meant to be used in tests.
+type SequenceGenerator struct {
+	mu     sync.Mutex
+	prefix string
+	next   int64
+}
+
+// NewSequenceGenerator initializes a new SequenceGenerator instance.
+func NewSequenceGenerator(prefix string) *SequenceGenerator {
+	return &SequenceGenerator{prefix: prefix, next: 1}
+}
+
+// NewID returns the next ID of the sequence.
+func (g *SequenceGenerator) NewID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	id := g.prefix + strconv.FormatInt(g.next, 10)
+	g.next++
+	return id, nil
+}
+
+var _ IDGenerator = (*UUIDv4Generator)(nil)
+var _ IDGenerator = (*UUIDv7Generator)(nil)
+var _ IDGenerator = (*ULIDGenerator)(nil)
+var _ IDGenerator = (*SnowflakeGenerator)(nil)
+var _ IDGenerator = (*SequenceGenerator)(nil)
+
+func formatUUID(uuid [16]byte, version byte) string {
+	uuid[6] = uuid[6]&0x0f | version<<4
+	uuid[8] = uuid[8]&0x3f | 0x80
+	var buf [36]byte
+	hex.Encode(buf[0:8], uuid[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], uuid[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], uuid[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], uuid[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], uuid[10:])
+	return string(buf[:])
+}
+
+func putUint48(b []byte, v uint64) {
+	b[0] = byte(v >> 40)
+	b[1] = byte(v >> 32)
+	b[2] = byte(v >> 24)
+	b[3] = byte(v >> 16)
+	b[4] = byte(v >> 8)
+	b[5] = byte(v)
+}
+
+// incrementBytes increments b as a big-endian number, and reports false on overflow.
+func incrementBytes(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// encodeCrockford encodes 128 bits as 26 characters of Crockford's base32.
+func encodeCrockford(id [16]byte) string {
+	var buf [26]byte
+	hi := binary.BigEndian.Uint64(id[0:8])
+	lo := binary.BigEndian.Uint64(id[8:16])
+	// 26 characters hold 130 bits, so the first character only holds the 3 most significant bits.
+	for i := 25; i >= 0; i-- {
+		buf[i] = crockfordAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(buf[:])
+}
@@ -0,0 +1,106 @@
+package ddd_test
+
+import (
+	"github.com/vklap/go_ddd/internal/domain/command_model"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestIDGenerators(t *testing.T) {
+	snowflake, err := ddd.NewSnowflakeGenerator(42)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	data := []struct {
+		generator ddd.IDGenerator
+		name      string
+		ordered   bool
+		pattern   string
+	}{
+		{
+			generator: ddd.NewUUIDv4Generator(),
+			name:      "UUIDv4",
+			ordered:   false,
+			pattern:   `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`,
+		},
+		{
+			generator: ddd.NewUUIDv7Generator(),
+			name:      "UUIDv7",
+			ordered:   true,
+			pattern:   `^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`,
+		},
+		{
+			generator: ddd.NewULIDGenerator(),
+			name:      "ULID",
+			ordered:   true,
+			pattern:   `^[0-7][0-9A-HJKMNP-TV-Z]{25}$`,
+		},
+		{
+			generator: snowflake,
+			name:      "Snowflake",
+			ordered:   true,
+			pattern:   `^[0-9]+$`,
+		},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			pattern := regexp.MustCompile(d.pattern)
+			seen := make(map[string]bool)
+			previous := ""
+			for i := 0; i < 10000; i++ {
+				id, err := d.generator.NewID()
+				if err != nil {
+					t.Fatalf("want no error, got %v", err)
+				}
+				if pattern.MatchString(id) == false {
+					t.Fatalf("want ID matching %q, got %q", d.pattern, id)
+				}
+				if seen[id] {
+					t.Fatalf("want unique IDs, got %q twice", id)
+				}
+				seen[id] = true
+				if d.ordered && previous != "" && less(id, previous) {
+					t.Fatalf("want ordered IDs, got %q after %q", id, previous)
+				}
+				previous = id
+			}
+		})
+	}
+}
+
+func less(a string, b string) bool {
+	aInt, aErr := strconv.ParseInt(a, 10, 64)
+	bInt, bErr := strconv.ParseInt(b, 10, 64)
+	if aErr == nil && bErr == nil {
+		return aInt < bInt
+	}
+	return a < b
+}
+
+func TestSnowflakeNodeID(t *testing.T) {
+	snowflake, err := ddd.NewSnowflakeGenerator(1023)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	id, _ := snowflake.NewInt64()
+	if nodeID := id >> 12 & 1023; nodeID != 1023 {
+		t.Errorf("want node ID 1023, got %d", nodeID)
+	}
+	if _, err = ddd.NewSnowflakeGenerator(1024); err == nil {
+		t.Error("want error for node ID 1024, got nil")
+	}
+}
+
+func TestNewEntityWithGenerator(t *testing.T) {
+	generator := ddd.NewSequenceGenerator("user-")
+
+	first, _ := command_model.NewUser(generator)
+	second, _ := command_model.NewUser(generator)
+
+	if first.ID() != "user-1" || second.ID() != "user-2" {
+		t.Errorf("want IDs %q and %q, got %q and %q", "user-1", "user-2", first.ID(), second.ID())
+	}
+}
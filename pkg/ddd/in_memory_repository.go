@@ -0,0 +1,265 @@
+package ddd
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// InMemoryRepository is a transactional Repository that keeps entities in memory.
+// It is safe for concurrent use, and can be shared by all the handlers of an app (such as in tests):
+//   - Entities are copied on read and on write, so changes made to an entity do not leak into the repository
+//     before it is saved and committed.
+//   - Saved and deleted entities are buffered per unit of work (see UnitOfWorkFromContext),
+//     and are only visible to other units of work once committed.
+//     Outside of a unit of work, they are applied right away.
+//   - The repository enlists itself in the unit of work on the first write, and applies all the buffered writes
+//     atomically on Commit.
+//   - Entities that implement AggregateRoot are tracked in the unit of work (see Track).
+type InMemoryRepository[T Entity] struct {
+	mu           sync.RWMutex
+	clone        func(T) T
+	entities     map[string]T
+	transactions map[*UnitOfWork]*inMemoryTransaction[T]
+}
+
+type inMemoryWrite[T Entity] struct {
+	id      string
+	entity  T
+	deleted bool
+}
+
+type inMemoryTransaction[T Entity] struct {
+	writes     []inMemoryWrite[T]
+	savepoints map[string]int
+}
+
+// lookup returns the latest buffered write of the given entity.
+func (tx *inMemoryTransaction[T]) lookup(id string) (inMemoryWrite[T], bool) {
+	for i := len(tx.writes) - 1; i >= 0; i-- {
+		if tx.writes[i].id == id {
+			return tx.writes[i], true
+		}
+	}
+	return inMemoryWrite[T]{}, false
+}
+
+// NewInMemoryRepository initializes a new InMemoryRepository instance.
+// The clone function should return a deep copy of the given entity.
+func NewInMemoryRepository[T Entity](clone func(T) T) *InMemoryRepository[T] {
+	return &InMemoryRepository[T]{
+		clone:        clone,
+		entities:     make(map[string]T),
+		transactions: make(map[*UnitOfWork]*inMemoryTransaction[T]),
+	}
+}
+
+// Add stores copies of the entities right away, bypassing units of work.
+// It is meant to seed data, such as in tests.
+func (r *InMemoryRepository[T]) Add(entities ...T) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, entity := range entities {
+		r.entities[entity.ID()] = r.copy(entity)
+	}
+}
+
+// Get returns a copy of the entity with the given ID, including the changes buffered by the current unit of work.
+func (r *InMemoryRepository[T]) Get(ctx context.Context, id string) (T, error) {
+	r.mu.RLock()
+	entity, ok := r.get(ctx, id)
+	r.mu.RUnlock()
+	if ok == false {
+		var zero T
+		return zero, NewError(fmt.Sprintf("entity with id %q does not exist", id), StatusCodeNotFound)
+	}
+	entity = r.clone(entity)
+	r.track(ctx, entity)
+	return entity, nil
+}
+
+func (r *InMemoryRepository[T]) get(ctx context.Context, id string) (T, bool) {
+	if tx, ok := r.transactions[r.key(ctx)]; ok {
+		if write, ok := tx.lookup(id); ok {
+			return write.entity, write.deleted == false
+		}
+	}
+	entity, ok := r.entities[id]
+	return entity, ok
+}
+
+// Save buffers a copy of the entity, until the current unit of work is committed.
+// Outside of a unit of work, the copy is stored right away.
+func (r *InMemoryRepository[T]) Save(ctx context.Context, entity T) error {
+	stored := r.copy(entity)
+	r.track(ctx, entity)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.key(ctx) == nil {
+		r.entities[entity.ID()] = stored
+		return nil
+	}
+	tx := r.transaction(ctx)
+	tx.writes = append(tx.writes, inMemoryWrite[T]{id: entity.ID(), entity: stored})
+	return nil
+}
+
+// Delete buffers the deletion of the entity with the given ID, until the current unit of work is committed.
+// Outside of a unit of work, the entity is deleted right away.
+func (r *InMemoryRepository[T]) Delete(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.get(ctx, id); ok == false {
+		return NewError(fmt.Sprintf("entity with id %q does not exist", id), StatusCodeNotFound)
+	}
+	if r.key(ctx) == nil {
+		delete(r.entities, id)
+		return nil
+	}
+	tx := r.transaction(ctx)
+	tx.writes = append(tx.writes, inMemoryWrite[T]{id: id, deleted: true})
+	return nil
+}
+
+// Find returns copies of the entities that satisfy the specification, ordered by their IDs.
+// The changes buffered by the current unit of work are taken into account.
+func (r *InMemoryRepository[T]) Find(ctx context.Context, specification Specification[T]) ([]T, error) {
+	r.mu.RLock()
+	candidates := make(map[string]T, len(r.entities))
+	for id, entity := range r.entities {
+		candidates[id] = entity
+	}
+	if tx, ok := r.transactions[r.key(ctx)]; ok {
+		for _, write := range tx.writes {
+			if write.deleted {
+				delete(candidates, write.id)
+			} else {
+				candidates[write.id] = write.entity
+			}
+		}
+	}
+	r.mu.RUnlock()
+
+	ids := make([]string, 0, len(candidates))
+	for id, entity := range candidates {
+		if specification.IsSatisfiedBy(entity) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	entities := make([]T, 0, len(ids))
+	for _, id := range ids {
+		entity := r.clone(candidates[id])
+		r.track(ctx, entity)
+		entities = append(entities, entity)
+	}
+	return entities, nil
+}
+
+// Commit atomically applies the writes buffered by the current unit of work.
+func (r *InMemoryRepository[T]) Commit(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := r.key(ctx)
+	tx, ok := r.transactions[key]
+	if ok == false {
+		return nil
+	}
+	for _, write := range tx.writes {
+		if write.deleted {
+			delete(r.entities, write.id)
+		} else {
+			r.entities[write.id] = write.entity
+		}
+	}
+	delete(r.transactions, key)
+	return nil
+}
+
+// Rollback discards the writes buffered by the current unit of work.
+func (r *InMemoryRepository[T]) Rollback(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.transactions, r.key(ctx))
+	return nil
+}
+
+// Savepoint records the writes buffered so far by the current unit of work.
+func (r *InMemoryRepository[T]) Savepoint(ctx context.Context, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.key(ctx) == nil {
+		return fmt.Errorf("savepoint %q requires a unit of work", name)
+	}
+	tx := r.transaction(ctx)
+	tx.savepoints[name] = len(tx.writes)
+	return nil
+}
+
+// RollbackTo discards the writes buffered by the current unit of work after the given savepoint.
+func (r *InMemoryRepository[T]) RollbackTo(ctx context.Context, name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tx, ok := r.transactions[r.key(ctx)]
+	if ok == false {
+		return fmt.Errorf("savepoint %q does not exist", name)
+	}
+	writes, ok := tx.savepoints[name]
+	if ok == false {
+		return fmt.Errorf("savepoint %q does not exist", name)
+	}
+	tx.writes = tx.writes[:writes]
+	for savepoint, savepointWrites := range tx.savepoints {
+		if savepointWrites > writes {
+			delete(tx.savepoints, savepoint)
+		}
+	}
+	return nil
+}
+
+// key returns the unit of work the writes are buffered for (or nil outside of a unit of work).
+func (r *InMemoryRepository[T]) key(ctx context.Context) *UnitOfWork {
+	uow, _ := UnitOfWorkFromContext(ctx)
+	return uow
+}
+
+// transaction returns the transaction of the current unit of work, and starts it if needed.
+// It should be called while holding the lock, within a unit of work.
+func (r *InMemoryRepository[T]) transaction(ctx context.Context) *inMemoryTransaction[T] {
+	key := r.key(ctx)
+	tx, ok := r.transactions[key]
+	if ok == false {
+		tx = &inMemoryTransaction[T]{savepoints: make(map[string]int)}
+		r.transactions[key] = tx
+		key.Enlist(r)
+	}
+	return tx
+}
+
+// copy returns the copy of entity to be stored.
+func (r *InMemoryRepository[T]) copy(entity T) T {
+	stored := r.clone(entity)
+	if aggregate, ok := any(stored).(AggregateRoot); ok {
+		// The events belong to the given entity, and should not be raised again when the entity is loaded.
+		aggregate.PullEvents()
+	}
+	return stored
+}
+
+func (r *InMemoryRepository[T]) track(ctx context.Context, entity T) {
+	if aggregate, ok := any(entity).(AggregateRoot); ok {
+		Track(ctx, aggregate)
+	}
+}
+
+var _ Repository[*BaseEntity] = (*InMemoryRepository[*BaseEntity])(nil)
+var _ Savepointer = (*InMemoryRepository[*BaseEntity])(nil)
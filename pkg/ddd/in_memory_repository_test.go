@@ -0,0 +1,178 @@
+package ddd_test
+
+import (
+	"context"
+	"errors"
+	"github.com/vklap/go_ddd/internal/domain/command_model"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type emailDomainSpecification struct {
+	domain string
+}
+
+func (s *emailDomainSpecification) IsSatisfiedBy(user *command_model.User) bool {
+	return strings.HasSuffix(user.Email().String(), "@"+s.domain)
+}
+
+func newTestUser(t *testing.T, id string, email string) *command_model.User {
+	t.Helper()
+	user := &command_model.User{}
+	user.SetID(id)
+	user.SetEmail(mustNewEmail(t, email))
+	return user
+}
+
+func withNewUnitOfWork(t *testing.T, fn func(ctx context.Context)) {
+	t.Helper()
+	b := ddd.NewBootstrapper()
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{handle: func(ctx context.Context) error {
+			fn(ctx)
+			return nil
+		}}, nil
+	})
+	if _, err := b.HandleCommand(context.Background(), &testCommand{}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+}
+
+func TestInMemoryRepositoryIsolation(t *testing.T) {
+	repository := ddd.NewInMemoryRepository((*command_model.User).Clone)
+	repository.Add(newTestUser(t, "1", "kamel.amit@thaabet.sy"))
+	ctx := context.Background()
+
+	withNewUnitOfWork(t, func(uowCtx context.Context) {
+		user, _ := repository.Get(uowCtx, "1")
+		user.SetEmail(mustNewEmail(t, "eli.cohen@mossad.gov.il"))
+		if stored, _ := repository.Get(uowCtx, "1"); stored.Email().String() != "kamel.amit@thaabet.sy" {
+			t.Errorf("want unsaved changes not to leak, got %q", stored.Email())
+		}
+
+		_ = repository.Save(uowCtx, user)
+		if stored, _ := repository.Get(uowCtx, "1"); stored.Email().String() != "eli.cohen@mossad.gov.il" {
+			t.Errorf("want the unit of work to read its own writes, got %q", stored.Email())
+		}
+		if stored, _ := repository.Get(ctx, "1"); stored.Email().String() != "kamel.amit@thaabet.sy" {
+			t.Errorf("want uncommitted changes to be invisible outside the unit of work, got %q", stored.Email())
+		}
+		_ = repository.Save(uowCtx, newTestUser(t, "2", "wolfgang.lotz@mossad.gov.il"))
+		if err := repository.Delete(uowCtx, "2"); err != nil {
+			t.Errorf("want no error, got %v", err)
+		}
+	})
+
+	stored, _ := repository.Get(ctx, "1")
+	if stored.Email().String() != "eli.cohen@mossad.gov.il" {
+		t.Errorf("want the committed email, got %q", stored.Email())
+	}
+	if _, err := repository.Get(ctx, "2"); err == nil {
+		t.Error("want the deleted user not to exist")
+	}
+	if len(stored.Events()) != 0 {
+		t.Errorf("want stored users without events, got %v", stored.Events())
+	}
+}
+
+func TestInMemoryRepositoryRollback(t *testing.T) {
+	ctx := context.Background()
+	repository := ddd.NewInMemoryRepository((*command_model.User).Clone)
+	b := ddd.NewBootstrapper()
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{handle: func(ctx context.Context) error {
+			_ = repository.Save(ctx, newTestUser(t, "1", "kamel.amit@thaabet.sy"))
+			return errors.New("failed")
+		}}, nil
+	})
+
+	if _, err := b.HandleCommand(ctx, &testCommand{}); err == nil {
+		t.Fatal("want an error, got nil")
+	}
+
+	if _, err := repository.Get(ctx, "1"); err == nil {
+		t.Error("want the rolled back user not to exist")
+	}
+	assertStatusCode(t, repository.Delete(ctx, "1"), ddd.StatusCodeNotFound)
+}
+
+func TestInMemoryRepositoryWithoutUnitOfWork(t *testing.T) {
+	ctx := context.Background()
+	repository := ddd.NewInMemoryRepository((*command_model.User).Clone)
+
+	_ = repository.Save(ctx, newTestUser(t, "1", "kamel.amit@thaabet.sy"))
+	_ = repository.Rollback(ctx)
+
+	if _, err := repository.Get(ctx, "1"); err != nil {
+		t.Errorf("want the user to be saved right away, got %v", err)
+	}
+	withNewUnitOfWork(t, func(uowCtx context.Context) {
+		if _, err := repository.Get(uowCtx, "1"); err != nil {
+			t.Errorf("want the user to be visible to units of work, got %v", err)
+		}
+	})
+	if err := repository.Delete(ctx, "1"); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if _, err := repository.Get(ctx, "1"); err == nil {
+		t.Error("want the user to be deleted right away")
+	}
+	if err := repository.Savepoint(ctx, "s1"); err == nil {
+		t.Error("want a savepoint to require a unit of work")
+	}
+}
+
+func TestInMemoryRepositoryFind(t *testing.T) {
+	ctx := context.Background()
+	repository := ddd.NewInMemoryRepository((*command_model.User).Clone)
+	repository.Add(
+		newTestUser(t, "1", "kamel.amit@thaabet.sy"),
+		newTestUser(t, "2", "eli.cohen@mossad.gov.il"),
+	)
+	_ = repository.Save(ctx, newTestUser(t, "3", "wolfgang.lotz@mossad.gov.il"))
+
+	users, err := repository.Find(ctx, &emailDomainSpecification{domain: "mossad.gov.il"})
+
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if len(users) != 2 || users[0].ID() != "2" || users[1].ID() != "3" {
+		t.Errorf("want users 2 and 3, got %v", users)
+	}
+}
+
+// TestInMemoryRepositoryConcurrency is meant to be run with the -race flag.
+func TestInMemoryRepositoryConcurrency(t *testing.T) {
+	const workers = 20
+	repository := ddd.NewInMemoryRepository((*command_model.User).Clone)
+	b := ddd.NewBootstrapper()
+	b.RegisterCommandHandlerFactory(&command_model.SaveUserCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{handle: func(ctx context.Context) error {
+			user, err := repository.Get(ctx, "1")
+			if err != nil {
+				return err
+			}
+			user.SetEmail(mustNewEmail(t, "eli.cohen@mossad.gov.il"))
+			return repository.Save(ctx, user)
+		}}, nil
+	})
+	repository.Add(newTestUser(t, "1", "kamel.amit@thaabet.sy"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := b.HandleCommand(context.Background(), &command_model.SaveUserCommand{UserID: "1", Email: "-"}); err != nil {
+				t.Errorf("want no error, got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := repository.Get(context.Background(), "1"); err != nil {
+		t.Errorf("want no error, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+// Package integration publishes integration events: the public messages that tell other services
+// about the domain events raised within a ddd.Bootstrapper.
+//
+// Domain events are internal, and their structs change together with the domain model.
+// Integration events are contracts with other services, so each of them has a stable public schema of its own,
+// named by its type (such as "user.email_changed.v1"). A Translator maps a domain event to its integration event,
+// and a Publisher publishes it to a message broker once the unit of work that raised the domain event commits.
+package integration
+
+import (
+	"context"
+	"fmt"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"github.com/vklap/go_ddd/pkg/ddd/broker"
+)
+
+// Message is an integration event, to be published to a topic of the message broker.
+type Message struct {
+	// Topic is the topic the message is published to.
+	Topic string
+	// Key orders the messages with the same key, such as the ID of their aggregate root (see broker.Record).
+	Key string
+	// Type names the public schema of the payload. It should change (such as from v1 to v2)
+	// whenever the schema changes in a way that breaks its consumers.
+	Type string
+	// Payload is the public representation of the event, which is published as the JSON payload of a ddd.Envelope.
+	// It should be a struct of its own rather than the domain event, so the domain can change without breaking
+	// the consumers.
+	Payload any
+}
+
+// Translator translates a domain event into its integration event.
+// It returns a nil Message when the event should not be published.
+type Translator func(ctx context.Context, event ddd.Event) (*Message, error)
+
+// Option configures a Publisher.
+type Option func(p *Publisher)
+
+// WithErrorHandler sets the function that is called when a message could not be published.
+// Since the unit of work that raised the event was already committed by then, the error cannot fail it,
+// and the handler should rather report it, or publish the message again later.
+// By default, such errors are ignored.
+func WithErrorHandler(handler func(err error)) Option {
+	return func(p *Publisher) {
+		p.errorHandler = handler
+	}
+}
+
+// Publisher publishes the integration events translated from domain events.
+type Publisher struct {
+	publisher    broker.Publisher
+	errorHandler func(err error)
+}
+
+// NewPublisher initializes a new Publisher instance, which publishes the messages with the given broker.Publisher.
+func NewPublisher(publisher broker.Publisher, options ...Option) *Publisher {
+	p := &Publisher{publisher: publisher, errorHandler: func(err error) {}}
+	for _, option := range options {
+		option(p)
+	}
+	return p
+}
+
+// Register registers the translator of the domain event, with an event handler that joins the unit of work
+// that raised the event. The event is translated right away, so a failed translation rolls the unit of work back,
+// and the message is published once all the resources of the unit of work were committed (see ddd.UnitOfWork.AfterCommit).
+// It fails like ddd.Bootstrapper.RegisterEventHandlerFactory.
+func (p *Publisher) Register(b *ddd.Bootstrapper, event ddd.Event, translator Translator) error {
+	return b.RegisterEventHandlerFactory(event, func() (ddd.EventHandler, error) {
+		return &translatingHandler{publisher: p, translator: translator}, nil
+	}, ddd.JoinUnitOfWork())
+}
+
+// publish publishes the record, and reports the failure to the error handler.
+func (p *Publisher) publish(ctx context.Context, topic string, record broker.Record) {
+	if err := p.publisher.Publish(ctx, topic, record); err != nil {
+		p.errorHandler(fmt.Errorf("failed to publish integration event to %q: %w", topic, err))
+	}
+}
+
+// translatingHandler is the event handler that translates the events,
+// and publishes their messages once its unit of work was committed.
+type translatingHandler struct {
+	publisher  *Publisher
+	translator Translator
+}
+
+func (h *translatingHandler) Handle(ctx context.Context, event ddd.Event) error {
+	message, err := h.translator(ctx, event)
+	if err != nil || message == nil {
+		return err
+	}
+	if message.Topic == "" || message.Type == "" {
+		return fmt.Errorf("integration event of %q needs a topic and a type", event.EventName())
+	}
+	data, err := ddd.NewEnvelope(message.Type, message.Payload)
+	if err != nil {
+		return err
+	}
+	uow, ok := ddd.UnitOfWorkFromContext(ctx)
+	if ok == false {
+		return fmt.Errorf("integration event of %q is not raised within a unit of work", event.EventName())
+	}
+	record := broker.Record{Key: message.Key, Data: data}
+	uow.AfterCommit(func(ctx context.Context) {
+		h.publisher.publish(ctx, message.Topic, record)
+	})
+	return nil
+}
+
+func (h *translatingHandler) Events() []ddd.Event {
+	return nil
+}
+
+func (h *translatingHandler) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (h *translatingHandler) Rollback(ctx context.Context) error {
+	return nil
+}
+
+var _ ddd.EventHandler = (*translatingHandler)(nil)
@@ -0,0 +1,235 @@
+package integration_test
+
+import (
+	"context"
+	"errors"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"github.com/vklap/go_ddd/pkg/ddd/broker"
+	"github.com/vklap/go_ddd/pkg/ddd/integration"
+	"testing"
+	"time"
+)
+
+type renameUserCommand struct {
+	UserID string
+	Name   string
+}
+
+func (c *renameUserCommand) IsValid() error {
+	return nil
+}
+
+func (c *renameUserCommand) CommandName() string {
+	return "RenameUser"
+}
+
+// userRenamedEvent is the internal domain event, whose fields are not meant to be published as is.
+type userRenamedEvent struct {
+	UserID       string
+	NewName      string
+	PreviousName string
+}
+
+func (e *userRenamedEvent) EventName() string {
+	return "UserRenamed"
+}
+
+// userRenamedV1 is the public schema of the integration event.
+type userRenamedV1 struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+func translateUserRenamed(ctx context.Context, event ddd.Event) (*integration.Message, error) {
+	e := event.(*userRenamedEvent)
+	if e.NewName == e.PreviousName {
+		return nil, nil
+	}
+	if e.NewName == "untranslatable" {
+		return nil, errors.New("name cannot be translated")
+	}
+	return &integration.Message{Topic: "users", Key: e.UserID, Type: "user.renamed.v1", Payload: userRenamedV1{UserID: e.UserID, Name: e.NewName}}, nil
+}
+
+type renameUserCommandHandler struct {
+	events    []ddd.Event
+	commitErr error
+	committed *bool
+}
+
+func (h *renameUserCommandHandler) Handle(ctx context.Context, command ddd.Command) (any, error) {
+	c := command.(*renameUserCommand)
+	h.events = append(h.events, &userRenamedEvent{UserID: c.UserID, NewName: c.Name, PreviousName: "eli"})
+	return nil, nil
+}
+
+func (h *renameUserCommandHandler) Events() []ddd.Event {
+	return h.events
+}
+
+func (h *renameUserCommandHandler) Commit(ctx context.Context) error {
+	*h.committed = true
+	return h.commitErr
+}
+
+func (h *renameUserCommandHandler) Rollback(ctx context.Context) error {
+	return nil
+}
+
+// auditEventHandler joins the unit of work after the translating handler, so it is committed after it.
+type auditEventHandler struct {
+	commitErr error
+	committed *bool
+}
+
+func (h *auditEventHandler) Handle(ctx context.Context, event ddd.Event) error {
+	return nil
+}
+
+func (h *auditEventHandler) Events() []ddd.Event {
+	return nil
+}
+
+func (h *auditEventHandler) Commit(ctx context.Context) error {
+	*h.committed = true
+	return h.commitErr
+}
+
+func (h *auditEventHandler) Rollback(ctx context.Context) error {
+	return nil
+}
+
+// recordingPublisher records the published records, and whether all the resources were committed before.
+type recordingPublisher struct {
+	committed      []*bool
+	err            error
+	records        []broker.Record
+	afterCommitted bool
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, topic string, records ...broker.Record) error {
+	p.afterCommitted = true
+	for _, committed := range p.committed {
+		p.afterCommitted = p.afterCommitted && *committed
+	}
+	if p.err != nil {
+		return p.err
+	}
+	p.records = append(p.records, records...)
+	return nil
+}
+
+func TestPublisher(t *testing.T) {
+	tests := []struct {
+		name           string
+		userName       string
+		commitErr      error
+		auditCommitErr error
+		publishErr     error
+		wantErr        bool
+		wantHandlerErr bool
+		want           string
+	}{
+		{
+			name:     "published after commit",
+			userName: "kamel",
+			want:     `{"type":"user.renamed.v1","payload":{"user_id":"1","name":"kamel"}}`,
+		},
+		{
+			name:     "not translated",
+			userName: "eli",
+		},
+		{
+			name:     "translation failed",
+			userName: "untranslatable",
+			wantErr:  true,
+		},
+		{
+			name:      "commit failed",
+			userName:  "kamel",
+			commitErr: errors.New("commit failed"),
+			wantErr:   true,
+		},
+		{
+			name:           "later resource commit failed",
+			userName:       "kamel",
+			auditCommitErr: errors.New("audit commit failed"),
+			wantErr:        true,
+		},
+		{
+			name:           "publish failed",
+			userName:       "kamel",
+			publishErr:     errors.New("broker is down"),
+			wantHandlerErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			committed, auditCommitted := false, false
+			publisher := &recordingPublisher{committed: []*bool{&committed, &auditCommitted}, err: tc.publishErr}
+			b := ddd.NewBootstrapper()
+			b.RegisterCommandHandlerFactory(&renameUserCommand{}, func() (ddd.CommandHandler, error) {
+				return &renameUserCommandHandler{commitErr: tc.commitErr, committed: &committed}, nil
+			})
+			var handlerErr error
+			p := integration.NewPublisher(publisher, integration.WithErrorHandler(func(err error) {
+				handlerErr = err
+			}))
+			if err := p.Register(b, &userRenamedEvent{}, translateUserRenamed); err != nil {
+				t.Fatalf("want no error, got %v", err)
+			}
+			b.RegisterEventHandlerFactory(&userRenamedEvent{}, func() (ddd.EventHandler, error) {
+				return &auditEventHandler{commitErr: tc.auditCommitErr, committed: &auditCommitted}, nil
+			}, ddd.JoinUnitOfWork())
+
+			_, err := b.HandleCommand(context.Background(), &renameUserCommand{UserID: "1", Name: tc.userName})
+
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("want error %v, got %v", tc.wantErr, err)
+			}
+			if (handlerErr != nil) != tc.wantHandlerErr || errors.Is(handlerErr, tc.publishErr) == false {
+				t.Errorf("want the publish error %v to be reported, got %v", tc.publishErr, handlerErr)
+			}
+			if tc.want == "" {
+				if len(publisher.records) != 0 {
+					t.Errorf("want no message, got %s", publisher.records[0].Data)
+				}
+				return
+			}
+			if len(publisher.records) != 1 || string(publisher.records[0].Data) != tc.want || publisher.records[0].Key != "1" {
+				t.Fatalf("want %s, got %+v", tc.want, publisher.records)
+			}
+			if publisher.afterCommitted == false {
+				t.Errorf("want the message to be published after all the resources were committed")
+			}
+		})
+	}
+}
+
+func TestPublisherWithBroker(t *testing.T) {
+	b := broker.NewInMemoryBroker()
+	defer b.Close()
+	committed := false
+	bootstrapper := ddd.NewBootstrapper()
+	bootstrapper.RegisterCommandHandlerFactory(&renameUserCommand{}, func() (ddd.CommandHandler, error) {
+		return &renameUserCommandHandler{committed: &committed}, nil
+	})
+	integration.NewPublisher(b).Register(bootstrapper, &userRenamedEvent{}, translateUserRenamed)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages, _ := b.Subscribe(ctx, "users", "directory")
+
+	if _, err := bootstrapper.HandleCommand(ctx, &renameUserCommand{UserID: "1", Name: "kamel"}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+
+	select {
+	case message := <-messages:
+		envelope, err := ddd.ParseEnvelope(message.Data())
+		if err != nil || envelope.Type != "user.renamed.v1" {
+			t.Errorf("want a user.renamed.v1 envelope, got %s (%v)", message.Data(), err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("want the integration event to be published")
+	}
+}
@@ -0,0 +1,377 @@
+// Package jsonrpc exposes the commands of a ddd.Bootstrapper as JSON-RPC 2.0 methods (https://www.jsonrpc.org/specification).
+//
+// Every command registered in a ddd.Codec is a method named by its CommandName, whose params are the command's JSON object.
+// Batch requests and notifications are supported, and failures are reported as JSON-RPC error objects,
+// whose code is derived from the ddd.Error status code.
+// A Server can be served over HTTP (it is an http.Handler), or over any stream, such as a Unix socket (see Serve).
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Version is the JSON-RPC version implemented by Server.
+const Version = "2.0"
+
+// The error codes defined by the JSON-RPC specification.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+// The error codes of ddd.Error status codes, in the range reserved for implementation-defined server errors.
+const (
+	CodeNotFound    = -32001
+	CodeConflict    = -32002
+	CodeUnavailable = -32003
+	CodeTimeout     = -32004
+	CodeCanceled    = -32005
+)
+
+// DefaultMaxBodySize is the default maximum size of a request sent over HTTP.
+const DefaultMaxBodySize = 1 << 20
+
+// Request is a JSON-RPC request. Requests without an ID are notifications, which are not responded to.
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// Response is a JSON-RPC response, which has either a Result or an Error.
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// Error is a JSON-RPC error object. Its data holds the ddd.Error status code (if any).
+type Error struct {
+	Code    int        `json:"code"`
+	Message string     `json:"message"`
+	Data    *ErrorData `json:"data,omitempty"`
+}
+
+// ErrorData is the data of an Error.
+type ErrorData struct {
+	StatusCode string `json:"status_code"`
+}
+
+// Error returns the error message.
+func (e *Error) Error() string {
+	return fmt.Sprintf("json-rpc error %d: %s", e.Code, e.Message)
+}
+
+// Option configures a Server.
+type Option func(s *Server)
+
+// WithMaxBodySize limits the size of the requests sent over HTTP, which defaults to DefaultMaxBodySize.
+func WithMaxBodySize(n int64) Option {
+	return func(s *Server) {
+		s.maxBodySize = n
+	}
+}
+
+// WithErrorCode maps the ddd.Error status code to the given JSON-RPC error code,
+// such as the status codes of an app's own errors.
+func WithErrorCode(statusCode string, code int) Option {
+	return func(s *Server) {
+		s.codes[statusCode] = code
+	}
+}
+
+// WithErrorHandler sets a function that is called with the errors of the called methods (such as for logging).
+// The details of internal errors are not sent to clients, so this is the place to report them.
+func WithErrorHandler(handler func(ctx context.Context, method string, err error)) Option {
+	return func(s *Server) {
+		s.onError = handler
+	}
+}
+
+// Server handles JSON-RPC requests by decoding their commands through a ddd.Codec,
+// and handling them with a ddd.Bootstrapper.
+type Server struct {
+	bootstrapper *ddd.Bootstrapper
+	codec        *ddd.Codec
+	maxBodySize  int64
+	codes        map[string]int
+	onError      func(ctx context.Context, method string, err error)
+}
+
+// NewServer initializes a new Server instance, whose methods are the commands registered in the codec.
+func NewServer(bootstrapper *ddd.Bootstrapper, codec *ddd.Codec, options ...Option) *Server {
+	s := &Server{
+		bootstrapper: bootstrapper,
+		codec:        codec,
+		maxBodySize:  DefaultMaxBodySize,
+		codes: map[string]int{
+			ddd.StatusCodeBadRequest:  CodeInvalidParams,
+			ddd.StatusCodeNotFound:    CodeNotFound,
+			ddd.StatusCodeConflict:    CodeConflict,
+			ddd.StatusCodeUnavailable: CodeUnavailable,
+			ddd.StatusCodeTimeout:     CodeTimeout,
+			ddd.StatusCodeCanceled:    CodeCanceled,
+			ddd.StatusCodeInternal:    CodeInternalError,
+		},
+		onError: func(ctx context.Context, method string, err error) {},
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// Handle handles a request or a batch of requests, and returns the encoded response (or batch of responses).
+// It returns nil when there is nothing to respond, such as when all the requests are notifications.
+func (s *Server) Handle(ctx context.Context, data []byte) []byte {
+	data = bytes.TrimSpace(data)
+	if json.Valid(data) == false {
+		return encode(errorResponse(nil, &Error{Code: CodeParseError, Message: "parse error"}))
+	}
+	if len(data) == 0 || data[0] != '[' {
+		response := s.handle(ctx, data)
+		if response == nil {
+			return nil
+		}
+		return encode(response)
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(data, &batch); err != nil || len(batch) == 0 {
+		return encode(errorResponse(nil, &Error{Code: CodeInvalidRequest, Message: "invalid request: empty batch"}))
+	}
+	responses := make([]*Response, 0, len(batch))
+	for _, request := range batch {
+		if response := s.handle(ctx, request); response != nil {
+			responses = append(responses, response)
+		}
+	}
+	if len(responses) == 0 {
+		return nil
+	}
+	return encode(responses)
+}
+
+// handle handles a single request, and returns nil if it is a notification.
+func (s *Server) handle(ctx context.Context, data []byte) *Response {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return errorResponse(nil, &Error{Code: CodeInvalidRequest, Message: "invalid request: want an object"})
+	}
+	id, hasID := fields["id"]
+	if hasID && validID(id) == false {
+		return errorResponse(nil, &Error{Code: CodeInvalidRequest, Message: "invalid request: id must be a string, a number or null"})
+	}
+	var request Request
+	if err := json.Unmarshal(data, &request); err != nil || request.JSONRPC != Version || request.Method == "" {
+		return errorResponse(id, &Error{Code: CodeInvalidRequest, Message: `invalid request: want "jsonrpc": "2.0" and a method`})
+	}
+
+	result, rpcErr := s.call(ctx, request.Method, request.Params)
+	if hasID == false {
+		return nil
+	}
+	if rpcErr != nil {
+		return errorResponse(id, rpcErr)
+	}
+	return &Response{JSONRPC: Version, Result: result, ID: id}
+}
+
+// call decodes the params into the command named by method, and handles it.
+func (s *Server) call(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, *Error) {
+	if s.codec.HasCommand(method) == false {
+		return nil, &Error{Code: CodeMethodNotFound, Message: fmt.Sprintf("method %q is not found", method)}
+	}
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		params = []byte("{}")
+	}
+	if params[0] != '{' {
+		return nil, &Error{Code: CodeInvalidParams, Message: "params must be an object"}
+	}
+	command, err := s.codec.DecodeCommand(method, params)
+	if err != nil {
+		return nil, s.errorObject(ctx, method, err)
+	}
+	result, err := s.bootstrapper.HandleCommand(ctx, command)
+	if err != nil {
+		return nil, s.errorObject(ctx, method, err)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, s.errorObject(ctx, method, fmt.Errorf("failed to encode result: %w", err))
+	}
+	return data, nil
+}
+
+// errorObject converts the error to an Error. Errors that are not a ddd.Error are treated as internal errors,
+// and the details of internal errors are hidden from the client.
+func (s *Server) errorObject(ctx context.Context, method string, err error) *Error {
+	s.onError(ctx, method, err)
+	statusCode := ddd.StatusCodeInternal
+	var e *ddd.Error
+	if errors.As(err, &e) {
+		statusCode = e.StatusCode()
+	}
+	code, ok := s.codes[statusCode]
+	if ok == false {
+		code = CodeInternalError
+	}
+	message := err.Error()
+	if code == CodeInternalError {
+		message = "internal error"
+	}
+	return &Error{Code: code, Message: message, Data: &ErrorData{StatusCode: statusCode}}
+}
+
+// ServeHTTP handles the request (or batch of requests) posted in the body of r.
+// It responds with 204 No Content when there is nothing to respond, such as for notifications.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, fmt.Sprintf("method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, s.maxBodySize))
+	if err != nil {
+		status := http.StatusBadRequest
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		response := encode(errorResponse(nil, &Error{Code: CodeInvalidRequest, Message: fmt.Sprintf("failed to read request: %v", err)}))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(response)
+		return
+	}
+	response := s.Handle(r.Context(), data)
+	if response == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
+
+// ServeConn handles the requests read from conn, and writes the responses to it (one JSON value per line),
+// until conn is closed. A request that cannot be parsed is responded to with a parse error, and ends the connection,
+// since the stream cannot be read any further.
+func (s *Server) ServeConn(ctx context.Context, conn io.ReadWriter) error {
+	decoder := json.NewDecoder(conn)
+	for {
+		var data json.RawMessage
+		if err := decoder.Decode(&data); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+				conn.Write(append(encode(errorResponse(nil, &Error{Code: CodeParseError, Message: "parse error"})), '\n'))
+			}
+			return err
+		}
+		response := s.Handle(ctx, data)
+		if response == nil {
+			continue
+		}
+		if _, err := conn.Write(append(response, '\n')); err != nil {
+			return err
+		}
+	}
+}
+
+// Serve accepts connections from the listener, such as a Unix socket listener, and serves each of them with ServeConn.
+// Once ctx is done, the listener and the connections are closed, and Serve waits for the requests being handled.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var mu sync.Mutex
+	conns := make(map[net.Conn]struct{})
+	// closed is set once the connections were closed, so the ones accepted later are closed right away.
+	closed := false
+	// Closing the connections lets wg.Wait return, no matter why Serve returns.
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
+		}
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		closed = true
+		for conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		mu.Lock()
+		if closed || ctx.Err() != nil {
+			mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		conns[conn] = struct{}{}
+		wg.Add(1)
+		mu.Unlock()
+		go func() {
+			defer wg.Done()
+			s.ServeConn(ctx, conn)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+func errorResponse(id json.RawMessage, err *Error) *Response {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &Response{JSONRPC: Version, Error: err, ID: id}
+}
+
+// validID reports whether the id is a string, a number or null.
+func validID(id json.RawMessage) bool {
+	var value any
+	if err := json.Unmarshal(id, &value); err != nil {
+		return false
+	}
+	switch value.(type) {
+	case string, float64, nil:
+		return true
+	}
+	return false
+}
+
+func encode(value any) []byte {
+	data, _ := json.Marshal(value)
+	return data
+}
+
+var _ http.Handler = (*Server)(nil)
@@ -0,0 +1,309 @@
+package jsonrpc_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"github.com/vklap/go_ddd/pkg/ddd/jsonrpc"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+type greetCommand struct {
+	Name string `json:"name"`
+}
+
+func (c *greetCommand) IsValid() error {
+	if c.Name == "" {
+		return ddd.NewError("name cannot be empty", ddd.StatusCodeBadRequest)
+	}
+	return nil
+}
+
+func (c *greetCommand) CommandName() string {
+	return "greet"
+}
+
+type greetCommandHandler struct{}
+
+func (h *greetCommandHandler) Handle(ctx context.Context, command ddd.Command) (any, error) {
+	name := command.(*greetCommand).Name
+	switch name {
+	case "nobody":
+		return nil, ddd.NewError("nobody is not found", ddd.StatusCodeNotFound)
+	case "broken":
+		return nil, errors.New("database password is wrong")
+	}
+	return "hello " + name, nil
+}
+
+func (h *greetCommandHandler) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (h *greetCommandHandler) Rollback(ctx context.Context) error {
+	return nil
+}
+
+func (h *greetCommandHandler) Events() []ddd.Event {
+	return nil
+}
+
+func newTestServer(t *testing.T) *jsonrpc.Server {
+	t.Helper()
+	b := ddd.NewBootstrapper()
+	if err := b.RegisterCommandHandlerFactory(&greetCommand{}, func() (ddd.CommandHandler, error) {
+		return &greetCommandHandler{}, nil
+	}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	codec := ddd.NewCodec()
+	codec.RegisterCommand(&greetCommand{})
+	return jsonrpc.NewServer(b, codec)
+}
+
+func TestServerHandle(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{
+			name:    "call succeeds",
+			request: `{"jsonrpc":"2.0","method":"greet","params":{"name":"eli"},"id":1}`,
+			want:    `{"jsonrpc":"2.0","result":"hello eli","id":1}`,
+		},
+		{
+			name:    "notification is not responded to",
+			request: `{"jsonrpc":"2.0","method":"greet","params":{"name":"eli"}}`,
+			want:    ``,
+		},
+		{
+			name:    "invalid command",
+			request: `{"jsonrpc":"2.0","method":"greet","params":{},"id":"a"}`,
+			want:    `{"jsonrpc":"2.0","error":{"code":-32602,"message":"name cannot be empty","data":{"status_code":"bad_request"}},"id":"a"}`,
+		},
+		{
+			name:    "params by position",
+			request: `{"jsonrpc":"2.0","method":"greet","params":["eli"],"id":1}`,
+			want:    `{"jsonrpc":"2.0","error":{"code":-32602,"message":"params must be an object"},"id":1}`,
+		},
+		{
+			name:    "not found error",
+			request: `{"jsonrpc":"2.0","method":"greet","params":{"name":"nobody"},"id":1}`,
+			want:    `{"jsonrpc":"2.0","error":{"code":-32001,"message":"nobody is not found","data":{"status_code":"not_found"}},"id":1}`,
+		},
+		{
+			name:    "internal error",
+			request: `{"jsonrpc":"2.0","method":"greet","params":{"name":"broken"},"id":1}`,
+			want:    `{"jsonrpc":"2.0","error":{"code":-32603,"message":"internal error","data":{"status_code":"internal"}},"id":1}`,
+		},
+		{
+			name:    "method not found",
+			request: `{"jsonrpc":"2.0","method":"unknown","id":1}`,
+			want:    `{"jsonrpc":"2.0","error":{"code":-32601,"message":"method \"unknown\" is not found"},"id":1}`,
+		},
+		{
+			name:    "invalid request",
+			request: `{"jsonrpc":"1.0","method":"greet","id":1}`,
+			want:    `{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request: want \"jsonrpc\": \"2.0\" and a method"},"id":1}`,
+		},
+		{
+			name:    "parse error",
+			request: `{"jsonrpc":"2.0",`,
+			want:    `{"jsonrpc":"2.0","error":{"code":-32700,"message":"parse error"},"id":null}`,
+		},
+		{
+			name:    "empty batch",
+			request: `[]`,
+			want:    `{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request: empty batch"},"id":null}`,
+		},
+		{
+			name: "batch",
+			request: `[
+				{"jsonrpc":"2.0","method":"greet","params":{"name":"eli"},"id":1},
+				{"jsonrpc":"2.0","method":"greet","params":{"name":"eli"}},
+				1,
+				{"jsonrpc":"2.0","method":"unknown","id":2}
+			]`,
+			want: `[{"jsonrpc":"2.0","result":"hello eli","id":1},` +
+				`{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request: want an object"},"id":null},` +
+				`{"jsonrpc":"2.0","error":{"code":-32601,"message":"method \"unknown\" is not found"},"id":2}]`,
+		},
+		{
+			name:    "batch of notifications",
+			request: `[{"jsonrpc":"2.0","method":"greet","params":{"name":"eli"}}]`,
+			want:    ``,
+		},
+	}
+	server := newTestServer(t)
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := server.Handle(context.Background(), []byte(tc.request))
+			if string(got) != tc.want {
+				t.Errorf("want %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	server := httptest.NewServer(newTestServer(t))
+	defer server.Close()
+
+	response, err := http.Post(server.URL, "application/json", strings.NewReader(`{"jsonrpc":"2.0","method":"greet","params":{"name":"eli"},"id":1}`))
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	defer response.Body.Close()
+	var got jsonrpc.Response
+	if err = json.NewDecoder(response.Body).Decode(&got); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if response.StatusCode != http.StatusOK || string(got.Result) != `"hello eli"` || string(got.ID) != "1" {
+		t.Errorf("want the result of the call, got status %d and %+v", response.StatusCode, got)
+	}
+
+	response, err = http.Post(server.URL, "application/json", strings.NewReader(`{"jsonrpc":"2.0","method":"greet","params":{"name":"eli"}}`))
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		t.Errorf("want no content for a notification, got status %d", response.StatusCode)
+	}
+}
+
+func TestServeHTTPReadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body io.Reader
+		want int
+	}{
+		{
+			name: "too large",
+			body: strings.NewReader(`{"jsonrpc":"2.0","method":"greet","params":{"name":"` + strings.Repeat("x", 64) + `"},"id":1}`),
+			want: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "broken body",
+			body: iotest.ErrReader(errors.New("connection reset")),
+			want: http.StatusBadRequest,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := ddd.NewBootstrapper()
+			server := jsonrpc.NewServer(b, ddd.NewCodec(), jsonrpc.WithMaxBodySize(32))
+			recorder := httptest.NewRecorder()
+
+			server.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", tc.body))
+
+			if recorder.Code != tc.want {
+				t.Errorf("want status %d, got %d", tc.want, recorder.Code)
+			}
+		})
+	}
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rpc.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets are not supported: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- newTestServer(t).Serve(ctx, listener)
+	}()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, `{"jsonrpc":"2.0","method":"greet","params":{"name":"a"}}`+"\n")
+	io.WriteString(conn, `{"jsonrpc":"2.0","method":"greet","params":{"name":"b"},"id":1}`+"\n")
+	io.WriteString(conn, `[{"jsonrpc":"2.0","method":"greet","params":{"name":"c"},"id":2}]`)
+	reader := bufio.NewReader(conn)
+	for _, want := range []string{
+		`{"jsonrpc":"2.0","result":"hello b","id":1}`,
+		`[{"jsonrpc":"2.0","result":"hello c","id":2}]`,
+	} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("want no error, got %v", err)
+		}
+		if got := strings.TrimSpace(line); got != want {
+			t.Errorf("want %s, got %s", want, got)
+		}
+	}
+
+	cancel()
+	if err = <-served; err != nil {
+		t.Errorf("want no error, got %v", err)
+	}
+	if _, err = reader.ReadString('\n'); err == nil {
+		t.Errorf("want the connection to be closed")
+	}
+}
+
+// lateListener accepts a single connection once it was closed, as if it had been accepted while closing.
+type lateListener struct {
+	closed chan struct{}
+	once   sync.Once
+	served bool
+}
+
+func (l *lateListener) Accept() (net.Conn, error) {
+	<-l.closed
+	if l.served {
+		return nil, net.ErrClosed
+	}
+	l.served = true
+	// Lets Serve close the connections it tracks, before the late connection is returned.
+	time.Sleep(50 * time.Millisecond)
+	conn, _ := net.Pipe()
+	return conn, nil
+}
+
+func (l *lateListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *lateListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "late", Net: "unix"}
+}
+
+func TestServeClosesConnectionsAcceptedWhileStopping(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- newTestServer(t).Serve(ctx, &lateListener{closed: make(chan struct{})})
+	}()
+
+	cancel()
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("want no error, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("want Serve to return once stopped")
+	}
+}
@@ -0,0 +1,209 @@
+package ddd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StatusCodeUnavailable is a string that represents an error caused by a service that does not accept requests,
+// such as a Bootstrapper that is shutting down.
+const StatusCodeUnavailable = "unavailable"
+
+// ErrShuttingDown is wrapped by the errors returned from HandleCommand, HandleEvent and Go once Shutdown was called.
+var ErrShuttingDown = errors.New("bootstrapper is shutting down")
+
+// ErrAlreadyStarted is returned when starting a Bootstrapper that was already started.
+var ErrAlreadyStarted = errors.New("bootstrapper was already started")
+
+// Hook is a function that is run when a Bootstrapper starts or stops (see OnStart and OnStop).
+type Hook func(ctx context.Context) error
+
+// DefaultShutdownTimeout is the time Run lets the in-flight work drain after its context is done.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// WithShutdownTimeout sets the time Run lets the in-flight work drain after its context is done.
+func WithShutdownTimeout(timeout time.Duration) BootstrapperOption {
+	return func(b *Bootstrapper) {
+		b.lifecycle.shutdownTimeout = timeout
+	}
+}
+
+type lifecycle struct {
+	mu              sync.Mutex
+	startHooks      []Hook
+	stopHooks       []Hook
+	started         bool
+	closing         bool
+	inFlight        sync.WaitGroup
+	shutdownTimeout time.Duration
+	// cancels cancel the contexts of the in-flight work, when the shutdown deadline is exceeded.
+	cancels map[int]context.CancelFunc
+	nextID  int
+	stopped chan struct{}
+	stopErr error
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		shutdownTimeout: DefaultShutdownTimeout,
+		cancels:         make(map[int]context.CancelFunc),
+		stopped:         make(chan struct{}),
+	}
+}
+
+// OnStart registers a hook that is run by Start, such as connecting to a database or starting a relay.
+// Hooks are run in the order they were registered.
+func (b *Bootstrapper) OnStart(hook Hook) {
+	b.lifecycle.mu.Lock()
+	defer b.lifecycle.mu.Unlock()
+
+	b.lifecycle.startHooks = append(b.lifecycle.startHooks, hook)
+}
+
+// OnStop registers a hook that is run by Shutdown, such as closing a connection pool.
+// Hooks are run in the reverse order they were registered, so resources are closed before the ones they depend on.
+func (b *Bootstrapper) OnStop(hook Hook) {
+	b.lifecycle.mu.Lock()
+	defer b.lifecycle.mu.Unlock()
+
+	b.lifecycle.stopHooks = append(b.lifecycle.stopHooks, hook)
+}
+
+// Start runs the OnStart hooks, and stops at the first one that fails.
+func (b *Bootstrapper) Start(ctx context.Context) error {
+	l := b.lifecycle
+	l.mu.Lock()
+	if l.started {
+		l.mu.Unlock()
+		return ErrAlreadyStarted
+	}
+	l.started = true
+	hooks := l.startHooks
+	l.mu.Unlock()
+
+	for i, hook := range hooks {
+		if err := hook(ctx); err != nil {
+			return fmt.Errorf("start hook %d failed: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Run starts the Bootstrapper, waits until ctx is done, and then shuts it down,
+// giving the in-flight work the shutdown timeout (see WithShutdownTimeout) to drain.
+// If Start fails, the Bootstrapper is shut down as well, and the start error is returned.
+func (b *Bootstrapper) Run(ctx context.Context) error {
+	err := b.Start(ctx)
+	if err == nil {
+		<-ctx.Done()
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), b.lifecycle.shutdownTimeout)
+	defer cancel()
+	if shutdownErr := b.Shutdown(shutdownCtx); err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// Shutdown stops accepting new commands, waits for the in-flight HandleCommand and HandleEvent calls
+// and the work started by Go to drain, and then runs the OnStop hooks in reverse order.
+// If ctx is done before the work drained, the contexts of the in-flight work are canceled,
+// and the OnStop hooks are run once it returned, so they never close resources that are still in use.
+// The first error is returned.
+// Calling Shutdown again waits for the first call, and returns the same error.
+func (b *Bootstrapper) Shutdown(ctx context.Context) error {
+	l := b.lifecycle
+	l.mu.Lock()
+	if l.closing {
+		l.mu.Unlock()
+		select {
+		case <-l.stopped:
+			return l.stopErr
+		case <-ctx.Done():
+			return newContextError(ctx, ctx, "shutdown", 0)
+		}
+	}
+	l.closing = true
+	l.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		l.inFlight.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = newContextError(ctx, ctx, "shutdown: in-flight work did not drain", 0)
+		l.cancelInFlight()
+		<-drained
+	}
+
+	l.mu.Lock()
+	hooks := l.stopHooks
+	l.mu.Unlock()
+	// The hooks are given a chance to close the resources even when ctx is done.
+	stopCtx := rollbackContext(ctx)
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if hookErr := hooks[i](stopCtx); hookErr != nil && err == nil {
+			err = fmt.Errorf("stop hook %d failed: %w", i+1, hookErr)
+		}
+	}
+
+	l.stopErr = err
+	close(l.stopped)
+	return err
+}
+
+// Go runs fn in a new goroutine, which Shutdown waits for. fn should return once its context is done,
+// which happens when the shutdown deadline is exceeded, since the OnStop hooks are not run before it returned.
+// It fails with ErrShuttingDown once Shutdown was called.
+func (b *Bootstrapper) Go(fn func(ctx context.Context)) error {
+	ctx, exit, err := b.lifecycle.enter(context.Background())
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer exit()
+		fn(ctx)
+	}()
+	return nil
+}
+
+// enter registers in-flight work, unless the Bootstrapper is shutting down. It returns the context of the work,
+// which is canceled when the shutdown deadline is exceeded, and the function to call once the work returned.
+func (l *lifecycle) enter(ctx context.Context) (context.Context, func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closing {
+		return nil, nil, WrapError(ErrShuttingDown, ErrShuttingDown.Error(), StatusCodeUnavailable)
+	}
+	l.inFlight.Add(1)
+	ctx, cancel := context.WithCancel(ctx)
+	l.nextID++
+	id := l.nextID
+	l.cancels[id] = cancel
+	exit := func() {
+		l.mu.Lock()
+		delete(l.cancels, id)
+		l.mu.Unlock()
+		cancel()
+		l.inFlight.Done()
+	}
+	return ctx, exit, nil
+}
+
+// cancelInFlight cancels the contexts of the in-flight work.
+func (l *lifecycle) cancelInFlight() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, cancel := range l.cancels {
+		cancel()
+	}
+}
@@ -0,0 +1,229 @@
+package ddd_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStartAndStopHooks(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string, err error) ddd.Hook {
+		return func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, name)
+			return err
+		}
+	}
+	b.OnStart(record("start db", nil))
+	b.OnStart(record("start relay", nil))
+	b.OnStop(record("close db", nil))
+	b.OnStop(record("close relay", errors.New("relay failed")))
+
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if err := b.Start(context.Background()); errors.Is(err, ddd.ErrAlreadyStarted) == false {
+		t.Errorf("want ErrAlreadyStarted, got %v", err)
+	}
+	err := b.Shutdown(context.Background())
+	if err == nil || err.Error() != "stop hook 2 failed: relay failed" {
+		t.Errorf("want the relay stop hook error, got %v", err)
+	}
+	if err = b.Shutdown(context.Background()); err == nil {
+		t.Errorf("want the second Shutdown to return the same error")
+	}
+
+	want := "[start db start relay close relay close db]"
+	if got := fmt.Sprint(calls); got != want {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestShutdownWaitsForInFlightCommands(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{handle: func(ctx context.Context) error {
+			close(started)
+			<-release
+			return nil
+		}}, nil
+	})
+	stopped := false
+	b.OnStop(func(ctx context.Context) error {
+		stopped = true
+		return nil
+	})
+
+	handled := make(chan error)
+	go func() {
+		_, err := b.HandleCommand(context.Background(), &testCommand{})
+		handled <- err
+	}()
+	<-started
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- b.Shutdown(context.Background())
+	}()
+	// Wait for Shutdown to stop accepting new commands.
+	for {
+		_, err := b.HandleCommand(context.Background(), &testCommand{})
+		if errors.Is(err, ddd.ErrShuttingDown) {
+			assertStatusCode(t, err, ddd.StatusCodeUnavailable)
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-shutdown:
+		t.Fatalf("want Shutdown to wait for the in-flight command")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-handled; err != nil {
+		t.Errorf("want the in-flight command to succeed, got %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("want no error, got %v", err)
+	}
+	if stopped == false {
+		t.Errorf("want the stop hook to be called")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	asyncDone := make(chan struct{})
+	err := b.Go(func(ctx context.Context) {
+		defer close(asyncDone)
+		<-ctx.Done()
+	})
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	stopped := false
+	b.OnStop(func(ctx context.Context) error {
+		stopped = ctx.Err() == nil
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = b.Shutdown(ctx)
+
+	assertStatusCode(t, err, ddd.StatusCodeTimeout)
+	if stopped == false {
+		t.Errorf("want the stop hook to be called with a usable context")
+	}
+	select {
+	case <-asyncDone:
+	case <-time.After(time.Second):
+		t.Fatalf("want the async work to be canceled")
+	}
+	if err = b.Go(func(ctx context.Context) {}); errors.Is(err, ddd.ErrShuttingDown) == false {
+		t.Errorf("want ErrShuttingDown, got %v", err)
+	}
+}
+
+func TestShutdownDeadlineCancelsInFlightCommands(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	started := make(chan struct{})
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, name)
+	}
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{handle: func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			time.Sleep(10 * time.Millisecond)
+			record("command returned")
+			return ctx.Err()
+		}}, nil
+	})
+	b.OnStop(func(ctx context.Context) error {
+		record("stop hook")
+		return nil
+	})
+	handled := make(chan error)
+	go func() {
+		_, err := b.HandleCommand(context.Background(), &testCommand{})
+		handled <- err
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := b.Shutdown(ctx)
+
+	assertStatusCode(t, err, ddd.StatusCodeTimeout)
+	assertStatusCode(t, <-handled, ddd.StatusCodeCanceled)
+	want := "[command returned stop hook]"
+	if got := fmt.Sprint(calls); got != want {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestRun(t *testing.T) {
+	t.Run("stops once the context is done", func(t *testing.T) {
+		b := ddd.NewBootstrapper(ddd.WithShutdownTimeout(time.Second))
+		started := make(chan struct{})
+		b.OnStart(func(ctx context.Context) error {
+			close(started)
+			return nil
+		})
+		stopped := false
+		b.OnStop(func(ctx context.Context) error {
+			stopped = true
+			return nil
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() {
+			done <- b.Run(ctx)
+		}()
+		<-started
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("want no error, got %v", err)
+		}
+		if stopped == false {
+			t.Errorf("want the stop hook to be called")
+		}
+	})
+
+	t.Run("returns the start error", func(t *testing.T) {
+		b := ddd.NewBootstrapper()
+		b.OnStart(func(ctx context.Context) error {
+			return errors.New("connection refused")
+		})
+		stopped := false
+		b.OnStop(func(ctx context.Context) error {
+			stopped = true
+			return nil
+		})
+
+		err := b.Run(context.Background())
+		if err == nil || err.Error() != "start hook 1 failed: connection refused" {
+			t.Errorf("want the start error, got %v", err)
+		}
+		if stopped == false {
+			t.Errorf("want the stop hooks to be called")
+		}
+	})
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package ddd
+
+import (
+	"os"
+)
+
+// tryLockFile does nothing on platforms without advisory locks, where a FileEventStore directory
+// should only be opened by a single process.
+func tryLockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package ddd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// tryLockFile acquires an exclusive advisory lock of the file without waiting,
+// and fails with ErrEventStoreLocked when another process (or another open file) holds it.
+func tryLockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrEventStoreLocked
+	}
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %w", file.Name(), err)
+	}
+	return nil
+}
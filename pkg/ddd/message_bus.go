@@ -2,12 +2,47 @@ package ddd
 
 import (
 	"context"
+	"fmt"
+	"time"
 )
 
+// handler is the part that command and event handlers have in common.
+type handler interface {
+	Events() []Event
+	RollbackCommitter
+}
+
+// pendingEvent is an event handler that still has to handle its event within a unit of work of its own.
+type pendingEvent struct {
+	event Event
+	entry eventHandlerEntry
+	node  *TraceNode
+}
+
+// raisedEvent stands for the handler that raised an event outside of the message bus,
+// so the handlers that join its unit of work share one.
+type raisedEvent struct {
+	event Event
+}
+
+func (r *raisedEvent) Events() []Event {
+	return []Event{r.event}
+}
+
+func (r *raisedEvent) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (r *raisedEvent) Rollback(ctx context.Context) error {
+	return nil
+}
+
 type messageBus struct {
 	commandHandlerFactory *commandHandlerFactory
 	eventHandlersFactory  *eventHandlersFactory
-	events                []Event
+	pending               []pendingEvent
+	compensators          []Compensator
+	propagatePanics       bool
 }
 
 func newMessageBus(commandHandlerFactory *commandHandlerFactory, eventHandlersFactory *eventHandlersFactory) *messageBus {
@@ -17,46 +52,197 @@ func newMessageBus(commandHandlerFactory *commandHandlerFactory, eventHandlersFa
 	}
 }
 
-func (m *messageBus) Publish(ctx context.Context, command Command) (any, error) {
-	if err := command.IsValid(); err != nil {
+func (m *messageBus) Publish(ctx context.Context, command Command) (result any, err error) {
+	ctx, node := startTrace(ctx, command)
+	started := time.Now()
+	defer func() {
+		node.done(started, err)
+	}()
+	if err = command.IsValid(); err != nil {
 		return nil, err
 	}
-	handler, err := m.commandHandlerFactory.CreateHandler(command)
+	handler, options, err := m.commandHandlerFactory.CreateHandler(ctx, command)
 	if err != nil {
 		return nil, err
 	}
 
-	uow := commandUnitOfWork{handler}
-	result, err := uow.HandleCommand(ctx, command)
+	where := fmt.Sprintf("command %q handler %T", command.CommandName(), handler)
+	err = m.runUnitOfWork(ctx, node.add(TraceHandler, fmt.Sprintf("%T", handler)), where, handler, options, func(ctx context.Context) (err error) {
+		result, err = handler.Handle(ctx, command)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	m.events = append(m.events, handler.Events()...)
-
 	if err = m.handleEvents(ctx); err != nil {
-		return nil, err
+		return nil, m.compensate(ctx, err)
 	}
 
 	return result, nil
 }
 
+// PublishEvent handles an event that was raised outside of the message bus, as if a handler had raised it.
+func (m *messageBus) PublishEvent(ctx context.Context, event Event) error {
+	where := fmt.Sprintf("event %q", event.EventName())
+	err := m.runUnitOfWork(ctx, nil, where, &raisedEvent{event: event}, handlerOptions{}, func(ctx context.Context) error {
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err = m.handleEvents(ctx); err != nil {
+		return m.compensate(ctx, err)
+	}
+	return nil
+}
+
 func (m *messageBus) handleEvents(ctx context.Context) error {
-	for len(m.events) > 0 {
-		var event Event
-		event, m.events = m.events[0], m.events[1:]
-		handlers, err := m.eventHandlersFactory.CreateHandlers(event)
+	for len(m.pending) > 0 {
+		var p pendingEvent
+		p, m.pending = m.pending[0], m.pending[1:]
+		where := fmt.Sprintf("event %q handler %T", p.event.EventName(), p.entry.handler)
+		err := m.runUnitOfWork(ctx, p.node, where, p.entry.handler, p.entry.options, func(ctx context.Context) error {
+			return p.entry.handler.Handle(ctx, p.event)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runUnitOfWork runs handle within a new unit of work, together with the event handlers that join it,
+// and then either commits or rolls back the unit of work. Its outcome is traced by node (if any).
+func (m *messageBus) runUnitOfWork(parent context.Context, node *TraceNode, where string, h handler, options handlerOptions, handle func(ctx context.Context) error) (err error) {
+	started := time.Now()
+	defer func() {
+		node.done(started, err)
+	}()
+	parent = withTraceNode(parent, node)
+	if err := newContextError(parent, parent, where+" was not started", 0); err != nil {
+		return err
+	}
+	ctx, cancel := options.context(parent)
+	defer cancel()
+	uow := newUnitOfWork()
+	uow.Enlist(h)
+	ctx = withUnitOfWork(ctx, uow)
+
+	err = m.handle(ctx, parent, where, options.timeout, handle)
+	if err == nil {
+		err = m.dispatch(ctx, uow, h.Events())
+	}
+	for err == nil {
+		events := uow.harvest()
+		if len(events) == 0 {
+			break
+		}
+		err = m.dispatch(ctx, uow, events)
+	}
+	if err != nil {
+		rollbackErr := uow.rollback(ctx, where)
+		m.repanic(err)
+		if rollbackErr != nil {
+			return rollbackFailed(err, rollbackErr)
+		}
+		return err
+	}
+	if err = uow.commit(ctx, where); err != nil {
+		m.repanic(err)
+		return err
+	}
+	uow.afterCommit(ctx, where)
+	for _, rc := range uow.enlisted() {
+		m.committed(rc)
+	}
+	return nil
+}
+
+// handle runs handle, and reports panics and interruptions of its context as errors.
+func (m *messageBus) handle(ctx context.Context, parent context.Context, where string, timeout time.Duration, handle func(ctx context.Context) error) error {
+	err := recoverPanic(where, func() error {
+		return handle(ctx)
+	})
+	if err == nil || isContextError(err) {
+		if ctxErr := newContextError(ctx, parent, where+" was interrupted while handling", timeout); ctxErr != nil {
+			err = ctxErr
+		}
+	}
+	return err
+}
+
+// dispatch handles events raised within uow by the handlers that joined it,
+// and queues the other handlers to be run in units of work of their own.
+func (m *messageBus) dispatch(ctx context.Context, uow *UnitOfWork, events []Event) error {
+	for _, event := range events {
+		eventNode := traceNodeFromContext(ctx).add(TraceEvent, event.EventName())
+		entries, err := m.eventHandlersFactory.CreateHandlers(ctx, event)
 		if err != nil {
 			return err
 		}
-		for _, handler := range handlers {
-			uow := eventUnitOfWork{handler}
-			err = uow.HandleEvent(ctx, event)
-			if err != nil {
+		for _, entry := range entries {
+			node := eventNode.add(TraceHandler, fmt.Sprintf("%T", entry.handler))
+			if entry.options.joinUnitOfWork == false {
+				m.pending = append(m.pending, pendingEvent{event: event, entry: entry, node: node})
+				continue
+			}
+			if err = m.handleJoined(ctx, node, uow, event, entry); err != nil {
 				return err
 			}
-			m.events = append(m.events, handler.Events()...)
 		}
 	}
 	return nil
 }
+
+func (m *messageBus) handleJoined(parent context.Context, node *TraceNode, uow *UnitOfWork, event Event, entry eventHandlerEntry) (err error) {
+	started := time.Now()
+	defer func() {
+		node.done(started, err)
+	}()
+	parent = withTraceNode(parent, node)
+	where := fmt.Sprintf("event %q handler %T", event.EventName(), entry.handler)
+	if err := newContextError(parent, parent, where+" was not started", 0); err != nil {
+		return err
+	}
+	ctx, cancel := entry.options.context(parent)
+	defer cancel()
+	uow.Enlist(entry.handler)
+
+	err = m.handle(ctx, parent, where, entry.options.timeout, func(ctx context.Context) error {
+		return entry.handler.Handle(ctx, event)
+	})
+	if err != nil {
+		return err
+	}
+	return m.dispatch(parent, uow, entry.handler.Events())
+}
+
+func (m *messageBus) repanic(err error) {
+	if m.propagatePanics {
+		repanic(err)
+	}
+}
+
+// committed keeps track of committed resources that can be compensated if a later step fails.
+func (m *messageBus) committed(rc RollbackCommitter) {
+	if compensator, ok := rc.(Compensator); ok {
+		m.compensators = append(m.compensators, compensator)
+	}
+}
+
+// compensate runs the compensations of the committed resources in reverse order, after err occurred.
+func (m *messageBus) compensate(ctx context.Context, err error) error {
+	ctx = rollbackContext(ctx)
+	for i := len(m.compensators) - 1; i >= 0; i-- {
+		compensator := m.compensators[i]
+		compensationErr := recoverPanic(fmt.Sprintf("compensator %T", compensator), func() error {
+			return compensator.Compensate(ctx)
+		})
+		if compensationErr != nil {
+			err = &CompensationError{err: err, compensationErr: compensationErr, compensator: compensator}
+		}
+	}
+	m.compensators = nil
+	return err
+}
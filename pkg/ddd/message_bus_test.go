@@ -0,0 +1,238 @@
+package ddd_test
+
+import (
+	"context"
+	"errors"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCommand struct{}
+
+func (c *testCommand) IsValid() error {
+	return nil
+}
+
+func (c *testCommand) CommandName() string {
+	return "testCommand"
+}
+
+type testEvent struct {
+	name string
+}
+
+func (e *testEvent) EventName() string {
+	return e.name
+}
+
+type testCommandHandler struct {
+	handle         func(ctx context.Context) error
+	result         any
+	events         []ddd.Event
+	commitErr      error
+	rollbackErr    error
+	commitCalled   bool
+	rollbackCalled bool
+}
+
+func (h *testCommandHandler) Handle(ctx context.Context, command ddd.Command) (any, error) {
+	if h.handle != nil {
+		return h.result, h.handle(ctx)
+	}
+	return h.result, nil
+}
+
+func (h *testCommandHandler) Events() []ddd.Event {
+	return h.events
+}
+
+func (h *testCommandHandler) Commit(ctx context.Context) error {
+	h.commitCalled = true
+	return h.commitErr
+}
+
+func (h *testCommandHandler) Rollback(ctx context.Context) error {
+	h.rollbackCalled = true
+	return h.rollbackErr
+}
+
+type testEventHandler struct {
+	handle         func(ctx context.Context) error
+	events         []ddd.Event
+	commitErr      error
+	handleCalled   bool
+	commitCalled   bool
+	rollbackCalled bool
+}
+
+func (h *testEventHandler) Handle(ctx context.Context, event ddd.Event) error {
+	h.handleCalled = true
+	if h.handle != nil {
+		return h.handle(ctx)
+	}
+	return nil
+}
+
+func (h *testEventHandler) Events() []ddd.Event {
+	return h.events
+}
+
+func (h *testEventHandler) Commit(ctx context.Context) error {
+	h.commitCalled = true
+	return h.commitErr
+}
+
+func (h *testEventHandler) Rollback(ctx context.Context) error {
+	h.rollbackCalled = true
+	return nil
+}
+
+func assertStatusCode(t *testing.T, err error, statusCode string) {
+	t.Helper()
+	var dddError *ddd.Error
+	if errors.As(err, &dddError) == false {
+		t.Fatalf("want *ddd.Error, got %T (%v)", err, err)
+	}
+	if dddError.StatusCode() != statusCode {
+		t.Errorf("want status code %q, got %q", statusCode, dddError.StatusCode())
+	}
+}
+
+func TestHandleCommandWithCanceledContext(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	handler := &testCommandHandler{}
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return handler, nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := b.HandleCommand(ctx, &testCommand{})
+
+	assertStatusCode(t, err, ddd.StatusCodeCanceled)
+	if errors.Is(err, context.Canceled) == false {
+		t.Errorf("want error to wrap context.Canceled, got %v", err)
+	}
+	if handler.commitCalled || handler.rollbackCalled {
+		t.Error("want the unit of work not to be started")
+	}
+}
+
+func TestCancellationStopsEventCascade(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := ddd.NewBootstrapper()
+	commandHandler := &testCommandHandler{events: []ddd.Event{&testEvent{name: "first"}, &testEvent{name: "second"}}}
+	firstHandler := &testEventHandler{handle: func(ctx context.Context) error {
+		cancel()
+		return nil
+	}}
+	secondHandler := &testEventHandler{}
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return commandHandler, nil
+	})
+	b.RegisterEventHandlerFactory(&testEvent{name: "first"}, func() (ddd.EventHandler, error) {
+		return firstHandler, nil
+	})
+	b.RegisterEventHandlerFactory(&testEvent{name: "second"}, func() (ddd.EventHandler, error) {
+		return secondHandler, nil
+	})
+
+	_, err := b.HandleCommand(ctx, &testCommand{})
+
+	assertStatusCode(t, err, ddd.StatusCodeCanceled)
+	if strings.Contains(err.Error(), `event "first"`) == false {
+		t.Errorf("want error to mention the interrupted event, got %q", err.Error())
+	}
+	if commandHandler.commitCalled == false {
+		t.Error("want command handler to be committed")
+	}
+	if firstHandler.commitCalled || firstHandler.rollbackCalled == false {
+		t.Error("want the interrupted event handler to be rolled back")
+	}
+	if secondHandler.handleCalled {
+		t.Error("want the second event handler not to be called")
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	commandHandler := &testCommandHandler{events: []ddd.Event{&testEvent{name: "slow"}}}
+	eventHandler := &testEventHandler{handle: func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return commandHandler, nil
+	})
+	b.RegisterEventHandlerFactory(&testEvent{name: "slow"}, func() (ddd.EventHandler, error) {
+		return eventHandler, nil
+	}, ddd.WithTimeout(10*time.Millisecond))
+
+	_, err := b.HandleCommand(context.Background(), &testCommand{})
+
+	assertStatusCode(t, err, ddd.StatusCodeTimeout)
+	if errors.Is(err, context.DeadlineExceeded) == false {
+		t.Errorf("want error to wrap context.DeadlineExceeded, got %v", err)
+	}
+	for _, want := range []string{`event "slow"`, "timed out after 10ms"} {
+		if strings.Contains(err.Error(), want) == false {
+			t.Errorf("want %q in error, got %q", want, err.Error())
+		}
+	}
+	if eventHandler.rollbackCalled == false {
+		t.Error("want the timed out event handler to be rolled back")
+	}
+}
+
+func TestHandleEvent(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	joined := &testEventHandler{events: []ddd.Event{&testEvent{name: "cascaded"}}}
+	own := &testEventHandler{}
+	cascaded := &testEventHandler{}
+	b.RegisterEventHandlerFactory(&testEvent{name: "remote"}, func() (ddd.EventHandler, error) {
+		return joined, nil
+	}, ddd.JoinUnitOfWork())
+	b.RegisterEventHandlerFactory(&testEvent{name: "remote"}, func() (ddd.EventHandler, error) {
+		return own, nil
+	})
+	b.RegisterEventHandlerFactory(&testEvent{name: "cascaded"}, func() (ddd.EventHandler, error) {
+		return cascaded, nil
+	})
+
+	if err := b.HandleEvent(context.Background(), &testEvent{name: "remote"}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	for name, handler := range map[string]*testEventHandler{"joined": joined, "own": own, "cascaded": cascaded} {
+		if handler.handleCalled == false || handler.commitCalled == false {
+			t.Errorf("want the %s handler to be handled and committed", name)
+		}
+	}
+
+	b.Shutdown(context.Background())
+	err := b.HandleEvent(context.Background(), &testEvent{name: "remote"})
+	assertStatusCode(t, err, ddd.StatusCodeUnavailable)
+}
+
+func TestHandleEventFailureRollsBackJoinedHandlers(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	first := &testEventHandler{}
+	second := &testEventHandler{handle: func(ctx context.Context) error {
+		return ddd.NewError("second failed", ddd.StatusCodeConflict)
+	}}
+	for _, handler := range []*testEventHandler{first, second} {
+		handler := handler
+		b.RegisterEventHandlerFactory(&testEvent{name: "remote"}, func() (ddd.EventHandler, error) {
+			return handler, nil
+		}, ddd.JoinUnitOfWork())
+	}
+
+	err := b.HandleEvent(context.Background(), &testEvent{name: "remote"})
+
+	assertStatusCode(t, err, ddd.StatusCodeConflict)
+	if first.commitCalled || first.rollbackCalled == false {
+		t.Error("want the handler that shares the unit of work to be rolled back")
+	}
+}
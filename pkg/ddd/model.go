@@ -18,12 +18,30 @@ type Entity interface {
 	Events() []Event
 }
 
+// AggregateRoot interface that should be implemented by entities whose events are harvested by the framework.
+// Repositories can track aggregate roots in the current unit of work (see Track),
+// so that their events are dispatched without any handler code.
+type AggregateRoot interface {
+	Entity
+	PullEvents() []Event
+}
+
 // BaseEntity struct that can be used in Entity compositions, to prevent repetitive boilerplate code.
 type BaseEntity struct {
 	id     string
 	events []Event
 }
 
+// NewBaseEntity initializes a new BaseEntity instance, whose ID is assigned by the given generator.
+// It is meant to be used by the constructors of entities composed of BaseEntity.
+func NewBaseEntity(generator IDGenerator) (BaseEntity, error) {
+	id, err := generator.NewID()
+	if err != nil {
+		return BaseEntity{}, err
+	}
+	return BaseEntity{id: id}, nil
+}
+
 // ID returns the entity's ID.
 func (e *BaseEntity) ID() string {
 	return e.id
@@ -44,4 +62,11 @@ func (e *BaseEntity) AddEvent(event Event) {
 	e.events = append(e.events, event)
 }
 
-var _ Entity = (*BaseEntity)(nil)
+// PullEvents returns the events registered by the entity, and clears them, so they are dispatched only once.
+func (e *BaseEntity) PullEvents() []Event {
+	events := e.events
+	e.events = nil
+	return events
+}
+
+var _ AggregateRoot = (*BaseEntity)(nil)
@@ -0,0 +1,50 @@
+package ddd_test
+
+import (
+	"context"
+	"github.com/vklap/go_ddd/internal/adapters"
+	"github.com/vklap/go_ddd/internal/domain/command_model"
+	"github.com/vklap/go_ddd/internal/entrypoints/boostrapper"
+	"strings"
+	"testing"
+)
+
+func TestPullEvents(t *testing.T) {
+	aUser := &command_model.User{}
+	aUser.SetEmail(mustNewEmail(t, "kamel.amit@thaabet.sy"))
+
+	events := aUser.PullEvents()
+
+	if len(events) != 1 {
+		t.Errorf("want 1 event, got %d", len(events))
+	}
+	if len(aUser.Events()) != 0 {
+		t.Errorf("want events to be cleared, got %v", aUser.Events())
+	}
+}
+
+func TestHarvestedEventsAreDispatchedOnce(t *testing.T) {
+	const newEmail = "eli.cohen@mossad.gov.il"
+	fb := boostrapper.New()
+	aUser := &command_model.User{}
+	aUser.SetID("1")
+	aUser.SetEmail(mustNewEmail(t, "kamel.amit@thaabet.sy"))
+	aUser.PullEvents()
+	fb.Repository.Add(aUser)
+	command := &command_model.SaveUserCommand{Email: newEmail, UserID: aUser.ID()}
+
+	if _, err := fb.Bootstrapper.HandleCommand(context.Background(), command); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	published := fb.PubSubClient.PublishedTo(adapters.EmailChangedTopic)
+	if len(published) != 1 || strings.Contains(string(published[0].Data), newEmail) == false {
+		t.Errorf("want an email changed integration event with %q, got %v", newEmail, published)
+	}
+	if _, err := fb.Bootstrapper.HandleCommand(context.Background(), command); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+
+	if published = fb.PubSubClient.PublishedTo(adapters.EmailChangedTopic); len(published) != 1 {
+		t.Errorf("want the EmailSetEvent not to be dispatched again, got %d integration events", len(published))
+	}
+}
@@ -0,0 +1,58 @@
+package ddd
+
+import (
+	"context"
+	"time"
+)
+
+// BootstrapperOption configures a Bootstrapper created by NewBootstrapper.
+type BootstrapperOption func(*Bootstrapper)
+
+// WithPanicPropagation re-raises panics of handlers after their unit of work was rolled back,
+// instead of turning them into an Error with StatusCodeInternal. It is mostly useful in tests.
+func WithPanicPropagation() BootstrapperOption {
+	return func(b *Bootstrapper) {
+		b.propagatePanics = true
+	}
+}
+
+// HandlerOption configures how the message bus runs a registered handler.
+type HandlerOption func(*handlerOptions)
+
+type handlerOptions struct {
+	timeout        time.Duration
+	joinUnitOfWork bool
+}
+
+// WithTimeout runs the handler (including its commit) with a child context that expires after the given timeout.
+func WithTimeout(timeout time.Duration) HandlerOption {
+	return func(o *handlerOptions) {
+		o.timeout = timeout
+	}
+}
+
+// JoinUnitOfWork runs an event handler within the unit of work of the handler that raised the event
+// (such as the command handler), instead of a unit of work of its own.
+// The event handler is then committed or rolled back together with that handler.
+// It has no effect on command handlers.
+func JoinUnitOfWork() HandlerOption {
+	return func(o *handlerOptions) {
+		o.joinUnitOfWork = true
+	}
+}
+
+func newHandlerOptions(options []HandlerOption) handlerOptions {
+	var o handlerOptions
+	for _, option := range options {
+		option(&o)
+	}
+	return o
+}
+
+// context derives the context the handler should run with.
+func (o handlerOptions) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.timeout > 0 {
+		return context.WithTimeout(ctx, o.timeout)
+	}
+	return context.WithCancel(ctx)
+}
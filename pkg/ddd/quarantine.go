@@ -0,0 +1,343 @@
+package ddd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// QuarantinedMessage is a message that a Consumer gave up on, together with the errors of its delivery attempts.
+type QuarantinedMessage struct {
+	ID            string    `json:"id"`
+	Data          []byte    `json:"data"`
+	Errors        []string  `json:"errors"`
+	Attempts      int       `json:"attempts"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// Quarantine is an interface that should be implemented by stores of poison messages (a.k.a. dead letter queues).
+type Quarantine interface {
+	// Put stores the message, and replaces the message with the same ID if there is one.
+	Put(ctx context.Context, message QuarantinedMessage) error
+	// List returns the stored messages, in the order they were quarantined.
+	List(ctx context.Context) ([]QuarantinedMessage, error)
+	// Remove removes the message with the given ID.
+	Remove(ctx context.Context, id string) error
+}
+
+// DefaultAttemptTTL is the default time the failed delivery attempts of a message are remembered
+// (see WithAttemptTTL).
+const DefaultAttemptTTL = time.Hour
+
+// IdentifiedMessage can be implemented by messages that have a unique ID, which is used to count their delivery
+// attempts. The attempts of other messages are counted by the checksum of their data, so messages without an ID
+// whose data is the same share their count, and are quarantined together (under the same ID) once it reaches
+// the maximum. Messages that may legitimately repeat the same data should therefore have an ID.
+type IdentifiedMessage interface {
+	Message
+	ID() string
+}
+
+// WithQuarantine moves a message to the quarantine (and acknowledges it) once it failed maxAttempts times,
+// instead of negatively acknowledging it forever. Messages that fail with StatusCodeBadRequest,
+// such as the ones that cannot be decoded, are quarantined right away, since delivering them again cannot help.
+// The attempts are counted in memory, so they start over when the process restarts,
+// and they are forgotten once the message is acknowledged or did not fail again for a while (see WithAttemptTTL).
+func WithQuarantine(quarantine Quarantine, maxAttempts int) ConsumerOption {
+	return func(c *Consumer) {
+		c.quarantine = quarantine
+		c.maxAttempts = maxAttempts
+		c.attempts = make(map[string]*failedAttempts)
+	}
+}
+
+// WithAttemptTTL sets the time the failed delivery attempts of a message are remembered after its last failure,
+// so the attempts of messages that are not delivered again (such as the ones handled by another consumer)
+// do not pile up. The default is DefaultAttemptTTL.
+func WithAttemptTTL(ttl time.Duration) ConsumerOption {
+	return func(c *Consumer) {
+		if ttl > 0 {
+			c.attemptTTL = ttl
+		}
+	}
+}
+
+// failedAttempts are the failed delivery attempts of a message.
+type failedAttempts struct {
+	message  QuarantinedMessage
+	failedAt time.Time
+}
+
+// messageID returns the ID of the message, or the checksum of its data if it has none.
+func messageID(message Message) string {
+	if identified, ok := message.(IdentifiedMessage); ok && identified.ID() != "" {
+		return identified.ID()
+	}
+	sum := sha256.Sum256(message.Data())
+	return hex.EncodeToString(sum[:])
+}
+
+// failed records the failed delivery attempt, and returns the message when it should be quarantined.
+func (c *Consumer) failed(message Message, err error) *QuarantinedMessage {
+	id := messageID(message)
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, attempts := range c.attempts {
+		if now.Sub(attempts.failedAt) > c.attemptTTL {
+			delete(c.attempts, key)
+		}
+	}
+	attempts, ok := c.attempts[id]
+	if ok == false {
+		attempts = &failedAttempts{message: QuarantinedMessage{ID: id, Data: message.Data()}}
+		c.attempts[id] = attempts
+	}
+	attempts.failedAt = now
+	attempts.message.Attempts++
+	attempts.message.Errors = append(attempts.message.Errors, err.Error())
+	if attempts.message.Attempts < c.maxAttempts && isBadRequest(err) == false {
+		return nil
+	}
+	delete(c.attempts, id)
+	quarantined := attempts.message
+	quarantined.QuarantinedAt = now.UTC()
+	return &quarantined
+}
+
+// forget forgets the failed delivery attempts of the message.
+func (c *Consumer) forget(message Message) {
+	if c.quarantine == nil {
+		return
+	}
+	id := messageID(message)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.attempts, id)
+}
+
+func isBadRequest(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode() == StatusCodeBadRequest
+}
+
+// Replay handles the quarantined messages with the given IDs again (or all of them, when no ID is given).
+// The messages that are handled successfully are removed from the quarantine,
+// and the errors of the ones that fail again are added to them. It returns the number of messages that succeeded.
+func (c *Consumer) Replay(ctx context.Context, ids ...string) (int, error) {
+	if c.quarantine == nil {
+		return 0, errors.New("consumer has no quarantine")
+	}
+	messages, err := c.quarantine.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	selected := make(map[string]bool)
+	for _, id := range ids {
+		selected[id] = true
+	}
+	replayed := 0
+	for _, message := range messages {
+		if len(ids) > 0 && selected[message.ID] == false {
+			continue
+		}
+		delete(selected, message.ID)
+		if err = c.handle(ctx, &rawMessage{data: message.Data}); err != nil {
+			c.onError(ctx, &rawMessage{data: message.Data}, err)
+			message.Attempts++
+			message.Errors = append(message.Errors, err.Error())
+			if err = c.quarantine.Put(ctx, message); err != nil {
+				return replayed, err
+			}
+			continue
+		}
+		if err = c.quarantine.Remove(ctx, message.ID); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	for id := range selected {
+		return replayed, NewError(fmt.Sprintf("message %q is not quarantined", id), StatusCodeNotFound)
+	}
+	return replayed, nil
+}
+
+// rawMessage is a Message that is not acknowledged anywhere, such as a replayed quarantined message.
+type rawMessage struct {
+	data []byte
+}
+
+func (m *rawMessage) Data() []byte {
+	return m.data
+}
+
+func (m *rawMessage) Ack(ctx context.Context) error {
+	return nil
+}
+
+func (m *rawMessage) Nack(ctx context.Context, err error) error {
+	return nil
+}
+
+// InMemoryQuarantine is a Quarantine that keeps the messages in memory. It is safe for concurrent use.
+type InMemoryQuarantine struct {
+	mu       sync.Mutex
+	messages []QuarantinedMessage
+}
+
+// NewInMemoryQuarantine initializes a new InMemoryQuarantine instance.
+func NewInMemoryQuarantine() *InMemoryQuarantine {
+	return &InMemoryQuarantine{}
+}
+
+// Put stores the message.
+func (q *InMemoryQuarantine) Put(ctx context.Context, message QuarantinedMessage) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i := range q.messages {
+		if q.messages[i].ID == message.ID {
+			q.messages[i] = message
+			return nil
+		}
+	}
+	q.messages = append(q.messages, message)
+	return nil
+}
+
+// List returns the stored messages.
+func (q *InMemoryQuarantine) List(ctx context.Context) ([]QuarantinedMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages := make([]QuarantinedMessage, len(q.messages))
+	copy(messages, q.messages)
+	return messages, nil
+}
+
+// Remove removes the message with the given ID.
+func (q *InMemoryQuarantine) Remove(ctx context.Context, id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i := range q.messages {
+		if q.messages[i].ID == id {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			return nil
+		}
+	}
+	return NewError(fmt.Sprintf("message %q is not quarantined", id), StatusCodeNotFound)
+}
+
+// FileQuarantine is a Quarantine that stores every message as a JSON file within a directory,
+// so the messages survive restarts and can be inspected with any tool.
+type FileQuarantine struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// NewFileQuarantine initializes a new FileQuarantine instance, and creates its directory if needed.
+func NewFileQuarantine(dir string) (*FileQuarantine, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	return &FileQuarantine{dir: dir}, nil
+}
+
+// Put stores the message. The file is written atomically, and is flushed to stable storage
+// before Put returns, since the message is acked (and so dropped by the broker) right after.
+func (q *FileQuarantine) Put(ctx context.Context, message QuarantinedMessage) error {
+	data, err := json.MarshalIndent(message, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode quarantined message: %w", err)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	path := q.path(message.ID)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to write quarantined message: %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write quarantined message: %w", err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write quarantined message: %w", err)
+	}
+	// The rename is only durable once the directory is flushed.
+	return syncDir(q.dir)
+}
+
+// List returns the stored messages.
+func (q *FileQuarantine) List(ctx context.Context) ([]QuarantinedMessage, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(q.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	messages := make([]QuarantinedMessage, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read quarantined message: %w", err)
+		}
+		var message QuarantinedMessage
+		if err = json.Unmarshal(data, &message); err != nil {
+			return nil, fmt.Errorf("failed to decode quarantined message %s: %w", path, err)
+		}
+		messages = append(messages, message)
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].QuarantinedAt.Before(messages[j].QuarantinedAt)
+	})
+	return messages, nil
+}
+
+// Remove removes the message with the given ID.
+func (q *FileQuarantine) Remove(ctx context.Context, id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := os.Remove(q.path(id)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return NewError(fmt.Sprintf("message %q is not quarantined", id), StatusCodeNotFound)
+		}
+		return fmt.Errorf("failed to remove quarantined message: %w", err)
+	}
+	return nil
+}
+
+// path returns the file of the message. IDs with other characters than letters, digits, '-' and '_'
+// are hex encoded, so they cannot point outside of the directory.
+func (q *FileQuarantine) path(id string) string {
+	for _, r := range id {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return filepath.Join(q.dir, "hex-"+hex.EncodeToString([]byte(id))+".json")
+		}
+	}
+	return filepath.Join(q.dir, id+".json")
+}
+
+var _ Quarantine = (*InMemoryQuarantine)(nil)
+var _ Quarantine = (*FileQuarantine)(nil)
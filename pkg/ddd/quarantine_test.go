@@ -0,0 +1,246 @@
+package ddd_test
+
+import (
+	"context"
+	"errors"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"sync"
+	"testing"
+	"time"
+)
+
+// redeliveringSubscriber delivers nacked messages again, until all of them are acked.
+type redeliveringSubscriber struct {
+	data       [][]byte
+	deliveries int
+	mu         sync.Mutex
+}
+
+type redeliveredMessage struct {
+	id        string
+	data      []byte
+	settled   chan<- bool
+	redeliver chan<- *redeliveredMessage
+}
+
+func (m *redeliveredMessage) ID() string {
+	return m.id
+}
+
+func (m *redeliveredMessage) Data() []byte {
+	return m.data
+}
+
+func (m *redeliveredMessage) Ack(ctx context.Context) error {
+	m.settled <- true
+	return nil
+}
+
+func (m *redeliveredMessage) Nack(ctx context.Context, err error) error {
+	m.redeliver <- m
+	return nil
+}
+
+func (s *redeliveringSubscriber) Subscribe(ctx context.Context) (<-chan ddd.Message, error) {
+	messages := make(chan ddd.Message)
+	settled := make(chan bool, len(s.data))
+	redeliver := make(chan *redeliveredMessage, len(s.data))
+	go func() {
+		defer close(messages)
+		queue := make([]*redeliveredMessage, 0, len(s.data))
+		for i, data := range s.data {
+			queue = append(queue, &redeliveredMessage{id: string(rune('a' + i)), data: data, settled: settled, redeliver: redeliver})
+		}
+		for outstanding := len(queue); outstanding > 0; {
+			var next chan ddd.Message
+			var message *redeliveredMessage
+			if len(queue) > 0 {
+				next, message = messages, queue[0]
+			}
+			select {
+			case next <- message:
+				queue = queue[1:]
+				s.mu.Lock()
+				s.deliveries++
+				s.mu.Unlock()
+			case m := <-redeliver:
+				queue = append(queue, m)
+			case <-settled:
+				outstanding--
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return messages, nil
+}
+
+func TestConsumerQuarantinesPoisonMessages(t *testing.T) {
+	codec := ddd.NewCodec()
+	codec.RegisterCommand(&routedCommand{})
+	b := ddd.NewBootstrapper()
+	fail := true
+	b.RegisterCommandHandlerFactory(&routedCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{handle: func(ctx context.Context) error {
+			if fail {
+				return errors.New("database is down")
+			}
+			return nil
+		}}, nil
+	})
+	failing := newTestMessage(t, "routedCommand", &routedCommand{Value: "a"})
+	subscriber := &redeliveringSubscriber{data: [][]byte{failing.data, []byte("not json")}}
+	quarantine := ddd.NewInMemoryQuarantine()
+	consumer := ddd.NewConsumer(b, subscriber, codec, ddd.WithQuarantine(quarantine, 3))
+
+	if err := consumer.Run(context.Background()); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+
+	// The failing message is delivered 3 times, and the message that cannot be decoded only once.
+	if subscriber.deliveries != 4 {
+		t.Errorf("want 4 deliveries, got %d", subscriber.deliveries)
+	}
+	messages, _ := quarantine.List(context.Background())
+	if len(messages) != 2 {
+		t.Fatalf("want 2 quarantined messages, got %d", len(messages))
+	}
+	byID := map[string]ddd.QuarantinedMessage{messages[0].ID: messages[0], messages[1].ID: messages[1]}
+	if m := byID["a"]; m.Attempts != 3 || len(m.Errors) != 3 || string(m.Data) != string(failing.data) {
+		t.Errorf("want message a to be quarantined after 3 attempts, got %+v", m)
+	}
+	if m := byID["b"]; m.Attempts != 1 || string(m.Data) != "not json" {
+		t.Errorf("want message b to be quarantined right away, got %+v", m)
+	}
+
+	fail = false
+	replayed, err := consumer.Replay(context.Background(), "a")
+	if err != nil || replayed != 1 {
+		t.Fatalf("want 1 replayed message and no error, got %d and %v", replayed, err)
+	}
+	replayed, err = consumer.Replay(context.Background())
+	if err != nil || replayed != 0 {
+		t.Fatalf("want no replayed message and no error, got %d and %v", replayed, err)
+	}
+	messages, _ = quarantine.List(context.Background())
+	if len(messages) != 1 || messages[0].ID != "b" || messages[0].Attempts != 2 {
+		t.Errorf("want message b to stay quarantined with 2 attempts, got %+v", messages)
+	}
+	_, err = consumer.Replay(context.Background(), "missing")
+	assertStatusCode(t, err, ddd.StatusCodeNotFound)
+}
+
+func TestConsumerForgetsAttemptsAfterTTL(t *testing.T) {
+	codec := ddd.NewCodec()
+	codec.RegisterCommand(&routedCommand{})
+	b := ddd.NewBootstrapper()
+	b.RegisterCommandHandlerFactory(&routedCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{handle: func(ctx context.Context) error {
+			return errors.New("database is down")
+		}}, nil
+	})
+	for _, tc := range []struct {
+		name            string
+		ttl             time.Duration
+		wantQuarantined int
+	}{
+		{name: "attempts are remembered within the TTL", ttl: time.Minute, wantQuarantined: 1},
+		{name: "attempts are forgotten after the TTL", ttl: time.Millisecond, wantQuarantined: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			quarantine := ddd.NewInMemoryQuarantine()
+			consumer := ddd.NewConsumer(b, &testSubscriber{}, codec, ddd.WithQuarantine(quarantine, 2), ddd.WithAttemptTTL(tc.ttl))
+
+			consumer.Handle(context.Background(), newTestMessage(t, "routedCommand", &routedCommand{Value: "a"}))
+			time.Sleep(10 * time.Millisecond)
+			consumer.Handle(context.Background(), newTestMessage(t, "routedCommand", &routedCommand{Value: "a"}))
+
+			if messages, _ := quarantine.List(context.Background()); len(messages) != tc.wantQuarantined {
+				t.Errorf("want %d quarantined messages, got %d", tc.wantQuarantined, len(messages))
+			}
+		})
+	}
+}
+
+func TestConsumerReplayRecoversPanics(t *testing.T) {
+	codec := ddd.NewCodec()
+	codec.RegisterCommand(&routedCommand{})
+	b := ddd.NewBootstrapper()
+	b.RegisterCommandHandlerFactory(&routedCommand{}, func() (ddd.CommandHandler, error) {
+		panic("factory is broken")
+	})
+	quarantine := ddd.NewInMemoryQuarantine()
+	message := newTestMessage(t, "routedCommand", &routedCommand{Value: "a"})
+	quarantine.Put(context.Background(), ddd.QuarantinedMessage{ID: "a", Data: message.data, Attempts: 1})
+	consumer := ddd.NewConsumer(b, &testSubscriber{}, codec, ddd.WithQuarantine(quarantine, 1))
+
+	replayed, err := consumer.Replay(context.Background())
+
+	if err != nil || replayed != 0 {
+		t.Fatalf("want no replayed message and no error, got %d and %v", replayed, err)
+	}
+	messages, _ := quarantine.List(context.Background())
+	if len(messages) != 1 || messages[0].Attempts != 2 {
+		t.Errorf("want the message to stay quarantined with 2 attempts, got %+v", messages)
+	}
+
+	consumer.Handle(context.Background(), message)
+	if message.acked == false {
+		t.Errorf("want the message to be quarantined again")
+	}
+}
+
+func testQuarantine(t *testing.T, quarantine ddd.Quarantine) {
+	ctx := context.Background()
+	ids := []string{"first", "../second", "third"}
+	for _, id := range ids {
+		if err := quarantine.Put(ctx, ddd.QuarantinedMessage{ID: id, Data: []byte(id), Attempts: 1}); err != nil {
+			t.Fatalf("want no error, got %v", err)
+		}
+	}
+	quarantine.Put(ctx, ddd.QuarantinedMessage{ID: "third", Data: []byte("third"), Attempts: 2})
+
+	messages, err := quarantine.List(ctx)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("want 3 messages, got %d", len(messages))
+	}
+	for _, message := range messages {
+		if string(message.Data) != message.ID {
+			t.Errorf("want the data of %q to be kept, got %q", message.ID, message.Data)
+		}
+		if message.ID == "third" && message.Attempts != 2 {
+			t.Errorf("want the message to be replaced, got %d attempts", message.Attempts)
+		}
+	}
+
+	if err = quarantine.Remove(ctx, "../second"); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	assertStatusCode(t, quarantine.Remove(ctx, "../second"), ddd.StatusCodeNotFound)
+	messages, _ = quarantine.List(ctx)
+	if len(messages) != 2 {
+		t.Errorf("want 2 messages, got %d", len(messages))
+	}
+}
+
+func TestInMemoryQuarantine(t *testing.T) {
+	testQuarantine(t, ddd.NewInMemoryQuarantine())
+}
+
+func TestFileQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	quarantine, err := ddd.NewFileQuarantine(dir)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	testQuarantine(t, quarantine)
+
+	reopened, _ := ddd.NewFileQuarantine(dir)
+	messages, _ := reopened.List(context.Background())
+	if len(messages) != 2 {
+		t.Errorf("want the messages to survive a restart, got %d", len(messages))
+	}
+}
@@ -9,3 +9,20 @@ type RollbackCommitter interface {
 	Commit(ctx context.Context) error
 	Rollback(ctx context.Context) error
 }
+
+// Savepointer can optionally be implemented by resources enlisted in a UnitOfWork (such as repositories),
+// so that the changes of a nested unit of work can be rolled back without rolling back the whole unit of work.
+// The savepoint names are managed by the framework (see UnitOfWork.Nested).
+type Savepointer interface {
+	Savepoint(ctx context.Context, name string) error
+	RollbackTo(ctx context.Context, name string) error
+}
+
+// Repository is a generic interface that can be implemented by repositories of entities.
+type Repository[T Entity] interface {
+	Get(ctx context.Context, id string) (T, error)
+	Save(ctx context.Context, entity T) error
+	Delete(ctx context.Context, id string) error
+	Find(ctx context.Context, specification Specification[T]) ([]T, error)
+	RollbackCommitter
+}
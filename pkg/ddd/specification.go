@@ -0,0 +1,107 @@
+package ddd
+
+// Specification is an interface that should be implemented by business rules that select entities,
+// such as the ones returned by Repository.Find.
+// Specifications can be combined with And, Or and Not, and translated by adapters with a SpecificationVisitor.
+type Specification[T any] interface {
+	IsSatisfiedBy(candidate T) bool
+}
+
+// SpecificationFunc is a function based Specification.
+type SpecificationFunc[T any] func(candidate T) bool
+
+// IsSatisfiedBy calls f(candidate).
+func (f SpecificationFunc[T]) IsSatisfiedBy(candidate T) bool {
+	return f(candidate)
+}
+
+// SpecificationVisitor is an interface that can be implemented by adapters to translate specifications
+// into their own query languages (such as an SQL WHERE clause or a MongoDB filter).
+// VisitAnd, VisitOr and VisitNot receive the combined specifications, which can be visited with Visit.
+// VisitLeaf receives all the other specifications, which are usually told apart with a type switch.
+type SpecificationVisitor[T any] interface {
+	VisitAnd(specifications []Specification[T]) error
+	VisitOr(specifications []Specification[T]) error
+	VisitNot(specification Specification[T]) error
+	VisitLeaf(specification Specification[T]) error
+}
+
+// VisitableSpecification is an interface that can be implemented by composite specifications.
+type VisitableSpecification[T any] interface {
+	Specification[T]
+	Accept(visitor SpecificationVisitor[T]) error
+}
+
+// Visit lets the visitor visit the specification.
+// Specifications that do not implement VisitableSpecification are visited as leaves.
+func Visit[T any](specification Specification[T], visitor SpecificationVisitor[T]) error {
+	if visitable, ok := specification.(VisitableSpecification[T]); ok {
+		return visitable.Accept(visitor)
+	}
+	return visitor.VisitLeaf(specification)
+}
+
+type andSpecification[T any] struct {
+	specifications []Specification[T]
+}
+
+// And returns a Specification that is satisfied when all the given specifications are satisfied.
+func And[T any](specifications ...Specification[T]) Specification[T] {
+	return &andSpecification[T]{specifications: specifications}
+}
+
+func (s *andSpecification[T]) IsSatisfiedBy(candidate T) bool {
+	for _, specification := range s.specifications {
+		if specification.IsSatisfiedBy(candidate) == false {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *andSpecification[T]) Accept(visitor SpecificationVisitor[T]) error {
+	return visitor.VisitAnd(s.specifications)
+}
+
+type orSpecification[T any] struct {
+	specifications []Specification[T]
+}
+
+// Or returns a Specification that is satisfied when at least one of the given specifications is satisfied.
+func Or[T any](specifications ...Specification[T]) Specification[T] {
+	return &orSpecification[T]{specifications: specifications}
+}
+
+func (s *orSpecification[T]) IsSatisfiedBy(candidate T) bool {
+	for _, specification := range s.specifications {
+		if specification.IsSatisfiedBy(candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *orSpecification[T]) Accept(visitor SpecificationVisitor[T]) error {
+	return visitor.VisitOr(s.specifications)
+}
+
+type notSpecification[T any] struct {
+	specification Specification[T]
+}
+
+// Not returns a Specification that is satisfied when the given specification is not satisfied.
+func Not[T any](specification Specification[T]) Specification[T] {
+	return &notSpecification[T]{specification: specification}
+}
+
+func (s *notSpecification[T]) IsSatisfiedBy(candidate T) bool {
+	return s.specification.IsSatisfiedBy(candidate) == false
+}
+
+func (s *notSpecification[T]) Accept(visitor SpecificationVisitor[T]) error {
+	return visitor.VisitNot(s.specification)
+}
+
+var _ VisitableSpecification[any] = (*andSpecification[any])(nil)
+var _ VisitableSpecification[any] = (*orSpecification[any])(nil)
+var _ VisitableSpecification[any] = (*notSpecification[any])(nil)
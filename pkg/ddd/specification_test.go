@@ -0,0 +1,102 @@
+package ddd_test
+
+import (
+	"context"
+	"github.com/vklap/go_ddd/internal/adapters"
+	"github.com/vklap/go_ddd/internal/domain/command_model"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"testing"
+)
+
+func TestSpecificationCombinators(t *testing.T) {
+	even := ddd.SpecificationFunc[int](func(candidate int) bool { return candidate%2 == 0 })
+	positive := ddd.SpecificationFunc[int](func(candidate int) bool { return candidate > 0 })
+
+	data := []struct {
+		candidate     int
+		name          string
+		specification ddd.Specification[int]
+		want          bool
+	}{
+		{candidate: 2, name: "and satisfied", specification: ddd.And[int](even, positive), want: true},
+		{candidate: -2, name: "and not satisfied", specification: ddd.And[int](even, positive), want: false},
+		{candidate: -2, name: "or satisfied", specification: ddd.Or[int](even, positive), want: true},
+		{candidate: -3, name: "or not satisfied", specification: ddd.Or[int](even, positive), want: false},
+		{candidate: 3, name: "not satisfied", specification: ddd.Not[int](even), want: true},
+		{candidate: -3, name: "nested", specification: ddd.Not[int](ddd.Or[int](even, positive)), want: true},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			if got := d.specification.IsSatisfiedBy(d.candidate); got != d.want {
+				t.Errorf("want %v, got %v", d.want, got)
+			}
+		})
+	}
+}
+
+func TestActiveUsersWithUnverifiedEmail(t *testing.T) {
+	ctx := context.Background()
+	active := newTestUser(t, "1", "kamel.amit@thaabet.sy")
+	active.SetActive(true)
+	verified := newTestUser(t, "2", "eli.cohen@mossad.gov.il")
+	verified.SetActive(true)
+	verified.VerifyEmail()
+	inactive := newTestUser(t, "3", "wolfgang.lotz@mossad.gov.il")
+	repository := ddd.NewInMemoryRepository((*command_model.User).Clone)
+	repository.Add(active, verified, inactive)
+
+	users, err := repository.Find(ctx, command_model.ActiveUsersWithUnverifiedEmail())
+
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if len(users) != 1 || users[0].ID() != active.ID() {
+		t.Errorf("want only user %q, got %v", active.ID(), users)
+	}
+}
+
+func TestSpecificationVisitor(t *testing.T) {
+	clause, err := adapters.UserSQLWhereClause(command_model.ActiveUsersWithUnverifiedEmail())
+
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	const want = "(active = TRUE AND NOT (email_verified = TRUE))"
+	if clause != want {
+		t.Errorf("want %q, got %q", want, clause)
+	}
+
+	_, err = adapters.UserSQLWhereClause(ddd.SpecificationFunc[*command_model.User](func(*command_model.User) bool {
+		return true
+	}))
+
+	if err == nil {
+		t.Error("want untranslatable specification to fail, got nil")
+	}
+}
+
+func TestSpecificationVisitorWithoutOperands(t *testing.T) {
+	data := []struct {
+		name          string
+		specification ddd.Specification[*command_model.User]
+		want          string
+	}{
+		{name: "empty and", specification: ddd.And[*command_model.User](), want: "TRUE"},
+		{name: "empty or", specification: ddd.Or[*command_model.User](), want: "FALSE"},
+		{name: "nested", specification: ddd.And[*command_model.User](command_model.ActiveUserSpecification{}, ddd.Not[*command_model.User](ddd.Or[*command_model.User]())), want: "(active = TRUE AND NOT (FALSE))"},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			clause, err := adapters.UserSQLWhereClause(d.specification)
+
+			if err != nil {
+				t.Fatalf("want no error, got %v", err)
+			}
+			if clause != d.want {
+				t.Errorf("want %q, got %q", d.want, clause)
+			}
+		})
+	}
+}
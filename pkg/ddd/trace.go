@@ -0,0 +1,126 @@
+package ddd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TraceKind is the kind of a TraceNode.
+type TraceKind string
+
+const (
+	// TraceCommand is the node of the traced command.
+	TraceCommand TraceKind = "command"
+	// TraceHandler is the node of a command or event handler.
+	TraceHandler TraceKind = "handler"
+	// TraceEvent is the node of an event raised by a handler.
+	TraceEvent TraceKind = "event"
+)
+
+// TraceNode is a step of a traced command: the command, the handlers that ran, and the events they raised.
+type TraceNode struct {
+	Kind TraceKind
+	// Name is the name of the command or event, or the type of the handler.
+	Name string
+	// Err is the error of the command or handler (if any).
+	Err error
+	// Duration is the time it took to handle the command, or to run the handler (including its commit).
+	Duration time.Duration
+	// Children are the handler of a command, the events raised by a handler, or the handlers of an event.
+	Children []*TraceNode
+}
+
+// add adds a child node. Nodes are nil when the command is not traced, and adding to them does nothing.
+func (n *TraceNode) add(kind TraceKind, name string) *TraceNode {
+	if n == nil {
+		return nil
+	}
+	child := &TraceNode{Kind: kind, Name: name}
+	n.Children = append(n.Children, child)
+	return child
+}
+
+// done records the outcome of the node.
+func (n *TraceNode) done(started time.Time, err error) {
+	if n == nil {
+		return
+	}
+	n.Duration = time.Since(started)
+	n.Err = err
+}
+
+// Trace records how a command cascaded into events, and into the handlers of these events.
+type Trace struct {
+	// Root is the node of the traced command, once it was handled.
+	Root *TraceNode
+}
+
+type traceNodeKey struct{}
+
+type traceKey struct{}
+
+// WithTrace returns a context that traces the command handled with it by Bootstrapper.HandleCommand.
+// A Trace records a single command, so the context should not be reused for other commands.
+func WithTrace(ctx context.Context) (context.Context, *Trace) {
+	trace := &Trace{}
+	return context.WithValue(ctx, traceKey{}, trace), trace
+}
+
+// startTrace creates the root node of the command, if ctx is traced.
+func startTrace(ctx context.Context, command Command) (context.Context, *TraceNode) {
+	trace, ok := ctx.Value(traceKey{}).(*Trace)
+	if ok == false {
+		return ctx, nil
+	}
+	trace.Root = &TraceNode{Kind: TraceCommand, Name: command.CommandName()}
+	return withTraceNode(ctx, trace.Root), trace.Root
+}
+
+// withTraceNode returns a context whose events are traced as children of node.
+func withTraceNode(ctx context.Context, node *TraceNode) context.Context {
+	if node == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, traceNodeKey{}, node)
+}
+
+func traceNodeFromContext(ctx context.Context) *TraceNode {
+	node, _ := ctx.Value(traceNodeKey{}).(*TraceNode)
+	return node
+}
+
+// String renders the trace as a tree, such as:
+//
+//	command SaveUserCommand (1.2ms)
+//	└── handler *command_handlers.SaveUserCommandHandler (1.1ms)
+//	    └── event EmailSetEvent
+//	        └── handler *event_handlers.EmailSetEventHandler (0.2ms)
+func (t *Trace) String() string {
+	if t.Root == nil {
+		return ""
+	}
+	var b strings.Builder
+	writeTraceNode(&b, t.Root, "", "")
+	return b.String()
+}
+
+func writeTraceNode(b *strings.Builder, n *TraceNode, prefix string, childPrefix string) {
+	b.WriteString(prefix)
+	b.WriteString(string(n.Kind) + " " + n.Name)
+	if n.Kind != TraceEvent {
+		fmt.Fprintf(b, " (%v)", n.Duration.Round(time.Microsecond))
+	}
+	if n.Err != nil {
+		fmt.Fprintf(b, " failed: %v", n.Err)
+	}
+	b.WriteString("\n")
+	for i, child := range n.Children {
+		if i == len(n.Children)-1 {
+			writeTraceNode(b, child, childPrefix+"└── ", childPrefix+"    ")
+		} else {
+			writeTraceNode(b, child, childPrefix+"├── ", childPrefix+"│   ")
+		}
+	}
+}
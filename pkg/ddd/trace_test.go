@@ -0,0 +1,70 @@
+package ddd_test
+
+import (
+	"context"
+	"errors"
+	"github.com/vklap/go_ddd/internal/domain/command_model"
+	"github.com/vklap/go_ddd/internal/entrypoints/boostrapper"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"regexp"
+	"testing"
+)
+
+func TestTraceRecordsEventCascade(t *testing.T) {
+	fb := boostrapper.New()
+	fb.Repository.Add(newTestUser(t, "1", "kamel.amin@thaabet.sy"))
+
+	ctx, trace := ddd.WithTrace(context.Background())
+	if _, err := fb.Bootstrapper.HandleCommand(ctx, &command_model.SaveUserCommand{UserID: "1", Email: "eli.cohen@mossad.gov.il"}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+
+	want := `command SaveUserCommand (X)
+└── handler *command_handlers.SaveUserCommandHandler (X)
+    └── event EmailSetEvent
+        ├── handler *event_handlers.EmailSetEventHandler (X)
+        │   └── event KPIEvent
+        │       └── handler *event_handlers.KPIEventHandler (X)
+        ├── handler *ddd.eventRecorder (X)
+        └── handler *integration.translatingHandler (X)
+`
+	if got := regexp.MustCompile(`\(\d[^)]*\)`).ReplaceAllString(trace.String(), "(X)"); got != want {
+		t.Errorf("want trace\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestTraceRecordsErrors(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{events: []ddd.Event{&testEvent{name: "acme"}}}, nil
+	})
+	b.RegisterEventHandlerFactory(&testEvent{name: "acme"}, func() (ddd.EventHandler, error) {
+		return &testEventHandler{handle: func(ctx context.Context) error {
+			return errors.New("acme failed")
+		}}, nil
+	})
+
+	ctx, trace := ddd.WithTrace(context.Background())
+	_, err := b.HandleCommand(ctx, &testCommand{})
+
+	if trace.Root == nil || trace.Root.Err != err {
+		t.Fatalf("want the command error to be traced, got %+v", trace.Root)
+	}
+	handler := trace.Root.Children[0].Children[0].Children[0]
+	if handler.Kind != ddd.TraceHandler || handler.Err == nil || handler.Err.Error() != "acme failed" {
+		t.Errorf("want the event handler error to be traced, got %+v", handler)
+	}
+}
+
+func TestBootstrapperIntrospection(t *testing.T) {
+	b := boostrapper.New().Bootstrapper
+	if got := b.CommandNames(); len(got) != 1 || got[0] != "SaveUserCommand" {
+		t.Errorf("want the registered commands, got %v", got)
+	}
+	if got := b.EventNames(); len(got) != 2 || got[0] != "EmailSetEvent" || got[1] != "KPIEvent" {
+		t.Errorf("want the events with handlers, got %v", got)
+	}
+	if got := b.EventHandlerCount("EmailSetEvent"); got != 3 {
+		t.Errorf("want 3 EmailSetEvent handlers, got %d", got)
+	}
+}
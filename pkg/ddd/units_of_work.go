@@ -2,45 +2,286 @@ package ddd
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"runtime/debug"
+	"sync"
 )
 
-type commandUnitOfWork struct {
-	handler CommandHandler
+type unitOfWorkContextKey struct{}
+
+// UnitOfWork commits or rolls back all the RollbackCommitters that were enlisted in it, as a single unit.
+// The framework creates a UnitOfWork for every handler, enlists the handler itself,
+// and passes the UnitOfWork to the handler through the context (see UnitOfWorkFromContext).
+type UnitOfWork struct {
+	mu         sync.Mutex
+	resources  []RollbackCommitter
+	aggregates []AggregateRoot
+	// pending holds the events pulled from the tracked aggregate roots when a nested unit of work started,
+	// which were not harvested yet.
+	pending    []Event
+	hooks      []func(ctx context.Context)
+	savepoints int
+}
+
+func newUnitOfWork() *UnitOfWork {
+	return &UnitOfWork{}
 }
 
-func (uow *commandUnitOfWork) HandleCommand(ctx context.Context, command Command) (result any, err error) {
-	result, err = uow.handler.Handle(ctx, command)
-	if err != nil {
-		rollbackErr := uow.handler.Rollback(ctx)
-		if rollbackErr != nil {
-			return nil, fmt.Errorf("rollback failed with %q after getting %q", rollbackErr, err)
+// Enlist adds rc to the unit of work, so that it is committed or rolled back together with the handler.
+// Resources are committed in the order they were enlisted, and rolled back in the reverse order.
+// Enlisting the same resource more than once, or a nil resource, has no effect.
+func (uow *UnitOfWork) Enlist(rc RollbackCommitter) {
+	if rc == nil {
+		return
+	}
+	uow.mu.Lock()
+	defer uow.mu.Unlock()
+
+	comparable := reflect.TypeOf(rc).Comparable()
+	for _, resource := range uow.resources {
+		if comparable && resource == rc {
+			return
 		}
-		return result, err
 	}
-	err = uow.handler.Commit(ctx)
-	if err != nil {
-		return result, err
+	uow.resources = append(uow.resources, rc)
+}
+
+// Track registers an aggregate root with the unit of work, so that the events it raises are harvested
+// (see AggregateRoot.PullEvents) and dispatched by the framework before the unit of work is committed.
+// Tracking the same aggregate root more than once, or a nil aggregate root, has no effect.
+func (uow *UnitOfWork) Track(aggregate AggregateRoot) {
+	if aggregate == nil {
+		return
 	}
-	return result, nil
+	uow.mu.Lock()
+	defer uow.mu.Unlock()
+
+	comparable := reflect.TypeOf(aggregate).Comparable()
+	for _, tracked := range uow.aggregates {
+		if comparable && tracked == aggregate {
+			return
+		}
+	}
+	uow.aggregates = append(uow.aggregates, aggregate)
 }
 
-type eventUnitOfWork struct {
-	handler EventHandler
+// AfterCommit registers fn to be called once all the enlisted resources were committed, in the order the hooks
+// were registered. It is not called when the unit of work is rolled back, or when the nested unit of work
+// that registered it fails (see Nested).
+// Since the unit of work is committed by then, fn cannot fail it, and should handle its own errors,
+// such as by publishing a notification again later. Panics of fn are recovered and dropped.
+func (uow *UnitOfWork) AfterCommit(fn func(ctx context.Context)) {
+	uow.mu.Lock()
+	defer uow.mu.Unlock()
+
+	uow.hooks = append(uow.hooks, fn)
 }
 
-func (uow *eventUnitOfWork) HandleEvent(ctx context.Context, event Event) (err error) {
-	err = uow.handler.Handle(ctx, event)
-	if err != nil {
-		rollbackErr := uow.handler.Rollback(ctx)
-		if rollbackErr != nil {
-			return fmt.Errorf("rollback failed with %v after getting %v", rollbackErr, err)
-		}
-		return err
+// afterCommit calls the hooks registered by AfterCommit.
+func (uow *UnitOfWork) afterCommit(ctx context.Context, where string) {
+	uow.mu.Lock()
+	hooks := uow.hooks
+	uow.hooks = nil
+	uow.mu.Unlock()
+
+	for _, hook := range hooks {
+		recoverPanic(where+" after commit", func() error {
+			hook(ctx)
+			return nil
+		})
 	}
-	err = uow.handler.Commit(ctx)
-	if err != nil {
-		return err
+}
+
+// harvest pulls the events raised by the tracked aggregate roots since the previous harvest.
+func (uow *UnitOfWork) harvest() []Event {
+	uow.mu.Lock()
+	defer uow.mu.Unlock()
+
+	events := uow.pending
+	uow.pending = nil
+	for _, aggregate := range uow.aggregates {
+		events = append(events, aggregate.PullEvents()...)
+	}
+	return events
+}
+
+func (uow *UnitOfWork) enlisted() []RollbackCommitter {
+	uow.mu.Lock()
+	defer uow.mu.Unlock()
+
+	resources := make([]RollbackCommitter, len(uow.resources))
+	copy(resources, uow.resources)
+	return resources
+}
+
+// commit commits the enlisted resources in order.
+// When one of them fails, it and the following resources are rolled back (on a best-effort basis) in reverse order.
+// The returned error is either nil or a *CommitError.
+func (uow *UnitOfWork) commit(ctx context.Context, where string) error {
+	resources := uow.enlisted()
+	for i, rc := range resources {
+		err := recoverPanic(where+" commit", func() error {
+			return rc.Commit(ctx)
+		})
+		if err != nil {
+			rollbackErr := rollback(ctx, where, resources[i:])
+			return &CommitError{where: where, err: err, rollbackErr: rollbackErr, partial: i > 0}
+		}
 	}
 	return nil
 }
+
+// rollback rolls back the enlisted resources in reverse order.
+func (uow *UnitOfWork) rollback(ctx context.Context, where string) error {
+	return rollback(ctx, where, uow.enlisted())
+}
+
+// rollback rolls back all the resources in reverse order, and returns the first error.
+func rollback(ctx context.Context, where string, resources []RollbackCommitter) error {
+	ctx = rollbackContext(ctx)
+	var err error
+	for i := len(resources) - 1; i >= 0; i-- {
+		rc := resources[i]
+		rollbackErr := recoverPanic(where+" rollback", func() error {
+			return rc.Rollback(ctx)
+		})
+		if rollbackErr != nil && err == nil {
+			err = rollbackErr
+		}
+	}
+	return err
+}
+
+// Nested runs fn within a nested unit of work, so that fn can fail without failing the whole unit of work.
+// Before fn is called, a savepoint is created on every enlisted resource that implements Savepointer.
+// If fn fails, these resources are rolled back to the savepoint, and the resources enlisted by fn are rolled back
+// and removed from the unit of work, as are the hooks it registered with AfterCommit, the aggregate roots it tracked,
+// and the events raised by the tracked aggregate roots while it ran. Changes of resources that do not implement
+// Savepointer are not undone, nor are the changes of the aggregate roots themselves.
+// The error returned by fn is returned as is, unless unwinding the nested unit of work failed as well.
+func (uow *UnitOfWork) Nested(ctx context.Context, fn func(ctx context.Context) error) error {
+	uow.mu.Lock()
+	uow.savepoints++
+	name := fmt.Sprintf("ddd_savepoint_%d", uow.savepoints)
+	resources := make([]RollbackCommitter, len(uow.resources))
+	copy(resources, uow.resources)
+	uow.mu.Unlock()
+
+	var savepointers []Savepointer
+	for _, rc := range resources {
+		savepointer, ok := rc.(Savepointer)
+		if ok == false {
+			continue
+		}
+		if err := savepointer.Savepoint(ctx, name); err != nil {
+			err = fmt.Errorf("failed to create savepoint %q on %T: %w", name, rc, err)
+			if rollbackErr := rollbackTo(ctx, name, savepointers); rollbackErr != nil {
+				return rollbackFailed(err, rollbackErr)
+			}
+			return err
+		}
+		savepointers = append(savepointers, savepointer)
+	}
+
+	// Resources may enlist themselves while creating their savepoint, so the nested scope starts only now.
+	// The events raised so far are set aside, so the ones raised by fn can be told apart.
+	uow.mu.Lock()
+	mark := len(uow.resources)
+	hooks := len(uow.hooks)
+	aggregates := len(uow.aggregates)
+	for _, aggregate := range uow.aggregates {
+		uow.pending = append(uow.pending, aggregate.PullEvents()...)
+	}
+	pending := len(uow.pending)
+	uow.mu.Unlock()
+
+	err := recoverPanic(fmt.Sprintf("nested unit of work %q", name), func() error {
+		return fn(ctx)
+	})
+	if err == nil {
+		return nil
+	}
+
+	uow.mu.Lock()
+	added := uow.resources[mark:]
+	uow.resources = uow.resources[:mark:mark]
+	uow.hooks = uow.hooks[:hooks:hooks]
+	for _, aggregate := range uow.aggregates {
+		aggregate.PullEvents()
+	}
+	uow.aggregates = uow.aggregates[:aggregates:aggregates]
+	if len(uow.pending) > pending {
+		uow.pending = uow.pending[:pending:pending]
+	}
+	uow.mu.Unlock()
+
+	unwindErr := rollback(ctx, name, added)
+	if rollbackErr := rollbackTo(ctx, name, savepointers); rollbackErr != nil && unwindErr == nil {
+		unwindErr = rollbackErr
+	}
+	if unwindErr != nil {
+		return rollbackFailed(err, unwindErr)
+	}
+	return err
+}
+
+// rollbackTo rolls the savepointers back to the savepoint in reverse order, and returns the first error.
+func rollbackTo(ctx context.Context, name string, savepointers []Savepointer) error {
+	ctx = rollbackContext(ctx)
+	var err error
+	for i := len(savepointers) - 1; i >= 0; i-- {
+		if rollbackErr := savepointers[i].RollbackTo(ctx, name); rollbackErr != nil && err == nil {
+			err = rollbackErr
+		}
+	}
+	return err
+}
+
+// UnitOfWorkFromContext returns the unit of work of the currently running handler.
+func UnitOfWorkFromContext(ctx context.Context) (*UnitOfWork, bool) {
+	uow, ok := ctx.Value(unitOfWorkContextKey{}).(*UnitOfWork)
+	return uow, ok
+}
+
+// Track registers an aggregate root with the unit of work found in ctx (see UnitOfWork.Track).
+// It reports whether ctx contained a unit of work.
+func Track(ctx context.Context, aggregate AggregateRoot) bool {
+	uow, ok := UnitOfWorkFromContext(ctx)
+	if ok {
+		uow.Track(aggregate)
+	}
+	return ok
+}
+
+func withUnitOfWork(ctx context.Context, uow *UnitOfWork) context.Context {
+	return context.WithValue(ctx, unitOfWorkContextKey{}, uow)
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// recoverPanic runs fn, and turns a panic into an Error with StatusCodeInternal and the captured stack trace.
+func recoverPanic(where string, fn func() error) (err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			err = newPanicError(where, value, debug.Stack())
+		}
+	}()
+	return fn()
+}
+
+// repanic re-raises the original panic value of an Error created by recoverPanic.
+func repanic(err error) {
+	var dddError *Error
+	if errors.As(err, &dddError) && dddError.panicValue != nil {
+		panic(dddError.panicValue)
+	}
+}
+
+// rollbackFailed reports that rolling back after err failed as well.
+func rollbackFailed(err error, rollbackErr error) error {
+	return &RollbackError{err: err, rollbackErr: rollbackErr}
+}
@@ -0,0 +1,545 @@
+package ddd_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/vklap/go_ddd/internal/adapters"
+	"github.com/vklap/go_ddd/internal/domain/command_model"
+	"github.com/vklap/go_ddd/internal/service_layer/command_handlers"
+	"github.com/vklap/go_ddd/internal/service_layer/event_handlers"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"github.com/vklap/go_ddd/pkg/ddd/broker"
+	"strings"
+	"testing"
+)
+
+func TestEventHandlerPanicIsRecovered(t *testing.T) {
+	// The demo bootstrapper is sealed, so the misconfigured handlers are wired on a bootstrapper of their own.
+	b := ddd.NewBootstrapper()
+	repository := adapters.NewInMemoryRepository()
+	pubSubClient := adapters.NewPubSubClient(broker.NewInMemoryBroker())
+	aUser := &command_model.User{}
+	aUser.SetEmail(mustNewEmail(t, "kamel.amit@thaabet.sy"))
+	aUser.SetID("1")
+	repository.Add(aUser)
+	b.RegisterCommandHandlerFactory(&command_model.SaveUserCommand{}, func() (ddd.CommandHandler, error) {
+		return command_handlers.NewSaveUserCommandHandler(repository), nil
+	})
+	// The KPIEventHandler panics by design when it receives an event of another type.
+	b.RegisterEventHandlerFactory(&command_model.EmailSetEvent{}, func() (ddd.EventHandler, error) {
+		return event_handlers.NewKPIEventHandler(pubSubClient), nil
+	})
+
+	_, err := b.HandleCommand(context.Background(), &command_model.SaveUserCommand{Email: "eli.cohen@mossad.gov.il", UserID: "1"})
+
+	assertStatusCode(t, err, ddd.StatusCodeInternal)
+	dddError := err.(*ddd.Error)
+	if strings.Contains(dddError.Error(), "failed to handle KPI event") == false {
+		t.Errorf("want the panic message in the error, got %q", dddError.Error())
+	}
+	if strings.Contains(dddError.StackTrace(), "KPIEventHandler") == false {
+		t.Errorf("want the stack trace to contain the panicking handler, got %q", dddError.StackTrace())
+	}
+	if pubSubClient.RollbackCalled == false {
+		t.Error("want pubsub rollback to be called")
+	}
+}
+
+func TestCommandHandlerPanicIsPropagated(t *testing.T) {
+	b := ddd.NewBootstrapper(ddd.WithPanicPropagation())
+	handler := &testCommandHandler{handle: func(ctx context.Context) error {
+		panic("boom")
+	}}
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return handler, nil
+	})
+	defer func() {
+		if v := recover(); v != "boom" {
+			t.Errorf("want panic %q, got %v", "boom", v)
+		}
+		if handler.rollbackCalled == false {
+			t.Error("want rollback to be called before the panic is re-raised")
+		}
+	}()
+
+	_, _ = b.HandleCommand(context.Background(), &testCommand{})
+
+	t.Error("want panic, got none")
+}
+
+func TestCommitFailure(t *testing.T) {
+	data := []struct {
+		commitErr   error
+		name        string
+		rollbackErr error
+		stateKnown  bool
+	}{
+		{
+			commitErr:   errors.New("commit failed"),
+			name:        "rolled back",
+			rollbackErr: nil,
+			stateKnown:  true,
+		},
+		{
+			commitErr:   errors.New("commit failed"),
+			name:        "rollback failed",
+			rollbackErr: errors.New("rollback failed"),
+			stateKnown:  false,
+		},
+		{
+			commitErr:   fmt.Errorf("connection lost: %w", ddd.ErrCommitOutcomeUnknown),
+			name:        "commit outcome unknown",
+			rollbackErr: nil,
+			stateKnown:  false,
+		},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			b := ddd.NewBootstrapper()
+			handler := &testCommandHandler{result: "result", commitErr: d.commitErr, rollbackErr: d.rollbackErr}
+			b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+				return handler, nil
+			})
+
+			result, err := b.HandleCommand(context.Background(), &testCommand{})
+
+			if result != nil {
+				t.Errorf("want result nil, got %v", result)
+			}
+			var commitErr *ddd.CommitError
+			if errors.As(err, &commitErr) == false {
+				t.Fatalf("want *ddd.CommitError, got %T (%v)", err, err)
+			}
+			if errors.Is(err, d.commitErr) == false {
+				t.Errorf("want error to wrap %v, got %v", d.commitErr, err)
+			}
+			if commitErr.RollbackError() != d.rollbackErr {
+				t.Errorf("want rollback error %v, got %v", d.rollbackErr, commitErr.RollbackError())
+			}
+			if commitErr.StateKnown() != d.stateKnown {
+				t.Errorf("want state known %v, got %v", d.stateKnown, commitErr.StateKnown())
+			}
+			if handler.rollbackCalled == false {
+				t.Error("want rollback to be called after the failed commit")
+			}
+		})
+	}
+}
+
+func TestRollbackFailureKeepsBothErrors(t *testing.T) {
+	b := ddd.NewBootstrapper()
+	handler := &testCommandHandler{
+		handle: func(ctx context.Context) error {
+			return ddd.NewError("user does not exist", ddd.StatusCodeNotFound)
+		},
+		rollbackErr: fmt.Errorf("connection lost: %w", context.Canceled),
+	}
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return handler, nil
+	})
+
+	_, err := b.HandleCommand(context.Background(), &testCommand{})
+
+	var rollbackErr *ddd.RollbackError
+	if errors.As(err, &rollbackErr) == false {
+		t.Fatalf("want *ddd.RollbackError, got %T (%v)", err, err)
+	}
+	if rollbackErr.RollbackErr() != handler.rollbackErr {
+		t.Errorf("want rollback error %v, got %v", handler.rollbackErr, rollbackErr.RollbackErr())
+	}
+	assertStatusCode(t, err, ddd.StatusCodeNotFound)
+	if errors.Is(err, context.Canceled) == false {
+		t.Errorf("want error to match the rollback error, got %v", err)
+	}
+}
+
+type compensatingCommandHandler struct {
+	testCommandHandler
+	compensated *[]string
+}
+
+func (h *compensatingCommandHandler) Compensate(ctx context.Context) error {
+	*h.compensated = append(*h.compensated, "command")
+	return nil
+}
+
+type compensatingEventHandler struct {
+	testEventHandler
+	compensated     *[]string
+	compensationErr error
+}
+
+func (h *compensatingEventHandler) Compensate(ctx context.Context) error {
+	*h.compensated = append(*h.compensated, "event")
+	return h.compensationErr
+}
+
+func TestCompensationAfterLaterFailure(t *testing.T) {
+	var compensated []string
+	b := ddd.NewBootstrapper()
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		handler := &compensatingCommandHandler{compensated: &compensated}
+		handler.events = []ddd.Event{&testEvent{name: "first"}}
+		return handler, nil
+	})
+	b.RegisterEventHandlerFactory(&testEvent{name: "first"}, func() (ddd.EventHandler, error) {
+		handler := &compensatingEventHandler{compensated: &compensated, compensationErr: errors.New("compensation failed")}
+		handler.events = []ddd.Event{&testEvent{name: "second"}}
+		return handler, nil
+	})
+	b.RegisterEventHandlerFactory(&testEvent{name: "second"}, func() (ddd.EventHandler, error) {
+		return &testEventHandler{handle: func(ctx context.Context) error {
+			return ddd.NewError("second failed", ddd.StatusCodeBadRequest)
+		}}, nil
+	})
+
+	_, err := b.HandleCommand(context.Background(), &testCommand{})
+
+	if strings.Join(compensated, ",") != "event,command" {
+		t.Errorf("want compensations in reverse order, got %v", compensated)
+	}
+	var compensationErr *ddd.CompensationError
+	if errors.As(err, &compensationErr) == false {
+		t.Fatalf("want *ddd.CompensationError, got %T (%v)", err, err)
+	}
+	assertStatusCode(t, err, ddd.StatusCodeBadRequest)
+}
+
+type testResource struct {
+	name      string
+	log       *[]string
+	commitErr error
+}
+
+func (r *testResource) Commit(ctx context.Context) error {
+	*r.log = append(*r.log, "commit "+r.name)
+	return r.commitErr
+}
+
+func (r *testResource) Rollback(ctx context.Context) error {
+	*r.log = append(*r.log, "rollback "+r.name)
+	return nil
+}
+
+func TestEnlistedResources(t *testing.T) {
+	data := []struct {
+		commitErr error
+		name      string
+		want      string
+	}{
+		{
+			commitErr: nil,
+			name:      "committed in order",
+			want:      "commit first,commit second,commit third",
+		},
+		{
+			commitErr: errors.New("commit failed"),
+			name:      "rolled back in reverse order",
+			want:      "commit first,commit second,rollback third,rollback second",
+		},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			var log []string
+			b := ddd.NewBootstrapper()
+			first := &testResource{name: "first", log: &log}
+			second := &testResource{name: "second", log: &log, commitErr: d.commitErr}
+			third := &testResource{name: "third", log: &log}
+			b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+				return &testCommandHandler{handle: func(ctx context.Context) error {
+					uow, ok := ddd.UnitOfWorkFromContext(ctx)
+					if ok == false {
+						return errors.New("unit of work is missing from the context")
+					}
+					uow.Enlist(first)
+					uow.Enlist(second)
+					uow.Enlist(third)
+					uow.Enlist(first)
+					return nil
+				}}, nil
+			})
+
+			_, err := b.HandleCommand(context.Background(), &testCommand{})
+
+			if (err != nil) != (d.commitErr != nil) {
+				t.Errorf("want error %v, got %v", d.commitErr, err)
+			}
+			if got := strings.Join(log, ","); got != d.want {
+				t.Errorf("want %q, got %q", d.want, got)
+			}
+		})
+	}
+}
+
+func TestEnlistAndTrackIgnoreNil(t *testing.T) {
+	var log []string
+	b := ddd.NewBootstrapper()
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{handle: func(ctx context.Context) error {
+			uow, _ := ddd.UnitOfWorkFromContext(ctx)
+			uow.Enlist(nil)
+			uow.Track(nil)
+			ddd.Track(ctx, nil)
+			uow.Enlist(&testResource{name: "first", log: &log})
+			return nil
+		}}, nil
+	})
+
+	if _, err := b.HandleCommand(context.Background(), &testCommand{}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if got := strings.Join(log, ","); got != "commit first" {
+		t.Errorf("want %q, got %q", "commit first", got)
+	}
+}
+
+func TestEventHandlerJoinsCommandUnitOfWork(t *testing.T) {
+	repository := adapters.NewInMemoryRepository()
+	pubSubClient := adapters.NewInMemoryPubSubClient()
+	pubSubClient.NotifyKPIShouldFail = true
+	aUser := &command_model.User{}
+	aUser.SetEmail(mustNewEmail(t, "kamel.amit@thaabet.sy"))
+	aUser.SetID("1")
+	repository.Add(aUser)
+	b := ddd.NewBootstrapper()
+	b.RegisterCommandHandlerFactory(&command_model.SaveUserCommand{}, func() (ddd.CommandHandler, error) {
+		return command_handlers.NewSaveUserCommandHandler(repository), nil
+	})
+	b.RegisterEventHandlerFactory(&command_model.EmailSetEvent{}, func() (ddd.EventHandler, error) {
+		return event_handlers.NewEmailSetEventHandler(), nil
+	}, ddd.JoinUnitOfWork())
+	b.RegisterEventHandlerFactory(&command_model.KPIEvent{}, func() (ddd.EventHandler, error) {
+		return event_handlers.NewKPIEventHandler(pubSubClient), nil
+	}, ddd.JoinUnitOfWork())
+
+	_, err := b.HandleCommand(context.Background(), &command_model.SaveUserCommand{Email: "eli.cohen@mossad.gov.il", UserID: "1"})
+
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+	if repository.CommitCalled {
+		t.Error("want repository commit not to be called")
+	}
+	if repository.RollbackCalled == false || pubSubClient.RollbackCalled == false {
+		t.Error("want both the repository and the pubsub client to be rolled back")
+	}
+}
+
+func TestNestedUnitOfWork(t *testing.T) {
+	data := []struct {
+		name          string
+		nestedErr     error
+		wantEnriched  bool
+		wantResources string
+	}{
+		{
+			name:          "nested unit of work succeeds",
+			nestedErr:     nil,
+			wantEnriched:  true,
+			wantResources: "commit enrichment",
+		},
+		{
+			name:          "nested unit of work fails",
+			nestedErr:     errors.New("enrichment failed"),
+			wantEnriched:  false,
+			wantResources: "rollback enrichment",
+		},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			var log []string
+			repository := adapters.NewInMemoryRepository()
+			user := &command_model.User{}
+			user.SetID("1")
+			enrichedUser := &command_model.User{}
+			enrichedUser.SetID("2")
+			b := ddd.NewBootstrapper()
+			b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+				return &testCommandHandler{handle: func(ctx context.Context) error {
+					uow, _ := ddd.UnitOfWorkFromContext(ctx)
+					uow.Enlist(repository)
+					_ = repository.Save(ctx, user)
+					err := uow.Nested(ctx, func(ctx context.Context) error {
+						uow.Enlist(&testResource{name: "enrichment", log: &log})
+						_ = repository.Save(ctx, enrichedUser)
+						return d.nestedErr
+					})
+					if err != d.nestedErr {
+						t.Errorf("want nested error %v, got %v", d.nestedErr, err)
+					}
+					return nil
+				}}, nil
+			})
+
+			_, err := b.HandleCommand(context.Background(), &testCommand{})
+
+			if err != nil {
+				t.Fatalf("want no error, got %v", err)
+			}
+			if _, err := repository.Get(context.Background(), user.ID()); err != nil {
+				t.Error("want the user saved outside the nested unit of work to be committed")
+			}
+			if _, err := repository.Get(context.Background(), enrichedUser.ID()); (err == nil) != d.wantEnriched {
+				t.Errorf("want the enriched user to be committed %v, got %v", d.wantEnriched, err)
+			}
+			if got := strings.Join(log, ","); got != d.wantResources {
+				t.Errorf("want %q, got %q", d.wantResources, got)
+			}
+		})
+	}
+}
+
+func TestAfterCommit(t *testing.T) {
+	data := []struct {
+		commitErr error
+		name      string
+		want      string
+	}{
+		{
+			commitErr: nil,
+			name:      "called after all the resources were committed",
+			want:      "commit first,commit second,after commit",
+		},
+		{
+			commitErr: errors.New("commit failed"),
+			name:      "not called when the commit fails",
+			want:      "commit first,commit second,rollback second",
+		},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			var log []string
+			b := ddd.NewBootstrapper()
+			b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+				return &testCommandHandler{handle: func(ctx context.Context) error {
+					uow, _ := ddd.UnitOfWorkFromContext(ctx)
+					uow.Enlist(&testResource{name: "first", log: &log})
+					uow.AfterCommit(func(ctx context.Context) {
+						log = append(log, "after commit")
+					})
+					uow.Nested(ctx, func(ctx context.Context) error {
+						uow.AfterCommit(func(ctx context.Context) {
+							log = append(log, "after nested commit")
+						})
+						return errors.New("nested failed")
+					})
+					uow.Enlist(&testResource{name: "second", log: &log, commitErr: d.commitErr})
+					return nil
+				}}, nil
+			})
+
+			_, err := b.HandleCommand(context.Background(), &testCommand{})
+
+			if (err != nil) != (d.commitErr != nil) {
+				t.Errorf("want error %v, got %v", d.commitErr, err)
+			}
+			if got := strings.Join(log, ","); got != d.want {
+				t.Errorf("want %q, got %q", d.want, got)
+			}
+		})
+	}
+}
+
+type testAggregate struct {
+	ddd.BaseEntity
+}
+
+func TestNestedUnitOfWorkDiscardsEventsOnFailure(t *testing.T) {
+	var dispatched []string
+	b := ddd.NewBootstrapper()
+	for _, name := range []string{"outer", "outer in nested", "nested", "discarded"} {
+		name := name
+		b.RegisterEventHandlerFactory(&testEvent{name: name}, func() (ddd.EventHandler, error) {
+			return &testEventHandler{handle: func(ctx context.Context) error {
+				dispatched = append(dispatched, name)
+				return nil
+			}}, nil
+		}, ddd.JoinUnitOfWork())
+	}
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{handle: func(ctx context.Context) error {
+			uow, _ := ddd.UnitOfWorkFromContext(ctx)
+			outer := &testAggregate{}
+			outer.AddEvent(&testEvent{name: "outer"})
+			uow.Track(outer)
+			err := uow.Nested(ctx, func(ctx context.Context) error {
+				outer.AddEvent(&testEvent{name: "outer in nested"})
+				nested := &testAggregate{}
+				nested.AddEvent(&testEvent{name: "nested"})
+				uow.Track(nested)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			uow.Nested(ctx, func(ctx context.Context) error {
+				outer.AddEvent(&testEvent{name: "discarded"})
+				nested := &testAggregate{}
+				nested.AddEvent(&testEvent{name: "discarded"})
+				uow.Track(nested)
+				return errors.New("nested failed")
+			})
+			return nil
+		}}, nil
+	})
+
+	if _, err := b.HandleCommand(context.Background(), &testCommand{}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+
+	want := "outer,outer in nested,nested"
+	if got := strings.Join(dispatched, ","); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+// testSavepointer is a resource that supports savepoints, and records them.
+type testSavepointer struct {
+	testResource
+	savepointErr error
+}
+
+func (r *testSavepointer) Savepoint(ctx context.Context, name string) error {
+	*r.log = append(*r.log, "savepoint "+r.name)
+	return r.savepointErr
+}
+
+func (r *testSavepointer) RollbackTo(ctx context.Context, name string) error {
+	*r.log = append(*r.log, "rollback to "+r.name)
+	return nil
+}
+
+func TestNestedUnitOfWorkSavepointFailure(t *testing.T) {
+	var log []string
+	savepointErr := errors.New("savepoint failed")
+	b := ddd.NewBootstrapper()
+	b.RegisterCommandHandlerFactory(&testCommand{}, func() (ddd.CommandHandler, error) {
+		return &testCommandHandler{handle: func(ctx context.Context) error {
+			uow, _ := ddd.UnitOfWorkFromContext(ctx)
+			uow.Enlist(&testSavepointer{testResource: testResource{name: "first", log: &log}})
+			uow.Enlist(&testSavepointer{testResource: testResource{name: "second", log: &log}, savepointErr: savepointErr})
+			err := uow.Nested(ctx, func(ctx context.Context) error {
+				log = append(log, "nested")
+				return nil
+			})
+			if errors.Is(err, savepointErr) == false {
+				t.Errorf("want the savepoint error, got %v", err)
+			}
+			return nil
+		}}, nil
+	})
+
+	if _, err := b.HandleCommand(context.Background(), &testCommand{}); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+
+	want := "savepoint first,savepoint second,rollback to first,commit first,commit second"
+	if got := strings.Join(log, ","); got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,111 @@
+package ddd
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValueObject interface that should be implemented by value objects.
+// Value objects have no identity: two value objects are equal when their values are equal.
+type ValueObject[T any] interface {
+	Equals(other T) bool
+}
+
+// Validator validates a raw value before it becomes a value object.
+type Validator[T any] func(value T) error
+
+// Value is an immutable value object, which can only be built from a valid raw value (see NewValue).
+type Value[T comparable] struct {
+	value T
+}
+
+// NewValue validates raw with the given validators, and returns it as an immutable Value.
+// The first failed validation is returned as an Error with StatusCodeBadRequest.
+func NewValue[T comparable](raw T, validators ...Validator[T]) (Value[T], error) {
+	for _, validate := range validators {
+		if err := validate(raw); err != nil {
+			return Value[T]{}, asBadRequest(err)
+		}
+	}
+	return Value[T]{value: raw}, nil
+}
+
+// Get returns the raw value.
+func (v Value[T]) Get() T {
+	return v.value
+}
+
+// Equals reports whether both values are equal.
+func (v Value[T]) Equals(other Value[T]) bool {
+	return v.value == other.value
+}
+
+// IsZero reports whether the Value was not built by NewValue, or was built from the zero value of T.
+func (v Value[T]) IsZero() bool {
+	var zero T
+	return v.value == zero
+}
+
+// String returns the raw value formatted with the default format.
+func (v Value[T]) String() string {
+	return fmt.Sprint(v.value)
+}
+
+// MarshalJSON marshals the raw value.
+func (v Value[T]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(v.value)
+}
+
+// UnmarshalJSON unmarshals the raw value, and null as the zero Value.
+// The validators are not part of the Value, so a type that embeds it should validate it after unmarshaling.
+func (v *Value[T]) UnmarshalJSON(data []byte) error {
+	var raw T
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	v.value = raw
+	return nil
+}
+
+// NotEmpty validates that a string contains more than white spaces.
+func NotEmpty(name string) Validator[string] {
+	return func(value string) error {
+		if strings.TrimSpace(value) == "" {
+			return fmt.Errorf("%s cannot be empty", name)
+		}
+		return nil
+	}
+}
+
+// MaxLength validates that a string contains at most limit characters.
+func MaxLength(name string, limit int) Validator[string] {
+	return func(value string) error {
+		if utf8.RuneCountInString(value) > limit {
+			return fmt.Errorf("%s cannot be longer than %d characters", name, limit)
+		}
+		return nil
+	}
+}
+
+// Matches validates that a string matches the given regular expression.
+func Matches(name string, pattern *regexp.Regexp) Validator[string] {
+	return func(value string) error {
+		if pattern.MatchString(value) == false {
+			return fmt.Errorf("%s %q is invalid", name, value)
+		}
+		return nil
+	}
+}
+
+// asBadRequest keeps errors that already have a status code, and turns the others into bad request errors.
+func asBadRequest(err error) error {
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return WrapError(err, err.Error(), StatusCodeBadRequest)
+}
+
+var _ ValueObject[Value[string]] = Value[string]{}
@@ -0,0 +1,162 @@
+package ddd_test
+
+import (
+	"encoding/json"
+	"github.com/vklap/go_ddd/pkg/ddd"
+	"testing"
+)
+
+func mustNewEmail(t *testing.T, raw string) ddd.Email {
+	t.Helper()
+	email, err := ddd.NewEmail(raw)
+	if err != nil {
+		t.Fatalf("want valid email, got %v", err)
+	}
+	return email
+}
+
+func TestNewEmail(t *testing.T) {
+	data := []struct {
+		failed bool
+		name   string
+		raw    string
+		want   string
+	}{
+		{failed: false, name: "valid email", raw: "eli.cohen@mossad.gov.il", want: "eli.cohen@mossad.gov.il"},
+		{failed: false, name: "normalized email", raw: " Eli.Cohen@Mossad.Gov.IL ", want: "Eli.Cohen@mossad.gov.il"},
+		{failed: true, name: "empty email", raw: " "},
+		{failed: true, name: "missing at sign", raw: "eli.cohen"},
+		{failed: true, name: "missing domain", raw: "eli.cohen@localhost"},
+		{failed: true, name: "display name", raw: "Eli Cohen <eli.cohen@mossad.gov.il>"},
+	}
+
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			email, err := ddd.NewEmail(d.raw)
+
+			if d.failed {
+				assertStatusCode(t, err, ddd.StatusCodeBadRequest)
+				return
+			}
+			if err != nil {
+				t.Fatalf("want no error, got %v", err)
+			}
+			if email.String() != d.want {
+				t.Errorf("want %q, got %q", d.want, email.String())
+			}
+		})
+	}
+}
+
+func TestValueObjectEquality(t *testing.T) {
+	usd, _ := ddd.NewMoney(1250, "USD")
+	sameUSD, _ := ddd.NewMoney(1250, "USD")
+	eur, _ := ddd.NewMoney(1250, "EUR")
+
+	if usd.Equals(sameUSD) == false {
+		t.Error("want equal amounts of the same currency to be equal")
+	}
+	if usd.Equals(eur) {
+		t.Error("want equal amounts of different currencies not to be equal")
+	}
+	if _, err := usd.Add(eur); err == nil {
+		t.Error("want adding different currencies to fail")
+	}
+	sum, _ := usd.Add(sameUSD)
+	if sum.Amount() != 2500 {
+		t.Errorf("want amount 2500, got %d", sum.Amount())
+	}
+	if _, err := ddd.NewMoney(1, "usd"); err == nil {
+		t.Error("want invalid currency to fail")
+	}
+}
+
+func TestNewValue(t *testing.T) {
+	name, err := ddd.NewValue("Eli", ddd.NotEmpty("name"), ddd.MaxLength("name", 3))
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	same, _ := ddd.NewValue("Eli")
+	if name.Equals(same) == false {
+		t.Errorf("want %v to equal %v", name, same)
+	}
+
+	_, err = ddd.NewValue("Kamel", ddd.NotEmpty("name"), ddd.MaxLength("name", 3))
+
+	assertStatusCode(t, err, ddd.StatusCodeBadRequest)
+}
+
+func TestValueObjectJSON(t *testing.T) {
+	type profile struct {
+		Email   ddd.Email          `json:"email"`
+		Name    ddd.NonEmptyString `json:"name"`
+		Balance ddd.Money          `json:"balance"`
+	}
+	const valid = `{"email":"eli.cohen@mossad.gov.il","name":"Eli","balance":{"amount":1250,"currency":"USD"}}`
+
+	var p profile
+	if err := json.Unmarshal([]byte(valid), &p); err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatalf("want no error, got %v", err)
+	}
+	if string(data) != valid {
+		t.Errorf("want %s, got %s", valid, data)
+	}
+
+	for _, invalid := range []string{
+		`{"email":"eli.cohen"}`,
+		`{"name":"  "}`,
+		`{"balance":{"amount":1250,"currency":"dollars"}}`,
+	} {
+		if err = json.Unmarshal([]byte(invalid), &p); err == nil {
+			t.Errorf("want %s to fail, got nil", invalid)
+		}
+	}
+}
+
+func TestValueObjectJSONRoundTrip(t *testing.T) {
+	type profile struct {
+		Email    ddd.Email           `json:"email"`
+		Name     ddd.NonEmptyString  `json:"name"`
+		Balance  ddd.Money           `json:"balance"`
+		Nickname ddd.Value[string]   `json:"nickname"`
+		Age      ddd.Value[int]      `json:"age"`
+		Manager  *ddd.NonEmptyString `json:"manager"`
+	}
+	name, _ := ddd.NewNonEmptyString("Eli")
+	balance, _ := ddd.NewMoney(1250, "USD")
+	nickname, _ := ddd.NewValue("Kamel")
+	age, _ := ddd.NewValue(42)
+
+	for _, want := range []profile{
+		{},
+		{Email: mustNewEmail(t, "eli.cohen@mossad.gov.il"), Name: name, Balance: balance, Nickname: nickname, Age: age, Manager: &name},
+	} {
+		data, err := json.Marshal(want)
+		if err != nil {
+			t.Fatalf("want no error, got %v", err)
+		}
+		var got profile
+		if err = json.Unmarshal(data, &got); err != nil {
+			t.Fatalf("want %s to be unmarshaled, got %v", data, err)
+		}
+		if got.Email.Equals(want.Email) == false || got.Name.Equals(want.Name) == false || got.Balance.Equals(want.Balance) == false ||
+			got.Nickname.Equals(want.Nickname) == false || got.Age.Equals(want.Age) == false || (got.Manager == nil) != (want.Manager == nil) {
+			t.Errorf("want %+v, got %+v", want, got)
+		}
+	}
+
+	var p profile
+	if err := json.Unmarshal([]byte(`{"email":null,"name":null,"balance":null,"nickname":null,"age":null}`), &p); err != nil {
+		t.Fatalf("want null to be unmarshaled as the zero value, got %v", err)
+	}
+	if p.Email.IsZero() == false || p.Name.IsZero() == false || p.Balance.IsZero() == false || p.Nickname.IsZero() == false || p.Age.IsZero() == false {
+		t.Errorf("want zero values, got %+v", p)
+	}
+	if err := json.Unmarshal([]byte(`{"balance":{"amount":1250,"currency":""}}`), &p); err == nil {
+		t.Errorf("want money without a currency to fail, got nil")
+	}
+}
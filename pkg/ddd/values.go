@@ -0,0 +1,209 @@
+package ddd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// Email is a value object that holds a valid email address, such as "eli.cohen@mossad.gov.il".
+type Email struct {
+	value string
+}
+
+// NewEmail validates raw, and returns it as an Email.
+// Surrounding white spaces are trimmed, and the domain is lower-cased.
+func NewEmail(raw string) (Email, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return Email{}, NewError("email cannot be empty", StatusCodeBadRequest)
+	}
+	address, err := mail.ParseAddress(raw)
+	if err != nil || address.Name != "" || address.Address != raw {
+		return Email{}, NewError(fmt.Sprintf("email %q is invalid", raw), StatusCodeBadRequest)
+	}
+	at := strings.LastIndex(raw, "@")
+	if strings.Contains(raw[at+1:], ".") == false {
+		return Email{}, NewError(fmt.Sprintf("email %q is invalid", raw), StatusCodeBadRequest)
+	}
+	return Email{value: raw[:at+1] + strings.ToLower(raw[at+1:])}, nil
+}
+
+// String returns the email address.
+func (e Email) String() string {
+	return e.value
+}
+
+// Equals reports whether both emails are equal.
+func (e Email) Equals(other Email) bool {
+	return e.value == other.value
+}
+
+// IsZero reports whether the Email was not built by NewEmail.
+func (e Email) IsZero() bool {
+	return e.value == ""
+}
+
+// MarshalJSON marshals the email as a JSON string.
+func (e Email) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.value)
+}
+
+// UnmarshalJSON unmarshals and validates a JSON string.
+// An empty string or null (such as a marshaled zero Email) is unmarshaled as the zero Email.
+func (e *Email) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw == "" {
+		*e = Email{}
+		return nil
+	}
+	email, err := NewEmail(raw)
+	if err != nil {
+		return err
+	}
+	*e = email
+	return nil
+}
+
+// NonEmptyString is a value object that holds a string which contains more than white spaces.
+type NonEmptyString struct {
+	value string
+}
+
+// NewNonEmptyString validates raw, and returns it as a NonEmptyString.
+func NewNonEmptyString(raw string) (NonEmptyString, error) {
+	if err := NotEmpty("value")(raw); err != nil {
+		return NonEmptyString{}, asBadRequest(err)
+	}
+	return NonEmptyString{value: raw}, nil
+}
+
+// String returns the string.
+func (s NonEmptyString) String() string {
+	return s.value
+}
+
+// Equals reports whether both strings are equal.
+func (s NonEmptyString) Equals(other NonEmptyString) bool {
+	return s.value == other.value
+}
+
+// IsZero reports whether the NonEmptyString was not built by NewNonEmptyString.
+func (s NonEmptyString) IsZero() bool {
+	return s.value == ""
+}
+
+// MarshalJSON marshals the string as a JSON string.
+func (s NonEmptyString) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.value)
+}
+
+// UnmarshalJSON unmarshals and validates a JSON string.
+// An empty string or null (such as a marshaled zero NonEmptyString) is unmarshaled as the zero NonEmptyString.
+func (s *NonEmptyString) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw == "" {
+		*s = NonEmptyString{}
+		return nil
+	}
+	value, err := NewNonEmptyString(raw)
+	if err != nil {
+		return err
+	}
+	*s = value
+	return nil
+}
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Money is a value object that holds an amount of money in the minor unit of its currency (such as cents),
+// and the ISO 4217 code of its currency (such as "USD").
+type Money struct {
+	amount   int64
+	currency string
+}
+
+type moneyJSON struct {
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+// NewMoney validates the currency, and returns the amount as Money.
+func NewMoney(amount int64, currency string) (Money, error) {
+	if err := Matches("currency", currencyPattern)(currency); err != nil {
+		return Money{}, asBadRequest(err)
+	}
+	return Money{amount: amount, currency: currency}, nil
+}
+
+// Amount returns the amount in the minor unit of the currency.
+func (m Money) Amount() int64 {
+	return m.amount
+}
+
+// Currency returns the ISO 4217 code of the currency.
+func (m Money) Currency() string {
+	return m.currency
+}
+
+// Add returns the sum of both amounts, which must be of the same currency.
+func (m Money) Add(other Money) (Money, error) {
+	if m.currency != other.currency {
+		return Money{}, NewError(fmt.Sprintf("cannot add %s to %s", other.currency, m.currency), StatusCodeBadRequest)
+	}
+	return Money{amount: m.amount + other.amount, currency: m.currency}, nil
+}
+
+// Subtract returns the difference of both amounts, which must be of the same currency.
+func (m Money) Subtract(other Money) (Money, error) {
+	if m.currency != other.currency {
+		return Money{}, NewError(fmt.Sprintf("cannot subtract %s from %s", other.currency, m.currency), StatusCodeBadRequest)
+	}
+	return Money{amount: m.amount - other.amount, currency: m.currency}, nil
+}
+
+// Equals reports whether both amounts and currencies are equal.
+func (m Money) Equals(other Money) bool {
+	return m.amount == other.amount && m.currency == other.currency
+}
+
+// IsZero reports whether the Money was not built by NewMoney.
+func (m Money) IsZero() bool {
+	return m.currency == ""
+}
+
+// MarshalJSON marshals the money as a JSON object, such as {"amount":1250,"currency":"USD"}.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(moneyJSON{Amount: m.amount, Currency: m.currency})
+}
+
+// UnmarshalJSON unmarshals and validates a JSON object.
+// An object without an amount and a currency, or null (such as a marshaled zero Money), is unmarshaled as the zero Money.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var raw moneyJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw == (moneyJSON{}) {
+		*m = Money{}
+		return nil
+	}
+	money, err := NewMoney(raw.Amount, raw.Currency)
+	if err != nil {
+		return err
+	}
+	*m = money
+	return nil
+}
+
+var _ ValueObject[Email] = Email{}
+var _ ValueObject[NonEmptyString] = NonEmptyString{}
+var _ ValueObject[Money] = Money{}